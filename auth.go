@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	scopeRead      = "read"
+	scopeBroadcast = "broadcast"
+	scopeAdmin     = "admin"
+
+	apiKeyPrefix = "apikey-"
+
+	// defaultRatePerMinute/defaultBurst 未给key配置限流时使用
+	defaultRatePerMinute = 600
+	defaultBurst         = 20
+)
+
+var validScopes = map[string]bool{scopeRead: true, scopeBroadcast: true, scopeAdmin: true}
+
+// AuthConfig API key认证. 关闭时所有接口都可以直接访问.
+// keys 中的key只保存sha256哈希, db_path 非空时可以通过 /admin/keys 管理保存在LevelDB中的key.
+type AuthConfig struct {
+	Enabled       bool            `json:"enabled"`
+	DbPath        string          `json:"db_path"`
+	RatePerMinute uint64          `json:"rate_per_minute"`
+	Burst         uint64          `json:"burst"`
+	Keys          []*APIKeyConfig `json:"keys"`
+}
+
+// APIKeyConfig 配置文件中的key, rate_per_minute/burst 为0时使用 auth 中的值
+type APIKeyConfig struct {
+	Name          string   `json:"name"`
+	KeyHash       string   `json:"key_hash"`
+	Scopes        []string `json:"scopes"`
+	RatePerMinute uint64   `json:"rate_per_minute"`
+	Burst         uint64   `json:"burst"`
+}
+
+// CORSConfig 允许跨域访问的来源, 为空时允许所有来源
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// APIKey 保存的key记录, Hash 是key的sha256
+type APIKey struct {
+	Name          string   `json:"name"`
+	Hash          string   `json:"hash"`
+	Scopes        []string `json:"scopes"`
+	RatePerMinute uint64   `json:"rate_per_minute"`
+	Burst         uint64   `json:"burst"`
+	Created       uint64   `json:"created"`
+	Static        bool     `json:"static" rlp:"-"` // 来自配置文件, 不能通过接口删除
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		// admin 包含所有权限
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate 校验key的配置
+func (k *APIKeyConfig) Validate() error {
+	if k.Name == "" {
+		return errors.New("name is required")
+	}
+	if hash, err := hex.DecodeString(k.KeyHash); err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("%s: key_hash must be a hex sha256", k.Name)
+	}
+	return validateScopes(k.Scopes)
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyKey(hash string) []byte {
+	return []byte(apiKeyPrefix + hash)
+}
+
+// tokenBucket 每个key的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take 取一个令牌, 不够时返回需要等待的时间
+func (b *tokenBucket) take(ratePerMinute, burst uint64, now time.Time) (bool, time.Duration) {
+	rate := float64(ratePerMinute) / 60
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate == 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Auth 校验请求中的API key、权限和限流
+type Auth struct {
+	cfg    AuthConfig
+	db     *leveldb.DB
+	static map[string]*APIKey
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewAuth db为nil时只使用配置文件中的key
+func NewAuth(cfg AuthConfig, db *leveldb.DB) *Auth {
+	a := &Auth{
+		cfg:     cfg,
+		db:      db,
+		static:  make(map[string]*APIKey),
+		buckets: make(map[string]*tokenBucket),
+	}
+	for _, k := range cfg.Keys {
+		hash := strings.ToLower(k.KeyHash)
+		a.static[hash] = &APIKey{
+			Name:          k.Name,
+			Hash:          hash,
+			Scopes:        k.Scopes,
+			RatePerMinute: k.RatePerMinute,
+			Burst:         k.Burst,
+			Static:        true,
+		}
+	}
+	return a
+}
+
+// openAuth 配置了db_path时打开保存key的数据库
+func openAuth(cfg AuthConfig) (*Auth, error) {
+	if !cfg.Enabled || cfg.DbPath == "" {
+		return NewAuth(cfg, nil), nil
+	}
+	db, err := leveldb.OpenFile(cfg.DbPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuth(cfg, db), nil
+}
+
+// lookup 按key的哈希查找, 先查配置文件再查数据库
+func (a *Auth) lookup(hash string) (*APIKey, error) {
+	if key, ok := a.static[hash]; ok {
+		return key, nil
+	}
+	if a.db == nil {
+		return nil, leveldb.ErrNotFound
+	}
+	data, err := a.db.Get(apiKeyKey(hash), nil)
+	if err != nil {
+		return nil, err
+	}
+	var key APIKey
+	if err := rlp.DecodeBytes(data, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (a *Auth) limits(key *APIKey) (uint64, uint64) {
+	rate, burst := key.RatePerMinute, key.Burst
+	if rate == 0 {
+		rate = a.cfg.RatePerMinute
+	}
+	if rate == 0 {
+		rate = defaultRatePerMinute
+	}
+	if burst == 0 {
+		burst = a.cfg.Burst
+	}
+	if burst == 0 {
+		burst = defaultBurst
+	}
+	return rate, burst
+}
+
+func (a *Auth) allow(key *APIKey, now time.Time) (bool, time.Duration) {
+	rate, burst := a.limits(key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	bucket, ok := a.buckets[key.Hash]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		a.buckets[key.Hash] = bucket
+	}
+	return bucket.take(rate, burst, now)
+}
+
+// requestKey 从 X-API-Key 或 Authorization: Bearer 读取key
+func requestKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Require 返回检查scope的中间件, 认证关闭时直接放行
+func (a *Auth) Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.cfg.Enabled {
+			c.Next()
+			return
+		}
+
+		raw := requestKey(c)
+		if raw == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "missing api key"})
+			return
+		}
+		key, err := a.lookup(hashAPIKey(raw))
+		if err == leveldb.ErrNotFound {
+			c.AbortWithStatusJSON(401, gin.H{"error": "invalid api key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": fmt.Sprintf("api key %s lacks scope %s", key.Name, scope)})
+			return
+		}
+		if ok, wait := a.allow(key, time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(429, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Register 注册key管理接口, 需要admin权限. 认证关闭时不注册.
+func (a *Auth) Register(g *gin.RouterGroup) {
+	if !a.cfg.Enabled {
+		return
+	}
+	admin := g.Group("/admin", a.Require(scopeAdmin))
+	admin.GET("/keys", a.ListKeys)           // 列出所有key, 不返回key本身
+	admin.POST("/keys", a.CreateKey)         // 创建key, 只在响应中返回一次
+	admin.DELETE("/keys/:name", a.DeleteKey) // 删除保存在数据库中的key
+}
+
+func (a *Auth) keys() ([]*APIKey, error) {
+	var keys []*APIKey
+	for _, key := range a.static {
+		keys = append(keys, key)
+	}
+	if a.db == nil {
+		return keys, nil
+	}
+
+	iter := a.db.NewIterator(util.BytesPrefix([]byte(apiKeyPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var key APIKey
+		if err := rlp.DecodeBytes(iter.Value(), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, iter.Error()
+}
+
+func (a *Auth) ListKeys(c *gin.Context) {
+	keys, err := a.keys()
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"keys": keys})
+}
+
+func (a *Auth) CreateKey(c *gin.Context) {
+	if a.db == nil {
+		c.JSON(200, gin.H{"error": "auth.db_path is not configured"})
+		return
+	}
+
+	name := c.PostForm("name")
+	if name == "" {
+		c.JSON(200, gin.H{"error": "name is required"})
+		return
+	}
+	scopes := strings.Split(c.PostForm("scopes"), ",")
+	if err := validateScopes(scopes); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	var limits [2]uint64
+	for i, field := range []string{"rate_per_minute", "burst"} {
+		if v := c.PostForm(field); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				c.JSON(200, gin.H{"error": fmt.Sprintf("%s: %s", field, err)})
+				return
+			}
+			limits[i] = n
+		}
+	}
+
+	keys, err := a.keys()
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	for _, key := range keys {
+		if key.Name == name {
+			c.JSON(200, gin.H{"error": fmt.Sprintf("key %s already exists", name)})
+			return
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	raw := hex.EncodeToString(secret)
+	key := &APIKey{
+		Name:          name,
+		Hash:          hashAPIKey(raw),
+		Scopes:        scopes,
+		RatePerMinute: limits[0],
+		Burst:         limits[1],
+		Created:       uint64(time.Now().Unix()),
+	}
+	data, err := rlp.EncodeToBytes(key)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.db.Put(apiKeyKey(key.Hash), data, nil); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"key": raw, "info": key})
+}
+
+func (a *Auth) DeleteKey(c *gin.Context) {
+	name := c.Param("name")
+	keys, err := a.keys()
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	for _, key := range keys {
+		if key.Name != name {
+			continue
+		}
+		if key.Static {
+			c.JSON(200, gin.H{"error": fmt.Sprintf("key %s is defined in the config file", name)})
+			return
+		}
+		if err := a.db.Delete(apiKeyKey(key.Hash), nil); err != nil {
+			c.JSON(200, gin.H{"error": err.Error()})
+			return
+		}
+		a.mu.Lock()
+		delete(a.buckets, key.Hash)
+		a.mu.Unlock()
+		c.JSON(200, gin.H{"deleted": name})
+		return
+	}
+	c.JSON(200, gin.H{"error": fmt.Sprintf("key %s not found", name)})
+}
+
+// corsMiddleware 只允许配置的来源, 未配置时允许所有来源
+func corsMiddleware(cfg CORSConfig) gin.HandlerFunc {
+	allowed := make(map[string]bool)
+	for _, origin := range cfg.AllowedOrigins {
+		allowed[origin] = true
+	}
+	allowAll := len(allowed) == 0 || allowed["*"]
+
+	return func(c *gin.Context) {
+		if allowAll {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*") // 允许所有来源访问
+		} else if origin := c.GetHeader("Origin"); allowed[origin] {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin) // 只返回匹配的来源
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")                                          // 允许的请求方法
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-API-Key") // 允许的请求头部信息
+		c.Writer.Header().Set("Access-Control-Max-Age", "3600")                                                                           // 预检请求的有效期，单位为秒
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(200)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(60, 2, now); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	ok, wait := b.take(60, 2, now)
+	if ok || wait != time.Second {
+		t.Fatalf("expected to wait 1s, got ok=%v wait=%s", ok, wait)
+	}
+	// 一秒后补充一个令牌
+	if ok, _ := b.take(60, 2, now.Add(time.Second)); !ok {
+		t.Fatal("expected a token after refill")
+	}
+}
+
+func TestAuthRequire(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	gin.SetMode(gin.TestMode)
+	auth := NewAuth(AuthConfig{
+		Enabled: true,
+		Keys: []*APIKeyConfig{
+			{Name: "reader", KeyHash: hashAPIKey("r"), Scopes: []string{scopeRead}, RatePerMinute: 60, Burst: 1},
+			{Name: "root", KeyHash: hashAPIKey("a"), Scopes: []string{scopeAdmin}},
+		},
+	}, ldb)
+	router := gin.New()
+	router.POST("/broadcast", auth.Require(scopeBroadcast), func(c *gin.Context) { c.Status(200) })
+	router.GET("/tip", auth.Require(scopeRead), func(c *gin.Context) { c.Status(200) })
+	auth.Register(&router.RouterGroup)
+
+	request := func(method, path, key string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	cases := []struct {
+		method, path, key string
+		code              int
+	}{
+		{"GET", "/tip", "", http.StatusUnauthorized},
+		{"GET", "/tip", "wrong", http.StatusUnauthorized},
+		{"POST", "/broadcast", "r", http.StatusForbidden},
+		{"GET", "/tip", "r", http.StatusOK},
+		{"GET", "/tip", "r", http.StatusTooManyRequests},
+		{"POST", "/broadcast", "a", http.StatusOK},
+		{"GET", "/admin/keys", "r", http.StatusForbidden},
+		{"GET", "/admin/keys", "a", http.StatusOK},
+	}
+	for i, tc := range cases {
+		if code := request(tc.method, tc.path, tc.key); code != tc.code {
+			t.Fatalf("case %d %s %s: expected %d, got %d", i, tc.method, tc.path, tc.code, code)
+		}
+	}
+}
+
+func TestAuthCreateKey(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	gin.SetMode(gin.TestMode)
+	auth := NewAuth(AuthConfig{
+		Enabled: true,
+		Keys:    []*APIKeyConfig{{Name: "root", KeyHash: hashAPIKey("a"), Scopes: []string{scopeAdmin}}},
+	}, ldb)
+	router := gin.New()
+	router.POST("/broadcast", auth.Require(scopeBroadcast), func(c *gin.Context) { c.Status(200) })
+	auth.Register(&router.RouterGroup)
+
+	form := url.Values{"name": {"wallet"}, "scopes": {"read,broadcast"}}
+	req := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer a")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var created struct {
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Key == "" {
+		t.Fatalf("create key: %s %s", w.Body.String(), created.Error)
+	}
+
+	req = httptest.NewRequest("POST", "/broadcast", nil)
+	req.Header.Set("X-API-Key", created.Key)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected created key to broadcast, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/keys/wallet", nil)
+	req.Header.Set("X-API-Key", "a")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("POST", "/broadcast", nil)
+	req.Header.Set("X-API-Key", created.Key)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected deleted key to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultCacheSize 未配置cache.size时缓存的响应数量
+const defaultCacheSize = 10000
+
+// CacheConfig 余额、UTXO和交易历史响应的缓存, size为负数时关闭
+type CacheConfig struct {
+	Size int `json:"size"`
+}
+
+func (c CacheConfig) size() int {
+	if c.Size == 0 {
+		return defaultCacheSize
+	}
+	return c.Size
+}
+
+type cacheEntry struct {
+	key     string
+	address string
+	value   interface{}
+}
+
+// ResponseCache 按 接口+参数 缓存响应的LRU. 区块提交时删除该区块涉及的地址的缓存,
+// 依赖最新高度的响应需要把高度写进key. nil表示不缓存.
+type ResponseCache struct {
+	mu         sync.Mutex
+	size       int
+	generation uint64 // 每次提交或回滚后加一, 在之前的快照上计算的响应不保存
+	ll         *list.List
+	entries    map[string]*list.Element
+	addresses  map[string]map[string]*list.Element
+}
+
+func NewResponseCache(size int) *ResponseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &ResponseCache{
+		size:      size,
+		ll:        list.New(),
+		entries:   make(map[string]*list.Element),
+		addresses: make(map[string]map[string]*list.Element),
+	}
+}
+
+func (c *ResponseCache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// Generation 返回当前的代数, 在取快照之前读取, 保存响应时传给 Put
+func (c *ResponseCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put 保存在generation代取的快照上计算的响应, 之后有提交或回滚时不保存.
+// 回滚后高度会变低, 所以不能按高度判断快照的新旧.
+func (c *ResponseCache) Put(address, key string, generation uint64, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).value = value
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	elem := c.ll.PushFront(&cacheEntry{key: key, address: address, value: value})
+	c.entries[key] = elem
+	if c.addresses[address] == nil {
+		c.addresses[address] = make(map[string]*list.Element)
+	}
+	c.addresses[address][key] = elem
+
+	for c.ll.Len() > c.size {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+// Invalidate 提交区块后删除它涉及的地址的缓存
+func (c *ResponseCache) Invalidate(addresses map[string]bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for address := range addresses {
+		for _, elem := range c.addresses[address] {
+			c.removeLocked(elem)
+		}
+	}
+}
+
+// Purge 回滚区块后删除所有缓存, 撤销的区块涉及哪些地址没有记录
+func (c *ResponseCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for c.ll.Len() > 0 {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+// Len 返回缓存的响应数量
+func (c *ResponseCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *ResponseCache) removeLocked(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if keys := c.addresses[entry.address]; keys != nil {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.addresses, entry.address)
+		}
+	}
+}
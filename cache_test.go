@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(2)
+	gen := cache.Generation()
+	cache.Put("A", "balance|A", gen, 10)
+	cache.Put("B", "balance|B", gen, 20)
+	cache.Get("balance|A")
+	cache.Put("C", "balance|C", gen, 30)
+	if _, ok := cache.Get("balance|B"); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+
+	// 区块2只涉及A
+	cache.Invalidate(map[string]bool{"A": true})
+	if _, ok := cache.Get("balance|A"); ok {
+		t.Fatal("expected touched address to be invalidated")
+	}
+	if v, ok := cache.Get("balance|C"); !ok || v != 30 {
+		t.Fatal("expected untouched address to stay cached")
+	}
+
+	// 在提交区块2之前的快照上计算的响应不保存
+	cache.Put("A", "balance|A", gen, 10)
+	if _, ok := cache.Get("balance|A"); ok {
+		t.Fatal("expected response from an older snapshot to be dropped")
+	}
+
+	// 回滚后高度变低, 回滚前的快照上计算的响应也不保存
+	gen = cache.Generation()
+	cache.Purge()
+	if cache.Len() != 0 {
+		t.Fatal("expected purge to drop all entries")
+	}
+	cache.Put("C", "balance|C", gen, 31)
+	if _, ok := cache.Get("balance|C"); ok {
+		t.Fatal("expected response from before the rollback to be dropped")
+	}
+	cache.Put("C", "balance|C", cache.Generation(), 29)
+	if v, ok := cache.Get("balance|C"); !ok || v != 29 {
+		t.Fatal("expected response from the current generation to be cached")
+	}
+}
+
+func TestRawDBView(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	db.SetHeight(1)
+	db.SetBalance("A", 1)
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	view, release, err := db.View()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// 下一个区块写了一半
+	db.SetBalance("A", 2)
+	if balance, _ := view.GetBalance("A"); balance != 1 {
+		t.Fatalf("expected committed balance 1, got %v", balance)
+	}
+
+	db.SetHeight(2)
+	db.Commit()
+	if balance, _ := view.GetBalance("A"); balance != 1 {
+		t.Fatalf("expected open view to keep its snapshot, got %v", balance)
+	}
+	next, releaseNext, err := db.View()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseNext()
+	if balance, _ := next.GetBalance("A"); balance != 2 {
+		t.Fatalf("expected new view to see balance 2, got %v", balance)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// ChainContext 一条链的参数、节点连接和数据库, 由该链的State和Router共享
+type ChainContext struct {
+	Name         string
+	FromBlock    int64
+	Params       *chaincfg.Params
+	PowAlgorithm string
+	Node         *NodePool
+	DB           *RawDB
+	Cache        *ResponseCache // nil时不缓存响应
+	Deposits     *DepositLedger // nil时不记录充值
+}
+
+// NewChainContext 按配置连接节点并选出当前节点、打开数据库并完成数据迁移
+func NewChainContext(setting *ChainSetting) (*ChainContext, error) {
+	params, err := setting.Params()
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := setting.PowAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := NewNodePool(setting.Chain.ChainName, setting.Chain.Endpoints())
+	if err != nil {
+		return nil, err
+	}
+	node.Check(true)
+
+	db, err := leveldb.OpenFile(setting.DbPath, nil)
+	if err != nil {
+		node.Shutdown()
+		return nil, fmt.Errorf("leveldb %s: %w", setting.DbPath, err)
+	}
+
+	chain := &ChainContext{
+		Name:         setting.Chain.ChainName,
+		FromBlock:    setting.FromBlock,
+		Params:       params,
+		PowAlgorithm: algorithm,
+		Node:         node,
+		DB:           &RawDB{DB: db, Node: node},
+	}
+	if err := migrate(chain.DB, params); err != nil {
+		chain.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	return chain, nil
+}
+
+// Close 断开节点连接并关闭数据库
+func (c *ChainContext) Close() error {
+	c.Node.Shutdown()
+	return c.DB.Stop()
+}
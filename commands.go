@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+// commands 子命令, 都通过 LoadConfig 加载配置. 没有子命令时执行 serve.
+var commands = map[string]*command{
+	"serve":     {"扫描区块并提供HTTP接口(默认)", cmdServe},
+	"sync":      {"只扫描区块, 不提供HTTP接口", cmdSync},
+	"rollback":  {"-to <height> [-chain <name>]  撤销高于height的区块", cmdRollback},
+	"reindex":   {"-from <height> [-chain <name>]  撤销到height之前并从height重新扫描", cmdReindex},
+	"verify":    {"[-chain <name>]  校验节点、区块链接和余额与utxo是否一致", cmdVerify},
+	"export":    {"[-chain <name>] [-out <file>]  导出数据库为JSONL", cmdExport},
+	"import":    {"[-chain <name>] [-in <file>]  从JSONL导入到空数据库", cmdImport},
+	"inspect":   {"[-chain <name>] [-limit <n>] <key-prefix>  查看指定前缀的记录", cmdInspect},
+	"compact":   {"[-chain <name>]  压缩数据库", cmdCompact},
+	"statement": {"-address <addr>|-wallet <name> [-format csv|jsonl] [-from <date>] [-to <date>] [-out <file>]  导出交易流水", cmdStatement},
+	"config":    {"check  打印生效的配置(隐藏密码)并校验", configCheck},
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: utxo-state [command] [flags]")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].usage)
+	}
+}
+
+// loadCommandConfig 加载并校验配置, 返回未解析的位置参数
+func loadCommandConfig(cfg *Config, fs *flag.FlagSet, args []string) ([]string, error) {
+	rest, err := LoadConfig(cfg, fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return rest, nil
+}
+
+// selectChain 按名称选择一条链, 只有一条链时可以省略
+func selectChain(cfg *Config, name string) (*ChainSetting, error) {
+	settings, err := cfg.ChainSettings()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if len(settings) != 1 {
+			return nil, errors.New("-chain is required when several chains are configured")
+		}
+		return settings[0], nil
+	}
+	for _, setting := range settings {
+		if setting.Chain.ChainName == name {
+			return setting, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown chain %q", name)
+}
+
+// openChainDB 只打开数据库, 不连接节点
+func openChainDB(setting *ChainSetting) (*RawDB, error) {
+	db, err := leveldb.OpenFile(setting.DbPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("leveldb %s: %w", setting.DbPath, err)
+	}
+	return &RawDB{DB: db}, nil
+}
+
+func cmdServe(args []string) error {
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, nil, args); err != nil {
+		return err
+	}
+	settings, err := cfg.ChainSettings()
+	if err != nil {
+		return err
+	}
+	return runIndexer(&cfg, settings, true)
+}
+
+func cmdSync(args []string) error {
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, nil, args); err != nil {
+		return err
+	}
+	settings, err := cfg.ChainSettings()
+	if err != nil {
+		return err
+	}
+	return runIndexer(&cfg, settings, false)
+}
+
+func cmdRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	to := fs.Int64("to", -1, "keep blocks up to this height")
+	chain := fs.String("chain", "", "chain name")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	if *to < 0 {
+		return errors.New("-to is required")
+	}
+
+	setting, err := selectChain(&cfg, *chain)
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	if err := rollbackTo(db, *to); err != nil {
+		return err
+	}
+	fmt.Printf("rolled back %s to height %d\n", setting.Chain.ChainName, *to)
+	return nil
+}
+
+func cmdReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	from := fs.Int64("from", -1, "first height to scan again")
+	chain := fs.String("chain", "", "chain name")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	if *from < 0 {
+		return errors.New("-from is required")
+	}
+
+	settings, err := cfg.ChainSettings()
+	if err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *chain)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		if s.Chain.ChainName == setting.Chain.ChainName {
+			setting = s
+		}
+	}
+
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	if height, err := db.GetHeight(); err == nil && height >= *from {
+		if err := rollbackTo(db, *from-1); err != nil {
+			db.Stop()
+			return err
+		}
+	}
+	db.Stop()
+
+	// 回滚后从指定高度重新扫描, 与sync一样持续运行
+	setting.FromBlock = *from
+	return runIndexer(&cfg, settings, false)
+}
+
+func cmdVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	chain, err := NewChainContext(setting)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	var problems []error
+	s := &State{Node: chain.Node, DB: chain.DB, chain: chain}
+	if err := s.checkChain(); err != nil {
+		problems = append(problems, err)
+	}
+	if err := verifyBlocks(chain.DB); err != nil {
+		problems = append(problems, err)
+	}
+	if err := verifyBalances(chain.DB); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 {
+		return errors.Join(problems...)
+	}
+	fmt.Printf("%s ok\n", chain.Name)
+	return nil
+}
+
+// verifyBlocks 检查从第一个索引的区块到最新区块的哈希链接
+func verifyBlocks(db *RawDB) error {
+	anchor, err := db.GetAnchor()
+	if err != nil {
+		return nil
+	}
+	height, err := db.GetHeight()
+	if err != nil {
+		return nil
+	}
+
+	var prev *Block
+	for h := anchor.Height; h <= height; h++ {
+		block, err := db.GetBlock(h)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", h, err)
+		}
+		if prev != nil && block.PreviousHash != prev.Hash {
+			return fmt.Errorf("%w: block %d links to %s, block %d is %s", errChainMismatch, h, block.PreviousHash, prev.Height, prev.Hash)
+		}
+		prev = block
+	}
+	return nil
+}
+
+// verifyBalances 检查每个地址的余额等于其utxo之和
+func verifyBalances(db *RawDB) error {
+	sums := make(map[string]float64)
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(utxoPrefix)), nil)
+	for iter.Next() {
+		var vin *Vin
+		if err := rlp.DecodeBytes(iter.Value(), &vin); err != nil {
+			iter.Release()
+			return fmt.Errorf("%s: %w", iter.Key(), err)
+		}
+		sums[vin.Owner()] += vin.Value
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	var mismatches []error
+	iter = db.DB.NewIterator(util.BytesPrefix([]byte(balancePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		address := strings.TrimPrefix(string(iter.Key()), balancePrefix)
+		balance, err := db.GetBalance(address)
+		if err != nil {
+			return err
+		}
+		if math.Abs(balance-sums[address]) > 1e-8 {
+			mismatches = append(mismatches, fmt.Errorf("balance %s is %.8f, utxos sum to %.8f", address, balance, sums[address]))
+		}
+		delete(sums, address)
+	}
+	for address, sum := range sums {
+		mismatches = append(mismatches, fmt.Errorf("utxos of %s sum to %.8f without a balance record", address, sum))
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return errors.Join(mismatches...)
+}
+
+// dumpRecord 导出/导入的一行, value为十六进制
+type dumpRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	out := fs.String("out", "", "output file, stdout when empty")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+
+	// 快照保证导出期间扫描写入的数据不会混入
+	snapshot, err := db.DB.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	iter := snapshot.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if err := encoder.Encode(&dumpRecord{Key: string(iter.Key()), Value: hex.EncodeToString(iter.Value())}); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+func cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	in := fs.String("in", "", "input file, stdin when empty")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	iter := db.DB.NewIterator(nil, nil)
+	empty := !iter.First()
+	iter.Release()
+	if !empty {
+		return fmt.Errorf("database %s is not empty", setting.DbPath)
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	batch := new(leveldb.Batch)
+	count := 0
+	for {
+		var record dumpRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", count+1, err)
+		}
+		value, err := hex.DecodeString(record.Value)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", count+1, err)
+		}
+		batch.Put([]byte(record.Key), value)
+		count++
+		if batch.Len() >= 1000 {
+			if err := db.DB.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d records\n", count)
+	return nil
+}
+
+func cmdInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	limit := fs.Int("limit", 20, "maximum number of records")
+	var cfg Config
+	rest, err := loadCommandConfig(&cfg, fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return errors.New("usage: inspect [flags] <key-prefix>")
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(rest[0])), nil)
+	defer iter.Release()
+	for n := 0; n < *limit && iter.Next(); n++ {
+		fmt.Printf("%s\t%s\n", iter.Key(), inspectValue(string(iter.Key()), iter.Value()))
+	}
+	return iter.Error()
+}
+
+// inspectValue 按key前缀解码记录, 无法识别的按原始内容输出
+func inspectValue(key string, value []byte) string {
+	var record interface{}
+	switch {
+	case strings.HasPrefix(key, balanceChangePrefix):
+		record = new(BalanceChange)
+	case strings.HasPrefix(key, addressStatsPrefix):
+		record = new(AddressStats)
+	case strings.HasPrefix(key, utxoAgePrefix):
+		record = new(utxoAge)
+	case strings.HasPrefix(key, walletPrefix):
+		record = new(Wallet)
+	case strings.HasPrefix(key, depositPrefix):
+		record = new(Deposit)
+	case strings.HasPrefix(key, depositEventPrefix):
+		record = new(DepositEvent)
+	case strings.HasPrefix(key, spendPrefix):
+		record = new(Spend)
+	case strings.HasPrefix(key, blockHashPrefix), strings.HasPrefix(key, txAddressPrefix),
+		strings.HasPrefix(key, balancePrefix), strings.HasPrefix(key, nullDataPrefix):
+		return string(value)
+	case strings.HasPrefix(key, blockPrefix):
+		record = new(Block)
+	case strings.HasPrefix(key, voutPrefix), strings.HasPrefix(key, scriptPrefix):
+		record = new(Vout)
+	case strings.HasPrefix(key, utxoPrefix):
+		record = new(Vin)
+	case strings.HasPrefix(key, txPrefix):
+		record = new(Tx)
+	case strings.HasPrefix(key, feePrefix):
+		record = new(BlockFees)
+	default:
+		return string(value)
+	}
+
+	if err := rlp.DecodeBytes(value, record); err != nil {
+		return fmt.Sprintf("%x (%s)", value, err)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Sprintf("%x (%s)", value, err)
+	}
+	return string(data)
+}
+
+func cmdCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	return db.DB.CompactRange(util.Range{})
+}
+
+func cmdStatement(args []string) error {
+	fs := flag.NewFlagSet("statement", flag.ContinueOnError)
+	name := fs.String("chain", "", "chain name")
+	out := fs.String("out", "", "output file, defaults to stdout")
+	req := &StatementRequest{}
+	fs.StringVar(&req.Address, "address", "", "address or script hash")
+	fs.StringVar(&req.Wallet, "wallet", "", "wallet name")
+	fs.StringVar(&req.Format, "format", "csv", "csv or jsonl")
+	fs.Int64Var(&req.FromHeight, "from-height", 0, "first height")
+	fs.Int64Var(&req.ToHeight, "to-height", 0, "last height, 0 for the indexed tip")
+	fs.StringVar(&req.From, "from", "", "first day (2006-01-02) or unix time")
+	fs.StringVar(&req.To, "to", "", "last day (2006-01-02) or unix time")
+	var cfg Config
+	if _, err := loadCommandConfig(&cfg, fs, args); err != nil {
+		return err
+	}
+	setting, err := selectChain(&cfg, *name)
+	if err != nil {
+		return err
+	}
+	params, err := setting.Params()
+	if err != nil {
+		return err
+	}
+	db, err := openChainDB(setting)
+	if err != nil {
+		return err
+	}
+	defer db.Stop()
+
+	s, err := prepareStatement(db, params, req)
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buf := bufio.NewWriter(w)
+	if err := s.Write(buf); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
@@ -1,63 +1,489 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 )
 
+// defaultCoinbaseMaturity 未配置coinbase_maturity时使用比特币的100个区块
+const defaultCoinbaseMaturity = 100
+
+// Config 顶层的 from_block/db_path/chain/chain_config 是单链配置,
+// chains 非空时每一项运行一条链, 服务按 /{chain_name}/... 路由
 type Config struct {
-	FromBlock   int64        `json:"from_block"`
-	DbPath      string       `json:"db_path"`
-	Server      string       `json:"server"`
-	Chain       Chain        `json:"chain"`
-	ChainConfig ChainConfig  `json:"chain_config"`
+	FromBlock   int64           `json:"from_block"`
+	DbPath      string          `json:"db_path"`
+	Server      string          `json:"server"`
+	Chain       Chain           `json:"chain"`
+	ChainConfig ChainConfig     `json:"chain_config"`
+	Chains      []*ChainSetting `json:"chains"`
+	Health      HealthConfig    `json:"health"`
+	Auth        AuthConfig      `json:"auth"`
+	CORS        CORSConfig      `json:"cors"`
+	Cache       CacheConfig     `json:"cache"`
+	Deposits    DepositConfig   `json:"deposits"`
+}
+
+// ChainSetting 单条链的配置
+type ChainSetting struct {
+	FromBlock   int64       `json:"from_block"`
+	DbPath      string      `json:"db_path"`
+	Chain       Chain       `json:"chain"`
+	ChainConfig ChainConfig `json:"chain_config"`
 }
 
+// Chain 节点连接配置. nodes 非空时使用其中的全部节点, 否则使用 rpc/user_name/pass_word
 type Chain struct {
-	ChainName string `json:"chain_name"`
-	RPC       string `json:"rpc"`
-	UserName  string `json:"user_name"`
-	PassWord  string `json:"pass_word"`
+	ChainName  string        `json:"chain_name"`
+	RPC        string        `json:"rpc"`
+	UserName   string        `json:"user_name"`
+	PassWord   string        `json:"pass_word"`
+	CookieFile string        `json:"cookie_file"`
+	Nodes      []RPCEndpoint `json:"nodes"`
+}
+
+// RPCEndpoint 单个节点. cookie_file 指向节点的 .cookie 文件, 设置后代替用户名和密码
+type RPCEndpoint struct {
+	RPC        string `json:"rpc"`
+	UserName   string `json:"user_name"`
+	PassWord   string `json:"pass_word"`
+	CookieFile string `json:"cookie_file"`
 }
 
+// Endpoints 返回该链的全部节点, nodes 中未填写的认证信息使用链上的值
+func (c *Chain) Endpoints() []RPCEndpoint {
+	if len(c.Nodes) == 0 {
+		return []RPCEndpoint{{RPC: c.RPC, UserName: c.UserName, PassWord: c.PassWord, CookieFile: c.CookieFile}}
+	}
+
+	endpoints := make([]RPCEndpoint, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		if node.UserName == "" && node.PassWord == "" && node.CookieFile == "" {
+			node.UserName, node.PassWord, node.CookieFile = c.UserName, c.PassWord, c.CookieFile
+		}
+		endpoints = append(endpoints, node)
+	}
+	return endpoints
+}
+
+// ChainConfig 覆盖 chain_name 对应的内置参数, 未填写的字段使用内置值.
+// chain_name 没有内置参数时地址版本字节和HD版本字节必须填写.
 type ChainConfig struct {
-	PubKeyHashAddrID        int     `json:"pub_key_hash_addr_id"`
-	ScriptHashAddrID        int     `json:"script_hash_addr_id"`
-	PrivateKeyID            int     `json:"private_key_id"`
-	WitnessPubKeyHashAddrID int     `json:"witness_pub_key_hash_addr_id"`
-	WitnessScriptHashAddrID int     `json:"witness_script_hash_addr_id"`
-	HDPublicKeyID           []int   `json:"hd_public_key_id"`
-	HDPrivateKeyID          []int   `json:"hd_private_key_id"`
-	HDCoinType              int     `json:"hd_coin_type"`
+	PubKeyHashAddrID        *int         `json:"pub_key_hash_addr_id"`
+	ScriptHashAddrID        *int         `json:"script_hash_addr_id"`
+	PrivateKeyID            *int         `json:"private_key_id"`
+	WitnessPubKeyHashAddrID *int         `json:"witness_pub_key_hash_addr_id"`
+	WitnessScriptHashAddrID *int         `json:"witness_script_hash_addr_id"`
+	Bech32HRPSegwit         string       `json:"bech32_hrp"`
+	HDPublicKeyID           []int        `json:"hd_public_key_id"`
+	HDPrivateKeyID          []int        `json:"hd_private_key_id"`
+	HDCoinType              *int         `json:"hd_coin_type"`
+	CoinbaseMaturity        int          `json:"coinbase_maturity"`
+	PowAlgorithm            string       `json:"pow_algorithm"`
+	GenesisHash             string       `json:"genesis_hash"`
+	Checkpoints             []Checkpoint `json:"checkpoints"`
 }
 
-func LoadConfig(cfg *Config, filep string) {
+// LoadConfig 按 配置文件 -> 环境变量 -> 命令行参数 的顺序加载配置, 后者覆盖前者.
+// 配置文件由 -config 指定, 兼容旧的第一个位置参数, 默认为 config.json.
+// fs 可以预先注册子命令自己的参数, 为nil时新建. 返回未被解析的位置参数.
+func LoadConfig(cfg *Config, fs *flag.FlagSet, args []string) ([]string, error) {
+	if fs == nil {
+		fs = flag.NewFlagSet("utxo-state", flag.ContinueOnError)
+	}
+	configFile := fs.String("config", "", "config file (.json, .yaml, .yml or .toml)")
+	server := fs.String("server", "", "HTTP listen address")
+	dbPath := fs.String("db-path", "", "leveldb directory")
+	fromBlock := fs.Int64("from-block", 0, "height to start scanning from")
+	chainName := fs.String("chain-name", "", "chain name, selects built-in chain parameters")
+	rpc := fs.String("rpc", "", "node RPC host:port")
+	rpcUser := fs.String("rpc-user", "", "node RPC user")
+	rpcPassword := fs.String("rpc-password", "", "node RPC password")
+	rpcCookie := fs.String("rpc-cookie-file", "", "node RPC cookie file")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	rest := fs.Args()
+
+	fileName := *configFile
+	if fileName == "" && len(rest) > 0 && isConfigFile(rest[0]) {
+		fileName, rest = rest[0], rest[1:]
+	}
+	if fileName == "" {
+		fileName = "config.json"
+	}
+	fileName, _ = filepath.Abs(fileName)
+	log.Printf("Loading config: %v", fileName)
 
-	// Default config.
-	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if err := loadConfigFile(cfg, fileName); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
 	}
 
-	configFileName, _ = filepath.Abs(configFileName)
-	log.Printf("Loading config: %v", configFileName)
+	// 只覆盖显式传入的参数
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			cfg.Server = *server
+		case "db-path":
+			cfg.DbPath = *dbPath
+		case "from-block":
+			cfg.FromBlock = *fromBlock
+		case "chain-name":
+			cfg.Chain.ChainName = *chainName
+		case "rpc":
+			cfg.Chain.RPC = *rpc
+		case "rpc-user":
+			cfg.Chain.UserName = *rpcUser
+		case "rpc-password":
+			cfg.Chain.PassWord = *rpcPassword
+		case "rpc-cookie-file":
+			cfg.Chain.CookieFile = *rpcCookie
+		}
+	})
+	return rest, nil
+}
 
-	if filep != "" {
-		configFileName = filep
+func isConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
 	}
-	configFile, err := os.Open(configFileName)
+	return false
+}
+
+// loadConfigFile 按扩展名解析配置文件. YAML和TOML先转换为JSON, 字段名与JSON一致.
+func loadConfigFile(cfg *Config, fileName string) error {
+	data, err := os.ReadFile(fileName)
 	if err != nil {
-		log.Fatal("File error: ", err.Error())
+		return fmt.Errorf("config file: %w", err)
 	}
-	defer configFile.Close()
-	jsonParser := json.NewDecoder(configFile)
-	if err := jsonParser.Decode(&cfg); err != nil {
-		log.Fatal("Config error: ", err.Error())
+
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("config file %s: %w", fileName, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("config file %s: %w", fileName, err)
+		}
 	}
+	if raw != nil {
+		if data, err = json.Marshal(raw); err != nil {
+			return fmt.Errorf("config file %s: %w", fileName, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("config file %s: %w", fileName, err)
+	}
+	return nil
 }
 
+// applyEnv 用环境变量覆盖配置. UTXO_* 作用于顶层的单链配置,
+// UTXO_<CHAIN>_* 作用于 chains 中 chain_name 为 <chain> 的链 (大写, - 换成 _).
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if v, ok := lookup("UTXO_SERVER"); ok {
+		cfg.Server = v
+	}
+	if v, ok := lookup("UTXO_CHAIN_NAME"); ok {
+		cfg.Chain.ChainName = v
+	}
+
+	settings := []*ChainSetting{{FromBlock: cfg.FromBlock, DbPath: cfg.DbPath, Chain: cfg.Chain}}
+	prefixes := []string{"UTXO_"}
+	for _, setting := range cfg.Chains {
+		settings = append(settings, setting)
+		prefixes = append(prefixes, "UTXO_"+strings.ToUpper(strings.ReplaceAll(setting.Chain.ChainName, "-", "_"))+"_")
+	}
+
+	for i, setting := range settings {
+		prefix := prefixes[i]
+		if v, ok := lookup(prefix + "DB_PATH"); ok {
+			setting.DbPath = v
+		}
+		if v, ok := lookup(prefix + "FROM_BLOCK"); ok {
+			height, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%sFROM_BLOCK: %w", prefix, err)
+			}
+			setting.FromBlock = height
+		}
+		if v, ok := lookup(prefix + "RPC"); ok {
+			setting.Chain.RPC = v
+		}
+		if v, ok := lookup(prefix + "RPC_USER"); ok {
+			setting.Chain.UserName = v
+		}
+		if v, ok := lookup(prefix + "RPC_PASSWORD"); ok {
+			setting.Chain.PassWord = v
+		}
+		if v, ok := lookup(prefix + "RPC_COOKIE_FILE"); ok {
+			setting.Chain.CookieFile = v
+		}
+	}
+
+	cfg.FromBlock, cfg.DbPath, cfg.Chain = settings[0].FromBlock, settings[0].DbPath, settings[0].Chain
+	return nil
+}
+
+// Validate 校验全部配置, 一次返回所有错误
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.Server == "" {
+		errs = append(errs, errors.New("server is required"))
+	}
+
+	if cfg.Health.MaxLagBlocks < 0 {
+		errs = append(errs, fmt.Errorf("health: max_lag_blocks %d is negative", cfg.Health.MaxLagBlocks))
+	}
+	if cfg.Health.MaxScanAge < 0 {
+		errs = append(errs, fmt.Errorf("health: max_scan_age %d is negative", cfg.Health.MaxScanAge))
+	}
+
+	if err := cfg.Deposits.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("deposits: %w", err))
+	}
+
+	if cfg.Auth.Enabled {
+		if len(cfg.Auth.Keys) == 0 && cfg.Auth.DbPath == "" {
+			errs = append(errs, errors.New("auth: keys or db_path is required when enabled"))
+		}
+		for i, key := range cfg.Auth.Keys {
+			if err := key.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("auth: key %d: %w", i, err))
+			}
+		}
+	}
+
+	settings, err := cfg.ChainSettings()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, setting := range settings {
+		name := setting.Chain.ChainName
+		if name == "" {
+			name = "chain"
+		}
+		if setting.DbPath == "" {
+			errs = append(errs, fmt.Errorf("%s: db_path is required", name))
+		}
+		if setting.FromBlock < 0 {
+			errs = append(errs, fmt.Errorf("%s: from_block %d is negative", name, setting.FromBlock))
+		}
+		for i, endpoint := range setting.Chain.Endpoints() {
+			if endpoint.RPC == "" {
+				errs = append(errs, fmt.Errorf("%s: node %d: rpc is required", name, i))
+			}
+			if endpoint.CookieFile != "" && endpoint.PassWord != "" {
+				errs = append(errs, fmt.Errorf("%s: node %d: set either pass_word or cookie_file, not both", name, i))
+			}
+			if endpoint.CookieFile != "" {
+				if _, err := os.Stat(endpoint.CookieFile); err != nil {
+					errs = append(errs, fmt.Errorf("%s: node %d: cookie_file: %w", name, i, err))
+				}
+			}
+		}
+		if _, err := setting.Params(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted 返回隐藏了密码的配置副本, 用于打印
+func (cfg *Config) Redacted() *Config {
+	data, _ := json.Marshal(cfg)
+	redacted := &Config{}
+	json.Unmarshal(data, redacted)
+
+	redact := func(chain *Chain) {
+		if chain.PassWord != "" {
+			chain.PassWord = redactedSecret
+		}
+		for i := range chain.Nodes {
+			if chain.Nodes[i].PassWord != "" {
+				chain.Nodes[i].PassWord = redactedSecret
+			}
+		}
+	}
+	redact(&redacted.Chain)
+	for _, setting := range redacted.Chains {
+		redact(&setting.Chain)
+	}
+	return redacted
+}
+
+const redactedSecret = "******"
+
 func (cfg *Config) GetConfig() *Config {
 	return cfg
 }
+
+// ChainSettings 返回需要运行的链, 没有配置chains时使用顶层的单链配置
+func (cfg *Config) ChainSettings() ([]*ChainSetting, error) {
+	if len(cfg.Chains) == 0 {
+		return []*ChainSetting{{
+			FromBlock:   cfg.FromBlock,
+			DbPath:      cfg.DbPath,
+			Chain:       cfg.Chain,
+			ChainConfig: cfg.ChainConfig,
+		}}, nil
+	}
+
+	names := make(map[string]bool)
+	dbPaths := make(map[string]bool)
+	for _, setting := range cfg.Chains {
+		name := setting.Chain.ChainName
+		if name == "" {
+			return nil, errors.New("chains: chain_name is required")
+		}
+		if names[name] {
+			return nil, fmt.Errorf("chains: duplicate chain_name %q", name)
+		}
+		if dbPaths[setting.DbPath] {
+			return nil, fmt.Errorf("chains: %s shares db_path %q with another chain", name, setting.DbPath)
+		}
+		names[name] = true
+		dbPaths[setting.DbPath] = true
+	}
+	return cfg.Chains, nil
+}
+
+// Params 以 chain_name 的内置参数为基础, 应用 chain_config 中的覆盖并校验
+func (s *ChainSetting) Params() (*chaincfg.Params, error) {
+	c := &s.ChainConfig
+	name := s.Chain.ChainName
+
+	params := &chaincfg.Params{}
+	preset, ok := chainPresets[name]
+	if ok {
+		*params = preset.params
+	} else if c.PubKeyHashAddrID == nil || c.ScriptHashAddrID == nil || c.HDPublicKeyID == nil || c.HDPrivateKeyID == nil {
+		return nil, fmt.Errorf("chain_config: %q has no preset, pub_key_hash_addr_id, script_hash_addr_id, hd_public_key_id and hd_private_key_id are required", name)
+	}
+	params.Name = name
+
+	addrIDs := []struct {
+		field string
+		value *int
+		dst   *byte
+	}{
+		{"pub_key_hash_addr_id", c.PubKeyHashAddrID, &params.PubKeyHashAddrID},
+		{"script_hash_addr_id", c.ScriptHashAddrID, &params.ScriptHashAddrID},
+		{"private_key_id", c.PrivateKeyID, &params.PrivateKeyID},
+		{"witness_pub_key_hash_addr_id", c.WitnessPubKeyHashAddrID, &params.WitnessPubKeyHashAddrID},
+		{"witness_script_hash_addr_id", c.WitnessScriptHashAddrID, &params.WitnessScriptHashAddrID},
+	}
+	for _, id := range addrIDs {
+		if id.value == nil {
+			continue
+		}
+		if *id.value < 0 || *id.value > 0xff {
+			return nil, fmt.Errorf("chain_config: %s %d is not a byte", id.field, *id.value)
+		}
+		*id.dst = byte(*id.value)
+	}
+	if params.PubKeyHashAddrID == params.ScriptHashAddrID {
+		return nil, errors.New("chain_config: pub_key_hash_addr_id and script_hash_addr_id must differ")
+	}
+	if c.Bech32HRPSegwit != "" {
+		params.Bech32HRPSegwit = c.Bech32HRPSegwit
+	}
+
+	// 将配置中的数组转换为字节数组
+	if c.HDPublicKeyID != nil {
+		if err := hdKeyID("hd_public_key_id", c.HDPublicKeyID, &params.HDPublicKeyID); err != nil {
+			return nil, err
+		}
+	}
+	if c.HDPrivateKeyID != nil {
+		if err := hdKeyID("hd_private_key_id", c.HDPrivateKeyID, &params.HDPrivateKeyID); err != nil {
+			return nil, err
+		}
+	}
+	if c.HDCoinType != nil {
+		if *c.HDCoinType < 0 {
+			return nil, fmt.Errorf("chain_config: hd_coin_type %d is negative", *c.HDCoinType)
+		}
+		params.HDCoinType = uint32(*c.HDCoinType)
+	}
+
+	if c.CoinbaseMaturity < 0 || c.CoinbaseMaturity > 0xffff {
+		return nil, fmt.Errorf("chain_config: coinbase_maturity %d out of range", c.CoinbaseMaturity)
+	}
+	if c.CoinbaseMaturity > 0 {
+		params.CoinbaseMaturity = uint16(c.CoinbaseMaturity)
+	}
+	if params.CoinbaseMaturity == 0 {
+		params.CoinbaseMaturity = defaultCoinbaseMaturity
+	}
+
+	if c.GenesisHash != "" {
+		hash, err := chainhash.NewHashFromStr(c.GenesisHash)
+		if err != nil {
+			return nil, fmt.Errorf("chain_config: genesis_hash: %w", err)
+		}
+		params.GenesisHash = hash
+	}
+
+	if _, err := s.PowAlgorithm(); err != nil {
+		return nil, err
+	}
+
+	for _, checkpoint := range c.Checkpoints {
+		hash, err := chainhash.NewHashFromStr(checkpoint.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %d: %w", checkpoint.Height, err)
+		}
+		params.Checkpoints = append(params.Checkpoints, chaincfg.Checkpoint{Height: int32(checkpoint.Height), Hash: hash})
+	}
+	return params, nil
+}
+
+// PowAlgorithm 返回配置或内置的工作量证明算法
+func (s *ChainSetting) PowAlgorithm() (string, error) {
+	algorithm := s.ChainConfig.PowAlgorithm
+	if algorithm == "" {
+		if preset, ok := chainPresets[s.Chain.ChainName]; ok {
+			algorithm = preset.powAlgorithm
+		}
+	}
+	switch algorithm {
+	case "", powSha256d, powScrypt:
+		return algorithm, nil
+	}
+	return "", fmt.Errorf("chain_config: unknown pow_algorithm %q", algorithm)
+}
+
+func hdKeyID(field string, values []int, dst *[4]byte) error {
+	if len(values) != 4 {
+		return fmt.Errorf("chain_config: %s must have 4 bytes, got %d", field, len(values))
+	}
+	for i, v := range values {
+		if v < 0 || v > 0xff {
+			return fmt.Errorf("chain_config: %s[%d] %d is not a byte", field, i, v)
+		}
+		dst[i] = byte(v)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChainSettingParams(t *testing.T) {
+	doge := &ChainSetting{Chain: Chain{ChainName: "dogecoin"}}
+	params, err := doge.Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.PubKeyHashAddrID != 0x1e || params.CoinbaseMaturity != 240 || params.HDCoinType != 3 {
+		t.Errorf("unexpected dogecoin preset %+v", params)
+	}
+	if algorithm, _ := doge.PowAlgorithm(); algorithm != powScrypt {
+		t.Errorf("unexpected pow algorithm %q", algorithm)
+	}
+
+	// chain_config 覆盖内置值, 0 也是有效的覆盖
+	zero := 0
+	override := &ChainSetting{
+		Chain:       Chain{ChainName: "litecoin"},
+		ChainConfig: ChainConfig{PubKeyHashAddrID: &zero, CoinbaseMaturity: 50},
+	}
+	if params, err = override.Params(); err != nil {
+		t.Fatal(err)
+	}
+	if params.PubKeyHashAddrID != 0 || params.ScriptHashAddrID != 0x32 || params.CoinbaseMaturity != 50 {
+		t.Errorf("override not applied %+v", params)
+	}
+
+	unknown := &ChainSetting{Chain: Chain{ChainName: "unknown"}}
+	if _, err := unknown.Params(); err == nil {
+		t.Error("expected error for chain without preset")
+	}
+
+	badHD := &ChainSetting{
+		Chain:       Chain{ChainName: "bitcoin"},
+		ChainConfig: ChainConfig{HDPublicKeyID: []int{4, 136, 178}},
+	}
+	if _, err := badHD.Params(); err == nil {
+		t.Error("expected error for short hd_public_key_id")
+	}
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	data := "server: \":8082\"\ndb_path: data/doge\nchain:\n  chain_name: dogecoin\n  rpc: 127.0.0.1:22555\n  user_name: user\n  pass_word: file-secret\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("UTXO_RPC_PASSWORD", "env-secret")
+	t.Setenv("UTXO_DB_PATH", "data/env")
+
+	var cfg Config
+	if _, err := LoadConfig(&cfg, nil, []string{"-config", file, "-db-path", "data/flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Chain.PassWord != "env-secret" || cfg.DbPath != "data/flag" || cfg.Chain.RPC != "127.0.0.1:22555" {
+		t.Errorf("unexpected layered config %+v", cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+	if redacted := cfg.Redacted(); redacted.Chain.PassWord != redactedSecret || cfg.Chain.PassWord != "env-secret" {
+		t.Errorf("password not redacted on a copy")
+	}
+
+	cfg.ChainConfig.HDPublicKeyID = []int{4, 136}
+	cfg.Server = ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "server") || !strings.Contains(err.Error(), "hd_public_key_id") {
+		t.Errorf("expected both errors, got %v", err)
+	}
+}
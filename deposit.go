@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/go-dogecoin/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	depositPrefix        = "deposit-"
+	depositPendingPrefix = "depositpending-"
+	depositEventPrefix   = "depositevent-"
+	depositSeqKey        = "depositseq"
+
+	// defaultDepositConfirmations 未配置时入账所需的确认数
+	defaultDepositConfirmations = 6
+	// defaultDepositFinal 未配置时不再跟踪的确认数
+	defaultDepositFinal = 100
+)
+
+// 充值的状态. dropped 和 reversed 只出现在事件中: 回滚时确认前的充值被丢弃,
+// 已确认的充值需要冲正.
+const (
+	depositDetected  = "detected"
+	depositConfirmed = "confirmed"
+	depositFinal     = "final"
+	depositDropped   = "dropped"
+	depositReversed  = "reversed"
+)
+
+// DepositConfig 充值确认数. confirmations 达到后为confirmed, final_confirmations 达到后为final
+type DepositConfig struct {
+	Confirmations      int64 `json:"confirmations"`
+	FinalConfirmations int64 `json:"final_confirmations"`
+}
+
+func (c DepositConfig) confirmations() int64 {
+	if c.Confirmations == 0 {
+		return defaultDepositConfirmations
+	}
+	return c.Confirmations
+}
+
+func (c DepositConfig) final() int64 {
+	if c.FinalConfirmations == 0 {
+		return defaultDepositFinal
+	}
+	return c.FinalConfirmations
+}
+
+// Validate 检查确认数, final不能小于confirmations
+func (c DepositConfig) Validate() error {
+	if c.Confirmations < 0 || c.FinalConfirmations < 0 {
+		return errors.New("confirmations must not be negative")
+	}
+	if c.final() < c.confirmations() {
+		return fmt.Errorf("final_confirmations %d is below confirmations %d", c.final(), c.confirmations())
+	}
+	return nil
+}
+
+// Deposit 支付到钱包地址的输出, 从首次索引的区块开始跟踪, 直到最终确认
+type Deposit struct {
+	Txid          string  `json:"txid"`
+	Vout          uint32  `json:"vout"`
+	Address       string  `json:"address"`
+	Wallet        string  `json:"wallet"`
+	Label         string  `json:"label"`
+	Amount        float64 `json:"amount"`
+	Height        int64   `json:"height"`
+	Status        string  `json:"status"`
+	Confirmations int64   `json:"confirmations"` // 按已索引高度计算, 不保存
+}
+
+type extDeposit struct {
+	Txid    string
+	Vout    uint32
+	Address string
+	Wallet  string
+	Label   string
+	Amount  []byte
+	Height  uint64
+	Status  string
+}
+
+// DecodeRLP implements rlp.Decoder
+func (d *Deposit) DecodeRLP(s *rlp.Stream) error {
+	var ext extDeposit
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	amount, err := strconv.ParseFloat(string(ext.Amount), 64)
+	if err != nil {
+		return err
+	}
+	*d = Deposit{
+		Txid:    ext.Txid,
+		Vout:    ext.Vout,
+		Address: ext.Address,
+		Wallet:  ext.Wallet,
+		Label:   ext.Label,
+		Amount:  amount,
+		Height:  int64(ext.Height),
+		Status:  ext.Status,
+	}
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (d *Deposit) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, extDeposit{
+		Txid:    d.Txid,
+		Vout:    d.Vout,
+		Address: d.Address,
+		Wallet:  d.Wallet,
+		Label:   d.Label,
+		Amount:  []byte(strconv.FormatFloat(d.Amount, 'f', 8, 64)),
+		Height:  uint64(d.Height),
+		Status:  d.Status,
+	})
+}
+
+// DepositEvent 充值的一次状态变化, 按发生顺序编号. 调用方用after=<最后的序号>分页, 处理后确认
+type DepositEvent struct {
+	Seq           uint64   `json:"seq"`
+	Status        string   `json:"status"`
+	Confirmations int64    `json:"confirmations"`
+	Time          int64    `json:"time"`
+	Acked         bool     `json:"acked"`
+	Deposit       *Deposit `json:"deposit"`
+}
+
+type extDepositEvent struct {
+	Seq           uint64
+	Status        string
+	Confirmations uint64
+	Time          uint64
+	Acked         bool
+	Deposit       *Deposit
+}
+
+// DecodeRLP implements rlp.Decoder
+func (e *DepositEvent) DecodeRLP(s *rlp.Stream) error {
+	var ext extDepositEvent
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	*e = DepositEvent{
+		Seq:           ext.Seq,
+		Status:        ext.Status,
+		Confirmations: int64(ext.Confirmations),
+		Time:          int64(ext.Time),
+		Acked:         ext.Acked,
+		Deposit:       ext.Deposit,
+	}
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (e *DepositEvent) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, extDepositEvent{
+		Seq:           e.Seq,
+		Status:        e.Status,
+		Confirmations: uint64(e.Confirmations),
+		Time:          uint64(e.Time),
+		Acked:         e.Acked,
+		Deposit:       e.Deposit,
+	})
+}
+
+func depositKey(txid string, index uint32) []byte {
+	return []byte(depositPrefix + txid + "-" + strconv.FormatUint(uint64(index), 10))
+}
+
+func depositPendingKey(txid string, index uint32) []byte {
+	return []byte(depositPendingPrefix + txid + "-" + strconv.FormatUint(uint64(index), 10))
+}
+
+// depositEventKey 序号补齐到固定宽度, 按key的顺序就是事件的顺序
+func depositEventKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", depositEventPrefix, seq))
+}
+
+// eventWriter 在一个batch中写入事件, 最后保存下一个序号
+type eventWriter struct {
+	batch *leveldb.Batch
+	next  uint64
+}
+
+func newEventWriter(db *RawDB, batch *leveldb.Batch) (*eventWriter, error) {
+	w := &eventWriter{batch: batch, next: 1}
+	data, err := db.read().Get([]byte(depositSeqKey), nil)
+	if err == leveldb.ErrNotFound {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.next, err = strconv.ParseUint(string(data), 10, 64); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *eventWriter) emit(deposit *Deposit, status string, confirmations int64) error {
+	copied := *deposit
+	event := &DepositEvent{
+		Seq:           w.next,
+		Status:        status,
+		Confirmations: confirmations,
+		Time:          time.Now().Unix(),
+		Deposit:       &copied,
+	}
+	data, err := rlp.EncodeToBytes(event)
+	if err != nil {
+		return err
+	}
+	w.batch.Put(depositEventKey(event.Seq), data)
+	w.next++
+	w.batch.Put([]byte(depositSeqKey), []byte(strconv.FormatUint(w.next, 10)))
+	return nil
+}
+
+// watchedAddress 被观察的地址所属的钱包
+type watchedAddress struct {
+	wallet string
+	label  string
+}
+
+// DepositLedger 扫描时记录付给钱包地址的输出, 并随确认数更新状态. nil表示不记录.
+type DepositLedger struct {
+	cfg    DepositConfig
+	db     *RawDB
+	params *chaincfg.Params
+
+	mu      sync.Mutex
+	watched map[string]*watchedAddress // nil时下次使用前重新加载
+}
+
+func NewDepositLedger(cfg DepositConfig, db *RawDB, params *chaincfg.Params) *DepositLedger {
+	return &DepositLedger{cfg: cfg, db: db, params: params}
+}
+
+// Reload 钱包修改后调用, 下一个区块使用新的地址
+func (l *DepositLedger) Reload() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.watched = nil
+	l.mu.Unlock()
+}
+
+// Watch 返回地址所属的钱包, 不被观察时返回nil
+func (l *DepositLedger) Watch(address string) *watchedAddress {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.watched == nil {
+		watched, err := l.load()
+		if err != nil {
+			log.Error("deposits", "load wallets", err)
+			return nil
+		}
+		l.watched = watched
+	}
+	return l.watched[address]
+}
+
+// load 展开所有钱包的地址, 同一地址属于多个钱包时使用名称最小的钱包
+func (l *DepositLedger) load() (map[string]*watchedAddress, error) {
+	names, err := l.db.GetWallets()
+	if err != nil {
+		return nil, err
+	}
+	watched := make(map[string]*watchedAddress)
+	for _, name := range names {
+		w, err := l.db.GetWallet(name)
+		if err != nil {
+			return nil, err
+		}
+		addresses, err := w.Addresses(l.params)
+		if err != nil {
+			return nil, fmt.Errorf("wallet %s: %w", name, err)
+		}
+		for _, a := range addresses {
+			if watched[a.Address] == nil {
+				watched[a.Address] = &watchedAddress{wallet: name, label: a.Label}
+			}
+		}
+	}
+	return watched, nil
+}
+
+// Detect 扫描到输出时调用, 付给被观察地址时返回新的充值
+func (l *DepositLedger) Detect(txid string, vout *Vout) *Deposit {
+	watched := l.Watch(vout.Owner())
+	if watched == nil {
+		return nil
+	}
+	return &Deposit{
+		Txid:    txid,
+		Vout:    vout.Index,
+		Address: vout.Owner(),
+		Wallet:  watched.wallet,
+		Label:   watched.label,
+		Amount:  vout.Value,
+		Height:  vout.Height,
+	}
+}
+
+// Process 在区块height的记录之后调用, 写入db: 保存新的充值, 并推进未final的充值的状态
+func (l *DepositLedger) Process(db *RawDB, height int64, found []*Deposit) error {
+	if l == nil {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	events, err := newEventWriter(db, batch)
+	if err != nil {
+		return err
+	}
+
+	var pending []*Deposit
+	for _, deposit := range found {
+		// 同一输出只记录一次
+		if ok, err := db.has(depositKey(deposit.Txid, deposit.Vout)); err != nil || ok {
+			continue
+		}
+		deposit.Status = depositDetected
+		if err := events.emit(deposit, depositDetected, height-deposit.Height+1); err != nil {
+			return err
+		}
+		pending = append(pending, deposit)
+	}
+
+	iter := db.read().NewIterator(util.BytesPrefix([]byte(depositPendingPrefix)), nil)
+	for iter.Next() {
+		data, err := db.read().Get([]byte(depositPrefix+string(iter.Key()[len(depositPendingPrefix):])), nil)
+		if err != nil {
+			continue
+		}
+		deposit := &Deposit{}
+		if err := rlp.DecodeBytes(data, deposit); err != nil {
+			iter.Release()
+			return err
+		}
+		pending = append(pending, deposit)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for _, deposit := range pending {
+		conf := height - deposit.Height + 1
+		if deposit.Status == depositDetected && conf >= l.cfg.confirmations() {
+			deposit.Status = depositConfirmed
+			if err := events.emit(deposit, depositConfirmed, conf); err != nil {
+				return err
+			}
+		}
+		if deposit.Status == depositConfirmed && conf >= l.cfg.final() {
+			deposit.Status = depositFinal
+			if err := events.emit(deposit, depositFinal, conf); err != nil {
+				return err
+			}
+		}
+
+		data, err := rlp.EncodeToBytes(deposit)
+		if err != nil {
+			return err
+		}
+		batch.Put(depositKey(deposit.Txid, deposit.Vout), data)
+		if deposit.Status == depositFinal {
+			batch.Delete(depositPendingKey(deposit.Txid, deposit.Vout))
+		} else {
+			batch.Put(depositPendingKey(deposit.Txid, deposit.Vout), nil)
+		}
+	}
+	return db.write(batch)
+}
+
+// rollbackDeposit 撤销区块时删除该输出的充值, 确认前的记为dropped, 已确认的记为reversed
+func rollbackDeposit(db *RawDB, batch *leveldb.Batch, events *eventWriter, txid string, index uint32) error {
+	data, err := db.read().Get(depositKey(txid, index), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deposit := &Deposit{}
+	if err := rlp.DecodeBytes(data, deposit); err != nil {
+		return err
+	}
+
+	status := depositReversed
+	if deposit.Status == depositDetected {
+		status = depositDropped
+	}
+	deposit.Status = status
+	batch.Delete(depositKey(txid, index))
+	batch.Delete(depositPendingKey(txid, index))
+	return events.emit(deposit, status, 0)
+}
+
+// GetDeposits 按条件筛选充值并按高度从新到旧分页, 确认数按已索引高度tip计算
+func (d *RawDB) GetDeposits(wallet, address, status string, tip, limit, offset int64) ([]*Deposit, error) {
+	iter := d.DB.NewIterator(util.BytesPrefix([]byte(depositPrefix)), nil)
+	defer iter.Release()
+
+	deposits := make([]*Deposit, 0)
+	for iter.Next() {
+		deposit := &Deposit{}
+		if err := rlp.DecodeBytes(iter.Value(), deposit); err != nil {
+			return nil, err
+		}
+		if (wallet != "" && deposit.Wallet != wallet) || (address != "" && deposit.Address != address) ||
+			(status != "" && deposit.Status != status) {
+			continue
+		}
+		deposit.Confirmations = tip - deposit.Height + 1
+		deposits = append(deposits, deposit)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(deposits, func(i, j int) bool {
+		return deposits[i].Height > deposits[j].Height
+	})
+	if offset >= int64(len(deposits)) {
+		return make([]*Deposit, 0), nil
+	}
+	deposits = deposits[offset:]
+	if int64(len(deposits)) > limit {
+		deposits = deposits[:limit]
+	}
+	return deposits, nil
+}
+
+// GetDepositEvents 按序号返回after之后的事件, unacked为true时跳过已确认处理的事件
+func (d *RawDB) GetDepositEvents(after uint64, limit int64, unacked bool) ([]*DepositEvent, error) {
+	iter := d.DB.NewIterator(&util.Range{
+		Start: depositEventKey(after + 1),
+		Limit: []byte(depositEventPrefix + "~"),
+	}, nil)
+	defer iter.Release()
+
+	events := make([]*DepositEvent, 0)
+	for iter.Next() && int64(len(events)) < limit {
+		event := &DepositEvent{}
+		if err := rlp.DecodeBytes(iter.Value(), event); err != nil {
+			return nil, err
+		}
+		if unacked && event.Acked {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, iter.Error()
+}
+
+// AckDepositEvents 标记事件已处理, 重复确认不会出错, 返回不存在的序号
+func (d *RawDB) AckDepositEvents(seqs []uint64) ([]uint64, error) {
+	batch := new(leveldb.Batch)
+	unknown := make([]uint64, 0)
+	for _, seq := range seqs {
+		data, err := d.DB.Get(depositEventKey(seq), nil)
+		if err == leveldb.ErrNotFound {
+			unknown = append(unknown, seq)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		event := &DepositEvent{}
+		if err := rlp.DecodeBytes(data, event); err != nil {
+			return nil, err
+		}
+		if event.Acked {
+			continue
+		}
+		event.Acked = true
+		if data, err = rlp.EncodeToBytes(event); err != nil {
+			return nil, err
+		}
+		batch.Put(depositEventKey(seq), data)
+	}
+	return unknown, d.DB.Write(batch, nil)
+}
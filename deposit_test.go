@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDepositLedger(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	if err := db.SetWallet(&Wallet{Name: "alice", Entries: []*WalletEntry{{Address: "X", Label: "hot"}}}); err != nil {
+		t.Fatal(err)
+	}
+	ledger := NewDepositLedger(DepositConfig{Confirmations: 2, FinalConfirmations: 3}, db, nil)
+
+	// 与扫描相同: 区块写完后处理付给钱包地址的输出
+	block := func(height int64, txs []*Tx) {
+		applyTestBlock(t, db, height, txs)
+		var found []*Deposit
+		for _, tx := range txs {
+			for _, vout := range tx.Vouts {
+				if deposit := ledger.Detect(tx.Txid, vout); deposit != nil {
+					found = append(found, deposit)
+				}
+			}
+		}
+		if err := ledger.Process(db, height, found); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statuses := func() string {
+		events, err := db.GetDepositEvents(0, 50, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, event := range events {
+			list = append(list, fmt.Sprintf("%s:%d:%s", event.Deposit.Txid, event.Confirmations, event.Status))
+		}
+		return strings.Join(list, ",")
+	}
+
+	block(1, []*Tx{{Txid: "A", Vouts: []*Vout{{Index: 0, Address: "X", Value: 5, ScriptHash: "sx"}, {Index: 1, Address: "Y", Value: 1, ScriptHash: "sy"}}}})
+	block(2, []*Tx{{Txid: "B", Vouts: []*Vout{{Index: 0, Address: "X", Value: 2, ScriptHash: "sx"}}}})
+	block(3, []*Tx{{Txid: "C", Vouts: []*Vout{{Index: 0, Address: "Z", Value: 1, ScriptHash: "sz"}}}})
+	if got, want := statuses(), "A:1:detected,B:1:detected,A:2:confirmed,A:3:final,B:2:confirmed"; got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+
+	// 重复处理同一区块不会产生新的充值
+	if err := ledger.Process(db, 3, []*Deposit{{Txid: "A", Vout: 0, Address: "X", Height: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	deposits, err := db.GetDeposits("alice", "", "", 3, 50, 0)
+	if err != nil || len(deposits) != 2 || deposits[0].Txid != "B" || deposits[0].Confirmations != 2 || deposits[1].Status != depositFinal {
+		t.Fatalf("deposits %+v (%v)", deposits, err)
+	}
+
+	// B在区块4达到final, 回滚时仍需冲正
+	block(4, []*Tx{{Txid: "D", Vouts: []*Vout{{Index: 0, Address: "X", Value: 1, ScriptHash: "sx"}}}})
+	if err := rollbackTo(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := db.GetDepositEvents(7, 50, false)
+	if len(events) != 2 || events[0].Deposit.Txid != "D" || events[0].Status != depositDropped ||
+		events[1].Deposit.Txid != "B" || events[1].Status != depositReversed {
+		t.Fatalf("rollback events %+v", events)
+	}
+	if deposits, _ := db.GetDeposits("", "", "", 1, 50, 0); len(deposits) != 1 || deposits[0].Txid != "A" {
+		t.Errorf("deposits after rollback %+v", deposits)
+	}
+
+	unknown, err := db.AckDepositEvents([]uint64{1, 2, 2, 99})
+	if err != nil || len(unknown) != 1 || unknown[0] != 99 {
+		t.Fatalf("ack unknown %v (%v)", unknown, err)
+	}
+	if events, _ := db.GetDepositEvents(0, 50, true); len(events) != 7 || events[0].Seq != 3 {
+		t.Errorf("unacked events %+v", events)
+	}
+}
+
+func TestDepositReorg(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	if err := db.SetWallet(&Wallet{Name: "alice", Entries: []*WalletEntry{{Address: "X"}}}); err != nil {
+		t.Fatal(err)
+	}
+	ledger := NewDepositLedger(DepositConfig{Confirmations: 3, FinalConfirmations: 6}, db, nil)
+
+	// 与扫描相同: 区块的记录和充值在同一个批次中写入
+	block := func(height int64, txs []*Tx) {
+		batch := db.Begin()
+		applyTestBlock(t, batch, height, txs)
+		var found []*Deposit
+		for _, tx := range txs {
+			for _, vout := range tx.Vouts {
+				if deposit := ledger.Detect(tx.Txid, vout); deposit != nil {
+					found = append(found, deposit)
+				}
+			}
+		}
+		if err := ledger.Process(batch, height, found); err != nil {
+			t.Fatal(err)
+		}
+		if err := batch.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block(1, []*Tx{{Txid: "A", Vouts: []*Vout{{Index: 0, Address: "Y", Value: 5, ScriptHash: "sy"}}}})
+	block(2, []*Tx{{Txid: "B", Vouts: []*Vout{{Index: 0, Address: "X", Value: 2, ScriptHash: "sx"}}}})
+	block(3, []*Tx{{Txid: "C", Vouts: []*Vout{{Index: 0, Address: "Y", Value: 1, ScriptHash: "sy"}}}})
+
+	// 节点切换到从高度2开始的另一条分支, B随孤块被撤销
+	branch := map[int64]string{1: "b", 2: "x", 3: "y"}
+	ancestor, err := rollbackFork(db, func(h int64) (string, error) { return branch[h], nil })
+	if err != nil || ancestor != 1 {
+		t.Fatalf("ancestor %d (%v)", ancestor, err)
+	}
+	events, err := db.GetDepositEvents(0, 50, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Status != depositDetected || events[1].Deposit.Txid != "B" || events[1].Status != depositDropped {
+		t.Fatalf("reorg events %+v", events)
+	}
+	if deposits, _ := db.GetDeposits("", "", "", 1, 50, 0); len(deposits) != 0 {
+		t.Errorf("deposits after reorg %+v", deposits)
+	}
+
+	// B在新分支的高度3重新出现时再次生成detected事件
+	block(2, []*Tx{{Txid: "D", Vouts: []*Vout{{Index: 0, Address: "Y", Value: 1, ScriptHash: "sy"}}}})
+	block(3, []*Tx{{Txid: "B", Vouts: []*Vout{{Index: 0, Address: "X", Value: 2, ScriptHash: "sx"}}}})
+	if events, _ := db.GetDepositEvents(2, 50, false); len(events) != 1 || events[0].Deposit.Txid != "B" || events[0].Deposit.Height != 3 || events[0].Status != depositDetected {
+		t.Errorf("events on the new branch %+v", events)
+	}
+}
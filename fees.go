@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/btcutil"
+	"github.com/dogecoinw/go-dogecoin/log"
+)
+
+var (
+	// feeWindow 参与估算的最近区块数
+	feeWindow = int64(144)
+	// feeTargets 估算的确认目标(区块数)
+	feeTargets = []int64{1, 2, 3, 6, 12, 24, 144}
+	// feePercentiles 每个区块记录的费率分位点
+	feePercentiles = []float64{0.1, 0.25, 0.5, 0.75, 0.9}
+	// mempoolInterval 刷新内存池统计和节点费率估算的间隔
+	mempoolInterval = 30 * time.Second
+)
+
+// feeSample 单笔交易的费率(聪/kvB)和虚拟大小
+type feeSample struct {
+	rate  int64
+	vsize int64
+}
+
+// BlockFees 区块内交易的手续费统计, 费率单位为聪/kvB
+type BlockFees struct {
+	Height      uint64   `json:"height"`
+	TxCount     uint64   `json:"tx_count"`
+	TotalFee    uint64   `json:"total_fee"`
+	TotalVsize  uint64   `json:"total_vsize"`
+	Percentiles []uint64 `json:"percentiles"`
+}
+
+// MempoolFees 内存池的手续费统计
+type MempoolFees struct {
+	TxCount     int64    `json:"tx_count"`
+	TotalVsize  int64    `json:"total_vsize"`
+	TotalFee    int64    `json:"total_fee"`
+	Percentiles []uint64 `json:"percentiles"`
+	UpdatedAt   int64    `json:"updated_at"`
+
+	samples []feeSample // 按费率从高到低
+}
+
+// FeeEstimate 某个确认目标的费率估算, 单位为聪/vB
+type FeeEstimate struct {
+	Target      int64    `json:"target"`
+	FeeRate     float64  `json:"fee_rate"`
+	NodeFeeRate *float64 `json:"node_fee_rate"`
+}
+
+// FeeEstimator 维护最近区块和内存池的费率统计
+type FeeEstimator struct {
+	db   *RawDB
+	node *NodePool
+
+	mu        sync.RWMutex
+	blocks    []*BlockFees // 按高度升序
+	mempool   *MempoolFees
+	mempoolAt time.Time
+	nodeRates map[int64]float64 // 节点estimatesmartfee的结果(聪/vB), 与内存池统计一起刷新
+}
+
+func NewFeeEstimator(db *RawDB, node *NodePool) *FeeEstimator {
+	f := &FeeEstimator{
+		db:   db,
+		node: node,
+	}
+
+	// 从数据库加载最近的区块统计
+	if height, err := db.GetHeight(); err == nil {
+		for h := height - feeWindow + 1; h <= height; h++ {
+			if h < 0 {
+				continue
+			}
+			if fees, err := db.GetBlockFees(h); err == nil {
+				f.blocks = append(f.blocks, fees)
+			}
+		}
+	}
+	return f
+}
+
+// AddBlock 记录新区块的统计, 高度不连续(回滚)时丢弃更高的旧记录
+func (f *FeeEstimator) AddBlock(fees *BlockFees) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.blocks) > 0 && f.blocks[len(f.blocks)-1].Height >= fees.Height {
+		f.blocks = f.blocks[:len(f.blocks)-1]
+	}
+	f.blocks = append(f.blocks, fees)
+	if int64(len(f.blocks)) > feeWindow {
+		f.blocks = f.blocks[int64(len(f.blocks))-feeWindow:]
+	}
+}
+
+// UpdateMempool 刷新内存池统计和节点的费率估算, 两次刷新之间至少间隔mempoolInterval.
+// 接口只读取刷新的结果, 不会调用节点.
+func (f *FeeEstimator) UpdateMempool() error {
+	f.mu.RLock()
+	fresh := time.Since(f.mempoolAt) < mempoolInterval
+	f.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	entries, err := f.node.Client().GetRawMempoolVerbose()
+	if err != nil {
+		return err
+	}
+	mempool := newMempoolFees(entries)
+	metricMempoolTxs.WithLabelValues(f.node.chain).Set(float64(mempool.TxCount))
+	metricMempoolVsize.WithLabelValues(f.node.chain).Set(float64(mempool.TotalVsize))
+	rates := f.fetchNodeRates()
+
+	f.mu.Lock()
+	f.mempool = mempool
+	f.mempoolAt = time.Now()
+	f.nodeRates = rates
+	f.mu.Unlock()
+	return nil
+}
+
+// fetchNodeRates 查询节点对每个确认目标的估算, 节点不能估算的目标不在结果中
+func (f *FeeEstimator) fetchNodeRates() map[int64]float64 {
+	rates := make(map[int64]float64, len(feeTargets))
+	for _, target := range feeTargets {
+		result, err := f.node.Client().EstimateSmartFee(target, &btcjson.EstimateModeConservative)
+		if err != nil {
+			log.Debug("fees", "estimatesmartfee", err)
+			continue
+		}
+		if result.FeeRate != nil {
+			// 节点返回 BTC/kvB
+			rates[target] = *result.FeeRate * btcutil.SatoshiPerBitcoin / 1000
+		}
+	}
+	return rates
+}
+
+// Mempool 返回最近一次的内存池统计
+func (f *FeeEstimator) Mempool() *MempoolFees {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mempool
+}
+
+// Blocks 返回最近count个区块的统计, 按高度降序
+func (f *FeeEstimator) Blocks(count int) []*BlockFees {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	blocks := make([]*BlockFees, 0, count)
+	for i := len(f.blocks) - 1; i >= 0 && len(blocks) < count; i-- {
+		blocks = append(blocks, f.blocks[i])
+	}
+	return blocks
+}
+
+// Estimate 按确认目标估算费率, 并附上最近一次刷新的节点estimatesmartfee结果用于对比
+func (f *FeeEstimator) Estimate() []*FeeEstimate {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	estimates := make([]*FeeEstimate, 0, len(feeTargets))
+	for _, target := range feeTargets {
+		estimate := &FeeEstimate{
+			Target:  target,
+			FeeRate: float64(estimateFeeRate(f.blocks, f.mempool, target)) / 1000,
+		}
+		if rate, ok := f.nodeRates[target]; ok {
+			estimate.NodeFeeRate = &rate
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates
+}
+
+// estimateFeeRate 目标越近取越高的区块分位点, 在最近 2*target 个区块上取中位数;
+// 内存池积压超过target个区块容量时, 以能进入前target个区块的费率为下限.
+func estimateFeeRate(blocks []*BlockFees, mempool *MempoolFees, target int64) int64 {
+	percentile := 0
+	switch {
+	case target <= 1:
+		percentile = 3
+	case target <= 2:
+		percentile = 2
+	case target <= 6:
+		percentile = 1
+	}
+
+	window := 2 * target
+	if window < 6 {
+		window = 6
+	}
+
+	var rates []int64
+	totalVsize := uint64(0)
+	for i := len(blocks) - 1; i >= 0 && int64(len(rates)) < window; i-- {
+		if len(blocks[i].Percentiles) == len(feePercentiles) {
+			rates = append(rates, int64(blocks[i].Percentiles[percentile]))
+			totalVsize += blocks[i].TotalVsize
+		}
+	}
+
+	rate := int64(0)
+	if len(rates) > 0 {
+		sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+		rate = rates[len(rates)/2]
+	}
+
+	if mempool != nil && len(rates) > 0 {
+		capacity := int64(totalVsize) / int64(len(rates)) * target
+		cumulative := int64(0)
+		for _, sample := range mempool.samples {
+			cumulative += sample.vsize
+			if cumulative >= capacity {
+				if sample.rate > rate {
+					rate = sample.rate
+				}
+				break
+			}
+		}
+	}
+	return rate
+}
+
+// newBlockFees 汇总区块内非coinbase交易的手续费
+func newBlockFees(height int64, samples []feeSample, totalFee int64) *BlockFees {
+	fees := &BlockFees{
+		Height:      uint64(height),
+		TxCount:     uint64(len(samples)),
+		TotalFee:    uint64(totalFee),
+		Percentiles: weightedPercentiles(samples),
+	}
+	for _, sample := range samples {
+		fees.TotalVsize += uint64(sample.vsize)
+	}
+	return fees
+}
+
+func newMempoolFees(entries map[string]btcjson.GetRawMempoolVerboseResult) *MempoolFees {
+	mempool := &MempoolFees{UpdatedAt: time.Now().Unix()}
+	for _, entry := range entries {
+		vsize := int64(entry.Vsize)
+		if vsize == 0 {
+			vsize = int64(entry.Size)
+		}
+		fee, err := btcutil.NewAmount(entry.Fee)
+		if err != nil || vsize <= 0 {
+			continue
+		}
+		mempool.TxCount++
+		mempool.TotalVsize += vsize
+		mempool.TotalFee += int64(fee)
+		mempool.samples = append(mempool.samples, feeSample{rate: int64(fee) * 1000 / vsize, vsize: vsize})
+	}
+	mempool.Percentiles = weightedPercentiles(mempool.samples)
+	sort.Slice(mempool.samples, func(i, j int) bool {
+		return mempool.samples[i].rate > mempool.samples[j].rate
+	})
+	return mempool
+}
+
+// weightedPercentiles 按虚拟大小加权计算费率分位点
+func weightedPercentiles(samples []feeSample) []uint64 {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	sorted := make([]feeSample, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].rate < sorted[j].rate })
+
+	total := int64(0)
+	for _, sample := range sorted {
+		total += sample.vsize
+	}
+
+	result := make([]uint64, 0, len(feePercentiles))
+	cumulative := int64(0)
+	i := 0
+	for _, p := range feePercentiles {
+		threshold := int64(p * float64(total))
+		for i < len(sorted)-1 && cumulative+sorted[i].vsize < threshold {
+			cumulative += sorted[i].vsize
+			i++
+		}
+		result = append(result, uint64(sorted[i].rate))
+	}
+	return result
+}
+
+// txFee 输入减输出得到手续费(聪)
+func txFee(vins []*Vin, vouts []*Vout) (int64, bool) {
+	fee := int64(0)
+	for _, vin := range vins {
+		amount, err := btcutil.NewAmount(vin.Value)
+		if err != nil {
+			return 0, false
+		}
+		fee += int64(amount)
+	}
+	for _, vout := range vouts {
+		amount, err := btcutil.NewAmount(vout.Value)
+		if err != nil {
+			return 0, false
+		}
+		fee -= int64(amount)
+	}
+	return fee, fee >= 0
+}
+
+// txVsize 返回交易的虚拟大小, 不支持隔离见证的节点没有vsize字段
+func txVsize(tx *btcjson.TxRawResult) int64 {
+	if tx.Vsize > 0 {
+		return int64(tx.Vsize)
+	}
+	if tx.Size > 0 {
+		return int64(tx.Size)
+	}
+	return int64(len(tx.Hex) / 2)
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestWeightedPercentiles(t *testing.T) {
+	samples := []feeSample{
+		{rate: 1000, vsize: 100},
+		{rate: 5000, vsize: 700},
+		{rate: 20000, vsize: 200},
+	}
+	got := weightedPercentiles(samples)
+	want := []uint64{1000, 5000, 5000, 5000, 20000}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("percentile %v: got %d, want %d", feePercentiles[i], got[i], want[i])
+		}
+	}
+}
+
+func TestEstimateFeeRate(t *testing.T) {
+	var blocks []*BlockFees
+	for h := uint64(1); h <= 10; h++ {
+		blocks = append(blocks, &BlockFees{
+			Height:      h,
+			TotalVsize:  1000,
+			Percentiles: []uint64{1000, 2000, 3000, 4000, 5000},
+		})
+	}
+
+	if rate := estimateFeeRate(blocks, nil, 1); rate != 4000 {
+		t.Errorf("target 1: got %d", rate)
+	}
+	if rate := estimateFeeRate(blocks, nil, 144); rate != 1000 {
+		t.Errorf("target 144: got %d", rate)
+	}
+
+	// 内存池积压超过一个区块时, 以进入下一个区块所需的费率为下限
+	mempool := &MempoolFees{samples: []feeSample{{rate: 9000, vsize: 600}, {rate: 8000, vsize: 600}}}
+	if rate := estimateFeeRate(blocks, mempool, 1); rate != 8000 {
+		t.Errorf("target 1 with backlog: got %d", rate)
+	}
+}
+
+func TestEstimateUsesCachedNodeRates(t *testing.T) {
+	// node为nil, 估算时调用节点会panic
+	f := &FeeEstimator{nodeRates: map[int64]float64{1: 12.5}}
+	estimates := f.Estimate()
+	if len(estimates) != len(feeTargets) {
+		t.Fatalf("got %d estimates", len(estimates))
+	}
+	if estimates[0].NodeFeeRate == nil || *estimates[0].NodeFeeRate != 12.5 {
+		t.Errorf("target 1: %+v", estimates[0])
+	}
+	if estimates[1].NodeFeeRate != nil {
+		t.Errorf("target 2 without node estimate: %v", *estimates[1].NodeFeeRate)
+	}
+}
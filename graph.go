@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/dogecoinw/doged/txscript"
+	"github.com/dogecoinw/go-dogecoin/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	spendPrefix = "spend-"
+
+	// 追踪的默认值和上限
+	defaultTraceDepth  = 3
+	maxTraceDepth      = 10
+	defaultTraceFanout = 20
+	maxTraceFanout     = 100
+	maxTraceNodes      = 500
+)
+
+// 追踪方向
+const (
+	traceForward  = "forward"
+	traceBackward = "backward"
+	traceBoth     = "both"
+)
+
+// Spend 输出被哪个交易花费: 花费交易、输入序号和所在区块高度. 迁移建立的记录不知道输入序号, Vin为nil
+type Spend struct {
+	Txid   string  `json:"txid"`
+	Vin    *uint32 `json:"vin,omitempty"`
+	Height int64   `json:"height"`
+}
+
+type extSpend struct {
+	Txid   string
+	Height uint64
+	Vin    uint64 `rlp:"optional"` // 输入序号加1, 0表示未知
+}
+
+// DecodeRLP implements rlp.Decoder
+func (s *Spend) DecodeRLP(st *rlp.Stream) error {
+	var ext extSpend
+	if err := st.Decode(&ext); err != nil {
+		return err
+	}
+	s.Txid = ext.Txid
+	s.Height = int64(ext.Height)
+	s.Vin = nil
+	if ext.Vin > 0 {
+		vin := uint32(ext.Vin - 1)
+		s.Vin = &vin
+	}
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (s *Spend) EncodeRLP(w io.Writer) error {
+	ext := extSpend{Txid: s.Txid, Height: uint64(s.Height)}
+	if s.Vin != nil {
+		ext.Vin = uint64(*s.Vin) + 1
+	}
+	return rlp.Encode(w, ext)
+}
+
+// newSpend 扫描时记录花费, index为输入在交易中的序号
+func newSpend(txid string, index int, height int64) *Spend {
+	vin := uint32(index)
+	return &Spend{Txid: txid, Vin: &vin, Height: height}
+}
+
+func spendKey(txid string, index uint32) []byte {
+	return []byte(spendPrefix + txid + "-" + strconv.FormatUint(uint64(index), 10))
+}
+
+// 保存输出被哪个交易花费
+func (d *RawDB) SetSpend(txid string, index uint32, spend *Spend) error {
+	data, err := rlp.EncodeToBytes(spend)
+	if err != nil {
+		return err
+	}
+	return d.put(spendKey(txid, index), data)
+}
+
+// 获取花费输出的交易, 未花费时返回 leveldb.ErrNotFound
+func (d *RawDB) GetSpend(txid string, index uint32) (*Spend, error) {
+	data, err := d.read().Get(spendKey(txid, index), nil)
+	if err != nil {
+		return nil, err
+	}
+	spend := &Spend{}
+	if err := rlp.DecodeBytes(data, spend); err != nil {
+		return nil, err
+	}
+	return spend, nil
+}
+
+// lookupSpend 返回花费输出的交易. 升级前花费的输出可能没有 spend- 记录, 这时按 utxo- 记录是否已删除判断,
+// 已花费时返回Txid为空的记录. 未花费时返回 leveldb.ErrNotFound
+func (d *RawDB) lookupSpend(txid string, vout *Vout) (*Spend, error) {
+	spend, err := d.GetSpend(txid, vout.Index)
+	if err != leveldb.ErrNotFound {
+		return spend, err
+	}
+	// OP_RETURN等不可花费的输出没有 utxo- 记录
+	if vout.unspendable() {
+		return nil, leveldb.ErrNotFound
+	}
+	ok, err := d.has(utxoKey(vout.Owner(), txid, vout.Index))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, leveldb.ErrNotFound
+	}
+	return &Spend{}, nil
+}
+
+// unspendable 输出脚本不可花费, 没有脚本时按脚本类型判断
+func (v *Vout) unspendable() bool {
+	script, err := hex.DecodeString(v.Script)
+	if err != nil || len(script) == 0 {
+		return v.Class == txscript.NullDataTy.String()
+	}
+	return txscript.IsUnspendable(script)
+}
+
+// Outpoint 输出的状态, 已花费时才有花费字段. 迁移建立的记录没有SpentVin, 花费交易未知时都没有
+type Outpoint struct {
+	Txid        string  `json:"txid"`
+	Vout        uint32  `json:"vout"`
+	Address     string  `json:"address"`
+	Value       float64 `json:"value"`
+	Height      int64   `json:"height"`
+	Status      string  `json:"status"`
+	SpentBy     string  `json:"spent_by,omitempty"`
+	SpentVin    *uint32 `json:"spent_vin,omitempty"`
+	SpentHeight int64   `json:"spent_height,omitempty"`
+}
+
+// GetOutpoint 按 vout- 和 spend- 记录返回输出是否已花费, 不需要知道地址.
+// 输出不存在或在索引起点之前时返回 leveldb.ErrNotFound
+func (d *RawDB) GetOutpoint(txid string, index uint32) (*Outpoint, error) {
+	vout, err := d.GetVout(txid, index)
+	if err != nil {
+		return nil, err
+	}
+	outpoint := &Outpoint{
+		Txid:    txid,
+		Vout:    index,
+		Address: vout.Owner(),
+		Value:   vout.Value,
+		Height:  vout.Height,
+		Status:  "unspent",
+	}
+	spend, err := d.lookupSpend(txid, vout)
+	if err == leveldb.ErrNotFound {
+		return outpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	outpoint.Status = "spent"
+	outpoint.SpentBy = spend.Txid
+	outpoint.SpentVin = spend.Vin
+	outpoint.SpentHeight = spend.Height
+	return outpoint, nil
+}
+
+// GraphNode 追踪到的交易, 花费方向Depth为正, 资金来源方向为负. 索引起点之前的交易无法展开, Indexed为false
+type GraphNode struct {
+	Txid    string `json:"txid"`
+	Height  int64  `json:"height"`
+	Depth   int    `json:"depth"`
+	Indexed bool   `json:"indexed"`
+}
+
+// GraphEdge 输出From:Vout被To花费, 未花费或花费交易未知时To为空
+type GraphEdge struct {
+	From    string  `json:"from"`
+	Vout    uint32  `json:"vout"`
+	To      string  `json:"to"`
+	Spent   bool    `json:"spent"`
+	Address string  `json:"address"`
+	Value   float64 `json:"value"`
+}
+
+// TxGraph 追踪结果, 超过扇出或节点数上限时truncated为true
+type TxGraph struct {
+	Nodes     []*GraphNode `json:"nodes"`
+	Edges     []*GraphEdge `json:"edges"`
+	Truncated bool         `json:"truncated"`
+}
+
+// TraceRequest 追踪参数, Vout为nil时从交易的所有输出开始
+type TraceRequest struct {
+	Txid      string
+	Vout      *uint32
+	Direction string
+	Depth     int
+	Fanout    int
+}
+
+// tracer 按广度优先展开, 同一交易只展开一次
+type tracer struct {
+	db     *RawDB
+	req    *TraceRequest
+	graph  *TxGraph
+	nodes  map[string]*GraphNode
+	edges  map[string]bool
+	txs    map[string]*Tx
+	queued map[string]bool
+}
+
+// traceKey 两个方向分别记录已展开的交易
+func traceKey(txid string, forward bool) string {
+	return fmt.Sprintf("%s|%t", txid, forward)
+}
+
+// TraceTx 从交易或它的一个输出沿花费方向(forward)和/或资金来源方向(backward)追踪
+func (d *RawDB) TraceTx(req *TraceRequest) (*TxGraph, error) {
+	switch req.Direction {
+	case "":
+		req.Direction = traceBoth
+	case traceForward, traceBackward, traceBoth:
+	default:
+		return nil, fmt.Errorf("unknown direction %q", req.Direction)
+	}
+	if req.Depth <= 0 {
+		req.Depth = defaultTraceDepth
+	}
+	if req.Depth > maxTraceDepth {
+		req.Depth = maxTraceDepth
+	}
+	if req.Fanout <= 0 {
+		req.Fanout = defaultTraceFanout
+	}
+	if req.Fanout > maxTraceFanout {
+		req.Fanout = maxTraceFanout
+	}
+
+	t := &tracer{
+		db:     d,
+		req:    req,
+		graph:  &TxGraph{Nodes: make([]*GraphNode, 0), Edges: make([]*GraphEdge, 0)},
+		nodes:  make(map[string]*GraphNode),
+		edges:  make(map[string]bool),
+		txs:    make(map[string]*Tx),
+		queued: make(map[string]bool),
+	}
+	start, err := t.tx(req.Txid)
+	if err != nil {
+		return nil, err
+	}
+	if start == nil {
+		return nil, fmt.Errorf("tx %s is not indexed", req.Txid)
+	}
+	if req.Vout != nil && int(*req.Vout) >= len(start.Vouts) {
+		return nil, fmt.Errorf("tx %s has no output %d", req.Txid, *req.Vout)
+	}
+	t.node(req.Txid, txRecordHeight(start), 0)
+
+	if req.Direction != traceBackward {
+		if err := t.walk(req.Txid, true); err != nil {
+			return nil, err
+		}
+	}
+	if req.Direction != traceForward {
+		if err := t.walk(req.Txid, false); err != nil {
+			return nil, err
+		}
+	}
+	return t.graph, nil
+}
+
+// walk 从起点按层展开一个方向
+func (t *tracer) walk(txid string, forward bool) error {
+	layer := []string{txid}
+	t.queued[traceKey(txid, forward)] = true
+	for depth := 0; depth < t.req.Depth && len(layer) > 0; depth++ {
+		var next []string
+		for _, id := range layer {
+			found, err := t.expand(id, depth, forward)
+			if err != nil {
+				return err
+			}
+			for _, child := range found {
+				if key := traceKey(child, forward); !t.queued[key] {
+					t.queued[key] = true
+					next = append(next, child)
+				}
+			}
+		}
+		layer = next
+	}
+	return nil
+}
+
+// expand 加入一个交易的边, 返回新到达的交易
+func (t *tracer) expand(txid string, depth int, forward bool) ([]string, error) {
+	tx, err := t.tx(txid)
+	if err != nil || tx == nil {
+		return nil, err
+	}
+
+	var found []string
+	count := 0
+	if forward {
+		for _, vout := range tx.Vouts {
+			// 起点指定了输出时只追踪这个输出
+			if depth == 0 && t.req.Vout != nil && vout.Index != *t.req.Vout {
+				continue
+			}
+			if count >= t.req.Fanout {
+				t.graph.Truncated = true
+				break
+			}
+			count++
+
+			edge := &GraphEdge{From: txid, Vout: vout.Index, Address: vout.Owner(), Value: vout.Value}
+			spend, err := t.db.lookupSpend(txid, vout)
+			if err != nil && err != leveldb.ErrNotFound {
+				return nil, err
+			}
+			// 花费交易未知时不能继续展开
+			if spend != nil && spend.Txid == "" {
+				edge.Spent = true
+				spend = nil
+			}
+			if spend != nil {
+				edge.Spent = true
+				edge.To = spend.Txid
+				if !t.node(spend.Txid, spend.Height, depth+1) {
+					continue
+				}
+				found = append(found, spend.Txid)
+			}
+			t.edge(edge)
+		}
+		return found, nil
+	}
+
+	for _, vin := range tx.Vins {
+		if count >= t.req.Fanout {
+			t.graph.Truncated = true
+			break
+		}
+		count++
+		if !t.node(vin.Txid, vin.Height, -(depth + 1)) {
+			continue
+		}
+		t.edge(&GraphEdge{From: vin.Txid, Vout: vin.Vout, To: txid, Spent: true, Address: vin.Owner(), Value: vin.Value})
+		found = append(found, vin.Txid)
+	}
+	return found, nil
+}
+
+// node 加入交易节点, 已存在时保留较早到达的深度. 超过节点数上限时返回false.
+func (t *tracer) node(txid string, height int64, depth int) bool {
+	if _, ok := t.nodes[txid]; ok {
+		return true
+	}
+	if len(t.nodes) >= maxTraceNodes {
+		t.graph.Truncated = true
+		return false
+	}
+	tx, err := t.tx(txid)
+	if err != nil {
+		log.Error("trace", "tx", txid, "err", err)
+	}
+	node := &GraphNode{Txid: txid, Height: height, Depth: depth, Indexed: tx != nil}
+	if tx != nil && height == 0 {
+		node.Height = txRecordHeight(tx)
+	}
+	t.nodes[txid] = node
+	t.graph.Nodes = append(t.graph.Nodes, node)
+	return true
+}
+
+func (t *tracer) edge(edge *GraphEdge) {
+	key := edge.From + "-" + strconv.FormatUint(uint64(edge.Vout), 10)
+	if !t.edges[key] {
+		t.edges[key] = true
+		t.graph.Edges = append(t.graph.Edges, edge)
+	}
+}
+
+// tx 读取交易记录, 没有索引的交易返回nil
+func (t *tracer) tx(txid string) (*Tx, error) {
+	if tx, ok := t.txs[txid]; ok {
+		return tx, nil
+	}
+	tx, err := t.db.GetTx(txid)
+	if err == leveldb.ErrNotFound {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.txs[txid] = tx
+	return tx, nil
+}
+
+// txRecordHeight 交易记录不保存高度, 从输出记录的高度取得
+func txRecordHeight(tx *Tx) int64 {
+	for _, vout := range tx.Vouts {
+		if vout.Height > 0 {
+			return vout.Height
+		}
+	}
+	return 0
+}
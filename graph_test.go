@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTraceTx(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	// A -> B -> C, A的第二个输出未花费
+	a0 := &Vout{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}
+	applyTestBlock(t, db, 1, []*Tx{{Txid: "A", Vouts: []*Vout{a0, {Index: 1, Address: "Z", Value: 5, ScriptHash: "sz"}}}})
+	b0 := &Vout{Index: 0, Address: "Y", Value: 49, ScriptHash: "sy"}
+	applyTestBlock(t, db, 2, []*Tx{{Txid: "B", Vins: []*Vin{a0.AsVin("A")}, Vouts: []*Vout{b0}}})
+	applyTestBlock(t, db, 3, []*Tx{{Txid: "C", Vins: []*Vin{b0.AsVin("B")}, Vouts: []*Vout{{Index: 0, Address: "X", Value: 48, ScriptHash: "sx"}}}})
+
+	// 迁移重建的索引与扫描时写入的相同
+	db.DB.Delete(spendKey("A", 0), nil)
+	if err := migrateSpends(db); err != nil {
+		t.Fatal(err)
+	}
+	// 迁移不知道输入序号
+	if spend, err := db.GetSpend("A", 0); err != nil || spend.Txid != "B" || spend.Height != 2 || spend.Vin != nil {
+		t.Fatalf("spend of A:0 %+v (%v)", spend, err)
+	}
+	if _, err := db.GetSpend("A", 1); err != leveldb.ErrNotFound {
+		t.Errorf("A:1 should be unspent, got %v", err)
+	}
+
+	graph, err := db.TraceTx(&TraceRequest{Txid: "A", Direction: traceForward})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 3 || len(graph.Edges) != 4 || graph.Truncated {
+		t.Fatalf("forward graph %+v", graph)
+	}
+	if graph.Nodes[2].Txid != "C" || graph.Nodes[2].Depth != 2 || graph.Nodes[2].Height != 3 {
+		t.Errorf("node %+v", graph.Nodes[2])
+	}
+
+	graph, err = db.TraceTx(&TraceRequest{Txid: "C", Direction: traceBackward, Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 2 || graph.Nodes[1].Txid != "B" || graph.Nodes[1].Depth != -1 {
+		t.Errorf("backward graph %+v", graph.Nodes)
+	}
+
+	vout := uint32(1)
+	graph, err = db.TraceTx(&TraceRequest{Txid: "A", Vout: &vout, Direction: traceForward})
+	if err != nil || len(graph.Nodes) != 1 || len(graph.Edges) != 1 || graph.Edges[0].To != "" {
+		t.Errorf("unspent output graph %+v (%v)", graph, err)
+	}
+
+	graph, err = db.TraceTx(&TraceRequest{Txid: "A", Direction: traceForward, Fanout: 1})
+	if err != nil || !graph.Truncated {
+		t.Errorf("fanout not truncated %+v (%v)", graph, err)
+	}
+
+	outpoint, err := db.GetOutpoint("B", 0)
+	if err != nil || outpoint.Status != "spent" || outpoint.SpentBy != "C" || outpoint.SpentVin == nil ||
+		*outpoint.SpentVin != 0 ||
+		outpoint.SpentHeight != 3 || outpoint.Address != "Y" {
+		t.Errorf("outpoint B:0 %+v (%v)", outpoint, err)
+	}
+	// 没有 spend- 记录时按 utxo- 记录判断, 花费交易未知
+	data, _ := db.DB.Get(spendKey("B", 0), nil)
+	db.DB.Delete(spendKey("B", 0), nil)
+	outpoint, err = db.GetOutpoint("B", 0)
+	if err != nil || outpoint.Status != "spent" || outpoint.SpentBy != "" || outpoint.SpentHeight != 0 {
+		t.Errorf("outpoint B:0 without spend record %+v (%v)", outpoint, err)
+	}
+	if outpoint, err := db.GetOutpoint("A", 1); err != nil || outpoint.Status != "unspent" {
+		t.Errorf("outpoint A:1 %+v (%v)", outpoint, err)
+	}
+	db.DB.Put(spendKey("B", 0), data, nil)
+	if _, err := db.GetOutpoint("B", 1); err != leveldb.ErrNotFound {
+		t.Errorf("missing outpoint: %v", err)
+	}
+
+	// 回滚后输出重新变为未花费
+	if err := rollbackBlock(db, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetSpend("B", 0); err != leveldb.ErrNotFound {
+		t.Errorf("B:0 still spent after rollback: %v", err)
+	}
+	if outpoint, err := db.GetOutpoint("B", 0); err != nil || outpoint.Status != "unspent" || outpoint.SpentVin != nil {
+		t.Errorf("outpoint B:0 after rollback %+v (%v)", outpoint, err)
+	}
+}
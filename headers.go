@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/dogecoinw/doged/blockchain"
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/doged/wire"
+	"github.com/dogecoinw/go-dogecoin/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	powSha256d = "sha256d"
+	powScrypt  = "scrypt"
+
+	// auxPowVersion 合并挖矿区块的版本标记, 工作量证明在父链区块中
+	auxPowVersion = 1 << 8
+)
+
+// errChainMismatch 节点返回的链与数据库中已索引的链不一致
+var errChainMismatch = errors.New("chain mismatch")
+
+// errReorg 节点切换到了另一条分支, 已索引的最新区块不在节点的主链上
+var errReorg = errors.New("reorg")
+
+type Checkpoint struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// checkHeader 校验新区块与已索引的上一个区块的链接关系、检查点和工作量证明,
+// 返回带累计工作量的区块记录. prev为nil时(第一个索引的区块)从节点读取chainwork.
+func (s *State) checkHeader(prev *Block, block *btcjson.GetBlockVerboseResult) (*Block, error) {
+	header, err := blockHeader(block)
+	if err != nil {
+		return nil, err
+	}
+	if hash := header.BlockHash(); hash.String() != block.Hash {
+		return nil, fmt.Errorf("%w: block %d header hashes to %s, node reported %s", errChainMismatch, block.Height, hash, block.Hash)
+	}
+
+	if prev != nil && prev.Hash != block.PreviousHash {
+		return nil, fmt.Errorf("%w: block %d links to %s, indexed block %d is %s", errReorg, block.Height, block.PreviousHash, prev.Height, prev.Hash)
+	}
+
+	if err := checkCheckpoint(s.chain.Params, block.Height, block.Hash); err != nil {
+		return nil, err
+	}
+
+	if err := checkProofOfWork(header, s.chain.PowAlgorithm); err != nil {
+		return nil, fmt.Errorf("%w: block %d %s", errChainMismatch, block.Height, err)
+	}
+
+	work := blockchain.CalcWork(header.Bits)
+	if prev != nil && prev.Chainwork != "" {
+		prevWork, ok := new(big.Int).SetString(prev.Chainwork, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid chainwork at height %d", prev.Height)
+		}
+		work.Add(work, prevWork)
+	} else if nodeWork, err := s.nodeChainwork(block.Hash); err == nil {
+		work = nodeWork
+	}
+
+	record := newBlock(block)
+	record.Chainwork = work.Text(16)
+	return record, nil
+}
+
+// checkChain 启动时确认节点和数据库是同一条链: 创世区块、配置的检查点和最早的已索引区块
+// 都必须与节点一致. 最新的已索引区块不一致时返回 errReorg
+func (s *State) checkChain() error {
+	nodeHeight, err := s.Node.Client().GetBlockCount()
+	if err != nil {
+		return err
+	}
+
+	if genesis := s.chain.Params.GenesisHash; genesis != nil {
+		if err := s.checkNodeHash(0, genesis.String(), "genesis"); err != nil {
+			return err
+		}
+	}
+
+	for _, checkpoint := range s.chain.Params.Checkpoints {
+		if int64(checkpoint.Height) > nodeHeight {
+			continue
+		}
+		if err := s.checkNodeHash(int64(checkpoint.Height), checkpoint.Hash.String(), "checkpoint"); err != nil {
+			return err
+		}
+	}
+
+	if anchor, err := s.DB.GetAnchor(); err == nil {
+		if err := s.checkNodeHash(anchor.Height, anchor.Hash, "first indexed block"); err != nil {
+			return err
+		}
+	}
+
+	height, err := s.DB.GetHeight()
+	if err != nil {
+		return nil
+	}
+	if tip, err := s.DB.GetBlock(height); err == nil {
+		if err := s.checkNodeHash(tip.Height, tip.Hash, "indexed tip"); errors.Is(err, errChainMismatch) {
+			return fmt.Errorf("%w: %s", errReorg, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorg 节点切换到另一条分支后撤销已索引的孤块, 之后从共同祖先的下一个区块继续扫描
+func (s *State) reorg() error {
+	height, err := s.DB.GetHeight()
+	if err != nil {
+		return err
+	}
+	node := s.Node.Client()
+	ancestor, err := rollbackFork(s.DB, func(h int64) (string, error) {
+		hash, err := node.GetBlockHash(h)
+		if err != nil {
+			return "", err
+		}
+		return hash.String(), nil
+	})
+	// 中途失败时已撤销的区块不会写回, 从剩下的最高区块继续
+	s.fromBlock = resumeHeight(s.DB)
+	if err != nil {
+		return err
+	}
+	log.Warn("scanning", "chain", s.chain.Name, "reorg", height-ancestor, "ancestor", ancestor)
+	metricReorgBlocks.WithLabelValues(s.chain.Name).Add(float64(height - ancestor))
+
+	if err := s.DB.Commit(); err != nil {
+		return err
+	}
+	s.chain.Cache.Purge()
+	metricIndexedHeight.WithLabelValues(s.chain.Name).Set(float64(ancestor))
+	return nil
+}
+
+func (s *State) checkNodeHash(height int64, hash, what string) error {
+	nodeHash, err := s.Node.Client().GetBlockHash(height)
+	if err != nil {
+		return err
+	}
+	if nodeHash.String() != hash {
+		return fmt.Errorf("%w: %s %d is %s, node has %s", errChainMismatch, what, height, hash, nodeHash)
+	}
+	return nil
+}
+
+// nodeChainwork 读取节点记录的累计工作量, btcjson的区块头结果没有这个字段
+func (s *State) nodeChainwork(hash string) (*big.Int, error) {
+	param, err := json.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	verbose, err := json.Marshal(true)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := s.Node.Client().RawRequest("getblockheader", []json.RawMessage{param, verbose})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Chainwork string `json:"chainwork"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	work, ok := new(big.Int).SetString(result.Chainwork, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid chainwork %q", result.Chainwork)
+	}
+	return work, nil
+}
+
+// checkCheckpoint 高度命中检查点时哈希必须一致
+func checkCheckpoint(params *chaincfg.Params, height int64, hash string) error {
+	for _, checkpoint := range params.Checkpoints {
+		if int64(checkpoint.Height) == height && checkpoint.Hash.String() != hash {
+			return fmt.Errorf("%w: block %d is %s, checkpoint is %s", errChainMismatch, height, hash, checkpoint.Hash)
+		}
+	}
+	return nil
+}
+
+// checkProofOfWork 按配置的算法校验区块头哈希不超过目标值. 合并挖矿的区块
+// 以及未配置算法时跳过.
+func checkProofOfWork(header *wire.BlockHeader, algorithm string) error {
+	if header.Version&auxPowVersion != 0 {
+		return nil
+	}
+
+	var hash chainhash.Hash
+	switch algorithm {
+	case powSha256d:
+		hash = header.BlockHash()
+	case powScrypt:
+		buf, err := headerBytes(header)
+		if err != nil {
+			return err
+		}
+		digest, err := scrypt.Key(buf, buf, 1024, 1, 1, chainhash.HashSize)
+		if err != nil {
+			return err
+		}
+		copy(hash[:], digest)
+	default:
+		return nil
+	}
+
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("invalid target bits %08x", header.Bits)
+	}
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("proof of work hash %s above target %064x", hash, target)
+	}
+	return nil
+}
+
+// blockHeader 用节点返回的字段重建80字节区块头
+func blockHeader(block *btcjson.GetBlockVerboseResult) (*wire.BlockHeader, error) {
+	bits, err := strconv.ParseUint(block.Bits, 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	merkleRoot, err := chainhash.NewHashFromStr(block.MerkleRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// 创世区块没有上一个区块
+	prevBlock := &chainhash.Hash{}
+	if block.PreviousHash != "" {
+		if prevBlock, err = chainhash.NewHashFromStr(block.PreviousHash); err != nil {
+			return nil, err
+		}
+	}
+
+	header := wire.NewBlockHeader(block.Version, prevBlock, merkleRoot, uint32(bits), block.Nonce)
+	header.Timestamp = time.Unix(block.Time, 0)
+	return header, nil
+}
+
+func headerBytes(header *wire.BlockHeader) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, wire.MaxBlockHeaderPayload))
+	if err := header.Serialize(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/chaincfg"
+)
+
+func TestCheckProofOfWork(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		block     *btcjson.GetBlockVerboseResult
+	}{
+		{powSha256d, &btcjson.GetBlockVerboseResult{
+			Hash:       "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+			Version:    1,
+			MerkleRoot: "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+			Time:       1231006505,
+			Bits:       "1d00ffff",
+			Nonce:      2083236893,
+		}},
+		{powScrypt, &btcjson.GetBlockVerboseResult{
+			Hash:       "12a765e31ffd4059bada1e25190f6e98c99d9714d334efa41a195a7e7e04bfe2",
+			Version:    1,
+			MerkleRoot: "97ddfbbae6be97fd6cdf3e7ca13232a3afff2353e29badfab7f73011edd4ced9",
+			Time:       1317972665,
+			Bits:       "1e0ffff0",
+			Nonce:      2084524493,
+		}},
+	}
+
+	for _, c := range cases {
+		header, err := blockHeader(c.block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash := header.BlockHash(); hash.String() != c.block.Hash {
+			t.Fatalf("%s: header hashes to %s", c.algorithm, hash)
+		}
+		if err := checkProofOfWork(header, c.algorithm); err != nil {
+			t.Errorf("%s: %v", c.algorithm, err)
+		}
+
+		header.Nonce++
+		if err := checkProofOfWork(header, c.algorithm); err == nil {
+			t.Errorf("%s: tampered header passed", c.algorithm)
+		}
+	}
+}
+
+func TestCheckHeaderLinkage(t *testing.T) {
+	s := &State{chain: &ChainContext{Params: &chaincfg.MainNetParams}}
+	block := &btcjson.GetBlockVerboseResult{
+		Hash:         "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+		Height:       1,
+		Version:      1,
+		PreviousHash: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		MerkleRoot:   "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+		Time:         1231469665,
+		Bits:         "1d00ffff",
+		Nonce:        2573394689,
+	}
+
+	prev := &Block{Height: 0, Hash: block.PreviousHash, Chainwork: "100010001"}
+	record, err := s.checkHeader(prev, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Chainwork != "200020002" {
+		t.Errorf("unexpected chainwork %s", record.Chainwork)
+	}
+
+	prev.Hash = "000000000000000000000000000000000000000000000000000000000000beef"
+	if _, err := s.checkHeader(prev, block); !errors.Is(err, errReorg) {
+		t.Errorf("expected reorg, got %v", err)
+	}
+}
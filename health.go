@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultMaxLagBlocks 未配置max_lag_blocks时允许落后节点的区块数
+	defaultMaxLagBlocks = 10
+	// defaultMaxScanAge 未配置max_scan_age时允许距上次成功扫描的秒数
+	defaultMaxScanAge = 300
+)
+
+// HealthConfig /readyz 的判定阈值, 0表示使用默认值
+type HealthConfig struct {
+	MaxLagBlocks int64 `json:"max_lag_blocks"`
+	MaxScanAge   int64 `json:"max_scan_age"`
+}
+
+func (h HealthConfig) maxLag() int64 {
+	if h.MaxLagBlocks == 0 {
+		return defaultMaxLagBlocks
+	}
+	return h.MaxLagBlocks
+}
+
+func (h HealthConfig) maxScanAge() time.Duration {
+	if h.MaxScanAge == 0 {
+		return defaultMaxScanAge * time.Second
+	}
+	return time.Duration(h.MaxScanAge) * time.Second
+}
+
+// SubsystemStatus 单个子系统的检查结果
+type SubsystemStatus struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// Health 提供所有链的 /healthz 和 /readyz
+type Health struct {
+	cfg    HealthConfig
+	names  []string
+	states map[string]*State
+}
+
+func NewHealth(cfg HealthConfig) *Health {
+	return &Health{cfg: cfg, states: make(map[string]*State)}
+}
+
+func (h *Health) Add(state *State) {
+	h.names = append(h.names, state.chain.Name)
+	h.states[state.chain.Name] = state
+}
+
+// Register 注册根路径的检查接口, 失败时返回503
+func (h *Health) Register(g gin.IRoutes) {
+	g.GET("/healthz", h.Healthz) // 进程存活且数据库可读
+	g.GET("/readyz", h.Readyz)   // 节点可用、同步延迟和扫描时间都在阈值内
+}
+
+func (h *Health) Healthz(c *gin.Context) {
+	ok := true
+	chains := make(map[string]map[string]*SubsystemStatus)
+	for _, name := range h.names {
+		db := h.checkDB(h.states[name])
+		ok = ok && db.OK
+		chains[name] = map[string]*SubsystemStatus{"db": db}
+	}
+	h.respond(c, ok, chains)
+}
+
+func (h *Health) Readyz(c *gin.Context) {
+	ok := true
+	chains := make(map[string]map[string]*SubsystemStatus)
+	for _, name := range h.names {
+		subsystems := h.ready(h.states[name], time.Now())
+		for _, status := range subsystems {
+			ok = ok && status.OK
+		}
+		chains[name] = subsystems
+	}
+	h.respond(c, ok, chains)
+}
+
+func (h *Health) respond(c *gin.Context, ok bool, chains map[string]map[string]*SubsystemStatus) {
+	code, status := 200, "ok"
+	if !ok {
+		code, status = 503, "fail"
+	}
+	c.JSON(code, gin.H{"status": status, "chains": chains})
+}
+
+func (h *Health) checkDB(state *State) *SubsystemStatus {
+	if _, err := state.DB.DB.Has([]byte("height"), nil); err != nil {
+		return &SubsystemStatus{Error: err.Error()}
+	}
+	return &SubsystemStatus{OK: true}
+}
+
+// ready 检查数据库、节点、同步延迟和上次成功扫描的时间
+func (h *Health) ready(state *State, now time.Time) map[string]*SubsystemStatus {
+	subsystems := map[string]*SubsystemStatus{"db": h.checkDB(state)}
+
+	// 节点: 至少一个节点通过最近一次检查, 节点高度取其中最高的
+	nodes := state.Node.Status()
+	tip, healthy := int64(-1), 0
+	for _, node := range nodes {
+		if node.Healthy {
+			healthy++
+			if node.Height > tip {
+				tip = node.Height
+			}
+		}
+	}
+	node := &SubsystemStatus{OK: healthy > 0, Detail: nodes}
+	if !node.OK {
+		node.Error = "no reachable node"
+	}
+	subsystems["node"] = node
+
+	// 同步延迟
+	indexed, err := state.DB.GetHeight()
+	if err != nil {
+		indexed = -1
+	}
+	lag := tip - indexed
+	syncStatus := &SubsystemStatus{OK: true, Detail: gin.H{
+		"indexed_height": indexed,
+		"node_height":    tip,
+		"lag":            lag,
+		"max_lag":        h.cfg.maxLag(),
+	}}
+	switch {
+	case healthy == 0:
+		syncStatus.OK, syncStatus.Error = false, "node height unknown"
+	case lag > h.cfg.maxLag():
+		syncStatus.OK, syncStatus.Error = false, fmt.Sprintf("indexed height lags node by %d blocks", lag)
+	}
+	subsystems["sync"] = syncStatus
+
+	// 扫描器: 上次成功扫描的时间
+	maxAge := h.cfg.maxScanAge()
+	scan := &SubsystemStatus{OK: true}
+	last := state.LastScan()
+	if last.IsZero() {
+		scan.OK, scan.Error = false, "no successful scan yet"
+		scan.Detail = gin.H{"max_age_seconds": int64(maxAge.Seconds())}
+	} else {
+		age := now.Sub(last)
+		scan.Detail = gin.H{
+			"last_scan":       last.Unix(),
+			"age_seconds":     int64(age.Seconds()),
+			"max_age_seconds": int64(maxAge.Seconds()),
+		}
+		if age > maxAge {
+			scan.OK, scan.Error = false, fmt.Sprintf("last successful scan %s ago", age.Truncate(time.Second))
+		}
+	}
+	if err := state.Stopped(); err != nil {
+		scan.OK, scan.Error = false, fmt.Sprintf("scanner stopped: %s", err)
+	}
+	subsystems["scan"] = scan
+	return subsystems
+}
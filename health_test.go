@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestHealthReady(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+	db.SetHeight(95)
+
+	node := &poolNode{rpc: "a", healthy: true, height: 100}
+	state := &State{
+		Node:  &NodePool{nodes: []*poolNode{node}, current: node},
+		DB:    db,
+		chain: &ChainContext{Name: "test"},
+	}
+	h := NewHealth(HealthConfig{MaxLagBlocks: 10, MaxScanAge: 60})
+	now := time.Now()
+
+	failed := func() []string {
+		var names []string
+		for name, status := range h.ready(state, now) {
+			if !status.OK {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	// 还没有成功扫描
+	if names := failed(); len(names) != 1 || names[0] != "scan" {
+		t.Fatalf("expected scan to fail, got %v", names)
+	}
+
+	state.lastScan.Store(now.Add(-30 * time.Second).Unix())
+	if names := failed(); len(names) != 0 {
+		t.Fatalf("expected ready, got failures %v", names)
+	}
+
+	state.lastScan.Store(now.Add(-2 * time.Minute).Unix())
+	node.height = 200
+	node.healthy = false
+	if names := failed(); len(names) != 3 {
+		t.Fatalf("expected node, sync and scan to fail, got %v", names)
+	}
+
+	node.healthy = true
+	state.lastScan.Store(now.Unix())
+	if names := failed(); len(names) != 1 || names[0] != "sync" {
+		t.Fatalf("expected sync to fail, got %v", names)
+	}
+
+	// 扫描器停止后只影响这条链的scan
+	node.height = 100
+	state.stop(errChainMismatch)
+	if names := failed(); len(names) != 1 || names[0] != "scan" {
+		t.Fatalf("expected stopped scanner to fail scan, got %v", names)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	balanceChangePrefix = "balancechange-"
+
+	// maxSeriesPoints 余额序列最多返回的点数
+	maxSeriesPoints = 1000
+)
+
+// seriesIntervals 余额序列支持的间隔(秒)
+var seriesIntervals = map[string]int64{
+	"hour": 3600,
+	"day":  86400,
+}
+
+// balanceChangeKey 高度补齐到固定宽度, 按key的顺序就是按高度的顺序
+func balanceChangeKey(address string, height int64) []byte {
+	return []byte(fmt.Sprintf("%s%s-%012d", balanceChangePrefix, address, height))
+}
+
+// 保存地址在一个区块中的余额变化, 同一区块多次调用时合并
+func (d *RawDB) AddBalanceChange(address string, height, time int64, delta, balance float64) error {
+	change := &BalanceChange{Height: height, Time: time, Delta: delta, Balance: balance}
+	if data, err := d.read().Get(balanceChangeKey(address, height), nil); err == nil {
+		var prev BalanceChange
+		if err := rlp.DecodeBytes(data, &prev); err != nil {
+			return err
+		}
+		change.Delta += prev.Delta
+	}
+
+	data, err := rlp.EncodeToBytes(change)
+	if err != nil {
+		return err
+	}
+	return d.put(balanceChangeKey(address, height), data)
+}
+
+// GetBalanceAt 返回地址在height区块之后的余额, 之前没有变化时为0
+func (d *RawDB) GetBalanceAt(address string, height int64) (float64, error) {
+	iter := d.read().NewIterator(&util.Range{
+		Start: []byte(balanceChangePrefix + address + "-"),
+		Limit: balanceChangeKey(address, height+1),
+	}, nil)
+	defer iter.Release()
+
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+	var change BalanceChange
+	if err := rlp.DecodeBytes(iter.Value(), &change); err != nil {
+		return 0, err
+	}
+	return change.Balance, nil
+}
+
+// GetBalanceChanges 按高度从新到旧分页返回地址的余额变化
+func (d *RawDB) GetBalanceChanges(address string, limit, offset int64) ([]*BalanceChange, error) {
+	iter := d.read().NewIterator(util.BytesPrefix([]byte(balanceChangePrefix+address+"-")), nil)
+	defer iter.Release()
+
+	changes := make([]*BalanceChange, 0)
+	skipped := int64(0)
+	for ok := iter.Last(); ok && int64(len(changes)) < limit; ok = iter.Prev() {
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		var change BalanceChange
+		if err := rlp.DecodeBytes(iter.Value(), &change); err != nil {
+			return nil, err
+		}
+		changes = append(changes, &change)
+	}
+	return changes, iter.Error()
+}
+
+// HeightAtTime 二分查找时间不晚于t的最后一个已索引区块, 所有区块都晚于t时返回-1.
+// 区块时间大致递增, 结果可能与精确值相差几个区块.
+func (d *RawDB) HeightAtTime(t int64) (int64, error) {
+	tip, err := d.GetHeight()
+	if err != nil {
+		return 0, err
+	}
+	low := int64(0)
+	if anchor, err := d.GetAnchor(); err == nil {
+		low = anchor.Height
+	}
+
+	var searchErr error
+	n := sort.Search(int(tip-low+1), func(i int) bool {
+		block, err := d.GetBlock(low + int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return block.Time > t
+	})
+	if searchErr != nil {
+		return 0, fmt.Errorf("block %d: %w", low+int64(n), searchErr)
+	}
+	if n == 0 {
+		return -1, nil
+	}
+	return low + int64(n) - 1, nil
+}
+
+// BalancePoint 余额序列中的一个点, 即该时间点的余额
+type BalancePoint struct {
+	Time    int64   `json:"time"`
+	Height  int64   `json:"height"`
+	Balance float64 `json:"balance"`
+}
+
+// GetBalanceSeries 返回[from, to]内每个间隔结束时的余额
+func (d *RawDB) GetBalanceSeries(address string, from, to int64, interval string) ([]*BalancePoint, error) {
+	step, ok := seriesIntervals[interval]
+	if !ok {
+		return nil, fmt.Errorf("unknown interval %q", interval)
+	}
+	if to < from {
+		return nil, errors.New("to is before from")
+	}
+	if (to-from)/step+1 > maxSeriesPoints {
+		return nil, fmt.Errorf("range has more than %d points", maxSeriesPoints)
+	}
+
+	// 从间隔的边界开始, 方便按天/小时对齐
+	points := make([]*BalancePoint, 0)
+	for t := from - from%step + step - 1; t < to+step; t += step {
+		end := t
+		if end > to {
+			end = to
+		}
+		height, err := d.HeightAtTime(end)
+		if err != nil {
+			return nil, err
+		}
+		point := &BalancePoint{Time: end, Height: height}
+		if height >= 0 {
+			if point.Balance, err = d.GetBalanceAt(address, height); err != nil {
+				return nil, err
+			}
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// errNoBlockAtTime 查询的时间早于所有已索引的区块
+var errNoBlockAtTime = errors.New("no indexed block at or before time")
+
+// balanceAtTime 返回时间t时的余额和对应的区块高度
+func (d *RawDB) balanceAtTime(address string, t int64) (float64, int64, error) {
+	height, err := d.HeightAtTime(t)
+	if err != nil {
+		return 0, 0, err
+	}
+	if height < 0 {
+		return 0, 0, errNoBlockAtTime
+	}
+	balance, err := d.GetBalanceAt(address, height)
+	return balance, height, err
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestBalanceHistory(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	// 区块时间为 1000+height
+	a0 := &Vout{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}
+	applyTestBlock(t, db, 1, []*Tx{{Txid: "A", Vouts: []*Vout{a0}}})
+	db.SetAnchor(&Checkpoint{Height: 1, Hash: "b"})
+	applyTestBlock(t, db, 2, []*Tx{{Txid: "E", Vouts: []*Vout{{Index: 0, Address: "Y", Value: 1, ScriptHash: "sy"}}}})
+	applyTestBlock(t, db, 3, []*Tx{{Txid: "B", Vins: []*Vin{a0.AsVin("A")}, Vouts: []*Vout{{Index: 0, Address: "X", Value: 20, ScriptHash: "sx"}}}})
+
+	for height, want := range map[int64]float64{0: 0, 1: 50, 2: 50, 3: 20} {
+		if balance, err := db.GetBalanceAt("X", height); err != nil || balance != want {
+			t.Errorf("balance at %d = %v (%v), want %v", height, balance, err, want)
+		}
+	}
+
+	changes, err := db.GetBalanceChanges("X", 10, 0)
+	if err != nil || len(changes) != 2 || changes[0].Height != 3 || changes[0].Delta != -30 {
+		t.Fatalf("unexpected changes %+v (%v)", changes, err)
+	}
+
+	for ts, want := range map[int64]int64{999: -1, 1001: 1, 1002: 2, 5000: 3} {
+		if height, err := db.HeightAtTime(ts); err != nil || height != want {
+			t.Errorf("height at time %d = %d (%v), want %d", ts, height, err, want)
+		}
+	}
+	if balance, height, err := db.balanceAtTime("X", 1002); err != nil || balance != 50 || height != 2 {
+		t.Errorf("balance at time 1002 = %v at %d (%v)", balance, height, err)
+	}
+}
+
+func TestResumeHeight(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	if height := resumeHeight(db); height != 0 {
+		t.Errorf("empty database resumes at %d", height)
+	}
+	// 最后一个写完的区块不再重复处理, 否则余额变化会计入两次
+	applyTestBlock(t, db, 5, []*Tx{{Txid: "A", Vouts: []*Vout{{Index: 0, Address: "X", Value: 1, ScriptHash: "sx"}}}})
+	if height := resumeHeight(db); height != 6 {
+		t.Errorf("resumes at %d, want 6", height)
+	}
+	// 配置的from_block不会让已索引的区块重新扫描
+	if height := startHeight(db, 3); height != 6 {
+		t.Errorf("starts at %d with from_block 3, want 6", height)
+	}
+	if height := startHeight(db, 10); height != 10 {
+		t.Errorf("starts at %d with from_block 10, want 10", height)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dogecoinw/go-dogecoin/log"
+)
+
+// shutdownTimeout 收到停止信号后等待HTTP请求和扫描器结束的最长时间
+var shutdownTimeout = 15 * time.Second
+
+// lifecycle 管理扫描器、HTTP服务和数据库的停止顺序. 任一组件失败时停止全部组件.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	errs    []error
+	servers []*http.Server
+	closers []func() error
+}
+
+// newLifecycle 创建后即开始监听中断信号, 启动阶段收到信号也会停止
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &lifecycle{ctx: ctx, cancel: cancel}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Info("lifecycle", "signal", sig, "stopping", "services")
+			cancel() // 取消 context，这将取消所有的 worker
+		case <-ctx.Done():
+		}
+
+		// 再次收到信号时不再等待
+		<-signals
+		fmt.Fprintln(os.Stderr, "received second signal, exiting")
+		os.Exit(1)
+	}()
+	return l
+}
+
+// Fail 记录组件错误并开始停止
+func (l *lifecycle) Fail(err error) {
+	l.mu.Lock()
+	l.errs = append(l.errs, err)
+	l.mu.Unlock()
+	l.cancel()
+}
+
+// Go 运行一个组件, 组件应在ctx取消后尽快返回. 返回错误视为组件失败.
+func (l *lifecycle) Go(name string, fn func(ctx context.Context) error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		if err := fn(l.ctx); err != nil {
+			l.Fail(fmt.Errorf("%s: %w", name, err))
+		}
+	}()
+}
+
+// Serve 在后台启动HTTP服务, 停止时先停止接收新请求再等待已有请求完成
+func (l *lifecycle) Serve(srv *http.Server) {
+	l.mu.Lock()
+	l.servers = append(l.servers, srv)
+	l.mu.Unlock()
+
+	go func() {
+		log.Info("http", "listen", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Fail(fmt.Errorf("http: %w", err))
+		}
+	}()
+}
+
+// OnClose 注册停止时的清理函数, 在所有组件结束后按注册的逆序执行
+func (l *lifecycle) OnClose(fn func() error) {
+	l.mu.Lock()
+	l.closers = append(l.closers, fn)
+	l.mu.Unlock()
+}
+
+// Wait 等待中断信号或组件失败, 然后依次停止HTTP服务、扫描器并关闭数据库.
+// 超时或有组件失败时返回错误.
+func (l *lifecycle) Wait() error {
+	<-l.ctx.Done()
+
+	deadline, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	l.mu.Lock()
+	servers := l.servers
+	l.mu.Unlock()
+	for _, srv := range servers {
+		if err := srv.Shutdown(deadline); err != nil {
+			errs = append(errs, fmt.Errorf("http shutdown: %w", err))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline.Done():
+		errs = append(errs, fmt.Errorf("shutdown timed out after %s", shutdownTimeout))
+	}
+
+	l.mu.Lock()
+	closers := l.closers
+	errs = append(l.errs, errs...)
+	l.mu.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycleStopsOnFailure(t *testing.T) {
+	l := newLifecycle()
+
+	var closed []string
+	l.OnClose(func() error { closed = append(closed, "db"); return nil })
+	l.OnClose(func() error { closed = append(closed, "node"); return nil })
+
+	stopped := false
+	l.Go("scanner", func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped = true
+		return nil
+	})
+	l.Go("checker", func(ctx context.Context) error {
+		return errors.New("chain mismatch")
+	})
+
+	err := l.Wait()
+	if err == nil || !strings.Contains(err.Error(), "checker: chain mismatch") {
+		t.Fatalf("expected component error, got %v", err)
+	}
+	if !stopped {
+		t.Error("scanner not stopped")
+	}
+	if strings.Join(closed, ",") != "node,db" {
+		t.Errorf("closers ran in order %v", closed)
+	}
+}
+
+func TestLifecycleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 10 * time.Millisecond
+
+	l := newLifecycle()
+	release := make(chan struct{})
+	defer close(release)
+	l.Go("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	l.cancel()
+
+	if err := l.Wait(); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
@@ -2,119 +2,139 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"sync/atomic"
 
-	"github.com/dogecoinw/doged/chaincfg"
-	"github.com/dogecoinw/doged/rpcclient"
 	"github.com/dogecoinw/go-dogecoin/log"
 	"github.com/gin-gonic/gin"
-	"github.com/syndtr/goleveldb/leveldb"
-)
-
-var (
-	cfg      Config
-	ChainCfg chaincfg.Params
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(true)))
+	glogger.Verbosity(log.Lvl(3))
+	log.Root().SetHandler(glogger)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	wg := &sync.WaitGroup{}
-
-	LoadConfig(&cfg, "")
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			name, args = args[0], args[1:]
+		} else if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			usage()
+			return
+		}
+	}
 
-	// 将配置中的数组转换为字节数组
-	hdPublicKeyID := [4]byte{
-		byte(cfg.ChainConfig.HDPublicKeyID[0]),
-		byte(cfg.ChainConfig.HDPublicKeyID[1]),
-		byte(cfg.ChainConfig.HDPublicKeyID[2]),
-		byte(cfg.ChainConfig.HDPublicKeyID[3]),
+	if err := commands[name].run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
 	}
-	hdPrivateKeyID := [4]byte{
-		byte(cfg.ChainConfig.HDPrivateKeyID[0]),
-		byte(cfg.ChainConfig.HDPrivateKeyID[1]),
-		byte(cfg.ChainConfig.HDPrivateKeyID[2]),
-		byte(cfg.ChainConfig.HDPrivateKeyID[3]),
+}
+
+// runIndexer 启动每条链的扫描器, serveHTTP为true时同时提供HTTP接口, 收到中断信号后依次停止
+func runIndexer(cfg *Config, settings []*ChainSetting, serveHTTP bool) error {
+	l := newLifecycle()
+
+	// 每条链独立的节点连接、数据库和扫描器
+	routers := make(map[string]*Router)
+	health := NewHealth(cfg.Health)
+	var names []string
+	var running atomic.Int64
+	running.Store(int64(len(settings)))
+	for _, setting := range settings {
+		chain, err := NewChainContext(setting)
+		if err != nil {
+			l.Fail(fmt.Errorf("chain %s: %w", setting.Chain.ChainName, err))
+			break
+		}
+		l.OnClose(chain.Close)
+		chain.Cache = NewResponseCache(cfg.Cache.size())
+		chain.Deposits = NewDepositLedger(cfg.Deposits, chain.DB, chain.Params)
+		if l.ctx.Err() != nil {
+			break
+		}
+
+		prometheus.MustRegister(newDBCollector(chain.Name, chain.DB))
+		state := NewState(l.ctx, chain)
+		l.Go("scanner "+chain.Name, func(ctx context.Context) error {
+			err := state.Start(chain.FromBlock)
+			if err == nil {
+				return nil
+			}
+			// 一条链的扫描器停止不影响其他链和HTTP接口, 停止原因由 /readyz 报告.
+			// 没有HTTP接口时所有链都停止才退出.
+			log.Error("scanning", "chain", chain.Name, "stopped", err)
+			if running.Add(-1) == 0 && !serveHTTP {
+				return err
+			}
+			return nil
+		})
+
+		routers[chain.Name] = NewRouter(chain, state.Fees)
+		health.Add(state)
+		names = append(names, chain.Name)
 	}
 
-	ChainCfg = chaincfg.Params{
-		PubKeyHashAddrID:        byte(cfg.ChainConfig.PubKeyHashAddrID),
-		ScriptHashAddrID:        byte(cfg.ChainConfig.ScriptHashAddrID),
-		PrivateKeyID:            byte(cfg.ChainConfig.PrivateKeyID),
-		WitnessPubKeyHashAddrID: byte(cfg.ChainConfig.WitnessPubKeyHashAddrID),
-		WitnessScriptHashAddrID: byte(cfg.ChainConfig.WitnessScriptHashAddrID),
-		HDPublicKeyID:           hdPublicKeyID,
-		HDPrivateKeyID:          hdPrivateKeyID,
-		HDCoinType:              uint32(cfg.ChainConfig.HDCoinType),
+	if serveHTTP && l.ctx.Err() == nil {
+		auth, err := openAuth(cfg.Auth)
+		if err != nil {
+			l.Fail(fmt.Errorf("auth: %w", err))
+		} else {
+			if auth.db != nil {
+				l.OnClose(auth.db.Close)
+			}
+			l.Serve(&http.Server{Addr: cfg.Server, Handler: newHandler(names, routers, health, auth, cfg.CORS)})
+		}
 	}
+	return l.Wait()
+}
 
-	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(true)))
-	glogger.Verbosity(log.Lvl(3))
-	log.Root().SetHandler(glogger)
+// newHandler 注册每条链的接口
+func newHandler(names []string, routers map[string]*Router, health *Health, auth *Auth, cors CORSConfig) http.Handler {
+	// 创建一个新的 Gin 路由器实例
+	router := gin.Default()
+	router.Use(metricsMiddleware)
+	router.Use(corsMiddleware(cors))
+
+	router.GET("/metrics", gin.WrapH(promhttp.Handler())) // Prometheus指标
+	health.Register(router)
+	auth.Register(&router.RouterGroup)
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         cfg.Chain.RPC,
-		Endpoint:     "ws",
-		User:         cfg.Chain.UserName,
-		Pass:         cfg.Chain.PassWord,
-		HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
-		DisableTLS:   true, // Bitcoin core does not provide TLS by default
+	// 按 /:chain/... 路由到对应的链, 只有一条链时同时保留原来的路径
+	for _, name := range names {
+		routers[name].Register(router.Group("/"+name), auth)
+	}
+	if len(names) == 1 {
+		routers[names[0]].Register(&router.RouterGroup, auth)
 	}
 
-	rpcClient, _ := rpcclient.New(connCfg, nil)
-	db, err := leveldb.OpenFile(cfg.DbPath, nil)
-	if err != nil {
-		panic(fmt.Sprintf("Leveldb err %s", err))
+	return router
+}
+
+func configCheck(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: config check [flags]")
 	}
-	defer db.Close()
-	RawDB := &RawDB{DB: db, Node: rpcClient}
-	state := NewState(ctx, wg, rpcClient, RawDB)
-	wg.Add(1)
 
-	go state.Start(cfg.FromBlock)
+	var cfg Config
+	if _, err := LoadConfig(&cfg, nil, args[1:]); err != nil {
+		return err
+	}
 
-	newRouter := NewRouter(RawDB)
+	data, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
 
-	// 创建一个新的 Gin 路由器实例
-	router := gin.Default()
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")                                               // 允许所有来源访问
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")                // 允许的请求方法
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept") // 允许的请求头部信息
-		c.Writer.Header().Set("Access-Control-Max-Age", "3600")                                                 // 预检请求的有效期，单位为秒
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(200)
-			return
-		}
-		c.Next()
-	})
-
-	router.POST("/utxo", newRouter.GetUtxo)                  // 获取指定地址的UTXO列表，支持按金额和数量筛选
-	router.POST("/getBalance", newRouter.GetBalance)         // 获取指定地址的余额
-	router.POST("/getTxByAddress", newRouter.GetTxByAddress) // 根据地址获取交易历史记录，支持分页
-	router.POST("/getTx", newRouter.GetTx)                   // 根据交易哈希获取交易详细信息
-	router.POST("/broadcast", newRouter.Broadcast)           // 广播已签名的交易到区块链网络
-	router.GET("/currentBlock", newRouter.GetCurrentBlock)   // 获取当前遍历到的区块高度
-
-	// 启动 HTTP 服务器并监听端口
-	go func() {
-		err = router.Run(cfg.Server)
-		if err != nil {
-			panic(err)
-		}
-	}()
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("\nReceived an interrupt, stopping services...")
-		cancel() // 取消 context，这将取消所有的 worker
-	}()
-
-	wg.Wait()
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	fmt.Fprintln(os.Stderr, "config ok")
+	return nil
 }
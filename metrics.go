@@ -0,0 +1,176 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const metricsNamespace = "utxo"
+
+var (
+	metricIndexedHeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "indexed_height",
+		Help:      "Height of the last indexed block.",
+	}, []string{"chain"})
+	metricNodeHeight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_height",
+		Help:      "Block height reported by each node at the last health check.",
+	}, []string{"chain", "rpc"})
+	metricNodeHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "node_healthy",
+		Help:      "Whether the node passed the last health check.",
+	}, []string{"chain", "rpc"})
+
+	metricBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocks_processed_total",
+		Help:      "Blocks indexed by the scanner.",
+	}, []string{"chain"})
+	metricTxs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "txs_processed_total",
+		Help:      "Transactions indexed by the scanner.",
+	}, []string{"chain"})
+	metricMissingPrevouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "missing_prevouts_total",
+		Help:      "Inputs whose previous output was not indexed when the spending transaction was scanned.",
+	}, []string{"chain"})
+	metricForks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fork_calls_total",
+		Help:      "Funding transactions fetched from the node to resolve missing previous outputs.",
+	}, []string{"chain"})
+	metricReorgBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reorg_blocks_total",
+		Help:      "Indexed blocks rolled back because the node switched to another branch.",
+	}, []string{"chain"})
+
+	metricRPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Node RPC latency by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"chain", "method"})
+	metricRPCErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed node RPC calls by method.",
+	}, []string{"chain", "method"})
+
+	metricHTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	metricMempoolTxs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mempool_txs",
+		Help:      "Transactions in the node mempool at the last refresh.",
+	}, []string{"chain"})
+	metricMempoolVsize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mempool_vsize_bytes",
+		Help:      "Total virtual size of the node mempool at the last refresh.",
+	}, []string{"chain"})
+)
+
+// observeRPC 记录一次节点调用的耗时和错误
+func observeRPC(chain, method string, start time.Time, err error) {
+	metricRPCDuration.WithLabelValues(chain, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricRPCErrors.WithLabelValues(chain, method).Inc()
+	}
+}
+
+// metricsMiddleware 按路由模板和状态码记录请求耗时, 未匹配的路由记为 unmatched
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	metricHTTPDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+}
+
+// dbCollector 在每次抓取时读取LevelDB的统计信息
+type dbCollector struct {
+	chain string
+	db    *RawDB
+}
+
+var (
+	descLevelSize = prometheus.NewDesc(metricsNamespace+"_leveldb_level_size_bytes",
+		"Size of each LevelDB level.", []string{"chain", "level"}, nil)
+	descLevelTables = prometheus.NewDesc(metricsNamespace+"_leveldb_level_tables",
+		"Number of tables in each LevelDB level.", []string{"chain", "level"}, nil)
+	descCompactions = prometheus.NewDesc(metricsNamespace+"_leveldb_compactions_total",
+		"LevelDB compactions by type.", []string{"chain", "type"}, nil)
+	descWriteDelays = prometheus.NewDesc(metricsNamespace+"_leveldb_write_delays_total",
+		"Writes delayed by LevelDB compaction.", []string{"chain"}, nil)
+	descWriteDelaySeconds = prometheus.NewDesc(metricsNamespace+"_leveldb_write_delay_seconds_total",
+		"Time writes spent delayed by LevelDB compaction.", []string{"chain"}, nil)
+	descWritePaused = prometheus.NewDesc(metricsNamespace+"_leveldb_write_paused",
+		"Whether LevelDB writes are currently paused.", []string{"chain"}, nil)
+	descIO = prometheus.NewDesc(metricsNamespace+"_leveldb_io_bytes_total",
+		"Bytes read and written by LevelDB.", []string{"chain", "op"}, nil)
+)
+
+func newDBCollector(chain string, db *RawDB) *dbCollector {
+	return &dbCollector{chain: chain, db: db}
+}
+
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descLevelSize
+	ch <- descLevelTables
+	ch <- descCompactions
+	ch <- descWriteDelays
+	ch <- descWriteDelaySeconds
+	ch <- descWritePaused
+	ch <- descIO
+}
+
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	var stats leveldb.DBStats
+	if err := c.db.DB.Stats(&stats); err != nil {
+		return
+	}
+
+	for level, size := range stats.LevelSizes {
+		ch <- prometheus.MustNewConstMetric(descLevelSize, prometheus.GaugeValue, float64(size), c.chain, strconv.Itoa(level))
+	}
+	for level, tables := range stats.LevelTablesCounts {
+		ch <- prometheus.MustNewConstMetric(descLevelTables, prometheus.GaugeValue, float64(tables), c.chain, strconv.Itoa(level))
+	}
+	compactions := map[string]uint32{
+		"memory":    stats.MemComp,
+		"level0":    stats.Level0Comp,
+		"nonlevel0": stats.NonLevel0Comp,
+		"seek":      stats.SeekComp,
+	}
+	for kind, count := range compactions {
+		ch <- prometheus.MustNewConstMetric(descCompactions, prometheus.CounterValue, float64(count), c.chain, kind)
+	}
+	ch <- prometheus.MustNewConstMetric(descWriteDelays, prometheus.CounterValue, float64(stats.WriteDelayCount), c.chain)
+	ch <- prometheus.MustNewConstMetric(descWriteDelaySeconds, prometheus.CounterValue, stats.WriteDelayDuration.Seconds(), c.chain)
+	paused := 0.0
+	if stats.WritePaused {
+		paused = 1
+	}
+	ch <- prometheus.MustNewConstMetric(descWritePaused, prometheus.GaugeValue, paused, c.chain)
+	ch <- prometheus.MustNewConstMetric(descIO, prometheus.CounterValue, float64(stats.IORead), c.chain, "read")
+	ch <- prometheus.MustNewConstMetric(descIO, prometheus.CounterValue, float64(stats.IOWrite), c.chain, "write")
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/go-dogecoin/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// schemaVersion 当前数据库结构版本
+//
+//	1: vout-/utxo-/script- 记录和交易记录带上脚本、脚本类型、高度和coinbase标记
+//	2: 持币排行索引 richlist- 和地址统计 addrstats-
+//	3: utxo集合统计和MuHash utxoset/utxoage-
+//	4: 输出被花费的索引 spend-
+const schemaVersion = 4
+
+// migrate 把数据库升级到当前结构版本, 在扫描开始前调用
+func migrate(db *RawDB, params *chaincfg.Params) error {
+	schema, err := db.GetSchema()
+	if err != nil {
+		return err
+	}
+	if schema >= schemaVersion {
+		return nil
+	}
+
+	log.Info("migrate", "from", schema, "to", schemaVersion)
+	if schema < 1 {
+		if err := migrateUtxoScripts(db, params); err != nil {
+			return err
+		}
+		if err := migrateLegacyRecords(db, params); err != nil {
+			return err
+		}
+	}
+	if schema < 2 {
+		if err := migrateAddressIndexes(db); err != nil {
+			return err
+		}
+	}
+	if schema < 3 {
+		if err := migrateUtxoSet(db); err != nil {
+			return err
+		}
+	}
+	if schema < 4 {
+		if err := migrateSpends(db); err != nil {
+			return err
+		}
+	}
+	return db.SetSchema(schemaVersion)
+}
+
+// outputFetcher 从节点重新读取旧记录对应的输出, 缓存交易和区块高度
+type outputFetcher struct {
+	db      *RawDB
+	params  *chaincfg.Params
+	txs     map[string]*btcjson.TxRawResult
+	heights map[string]int64
+}
+
+func newOutputFetcher(db *RawDB, params *chaincfg.Params) *outputFetcher {
+	return &outputFetcher{
+		db:      db,
+		params:  params,
+		txs:     make(map[string]*btcjson.TxRawResult),
+		heights: make(map[string]int64),
+	}
+}
+
+// output 返回输出的完整记录, address不为空时保留旧记录的记账地址, 保持原有的key和余额不变
+func (f *outputFetcher) output(txid string, index uint32, address string) (*Vout, error) {
+	tx, ok := f.txs[txid]
+	if !ok {
+		txhash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, err
+		}
+		tx, err = f.db.Node.Client().GetRawTransactionVerboseBool(txhash)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s: %w", txid, err)
+		}
+		f.txs[txid] = tx
+	}
+	if int(index) >= len(tx.Vout) {
+		return nil, fmt.Errorf("output %s-%d not found in tx", txid, index)
+	}
+
+	height, ok := f.heights[tx.BlockHash]
+	if !ok {
+		var err error
+		if height, err = blockHeight(f.db.Node.Client(), tx.BlockHash); err != nil {
+			return nil, err
+		}
+		f.heights[tx.BlockHash] = height
+	}
+
+	voutDB, _, err := newVout(tx.Vout[index], f.params, height, isCoinbase(tx))
+	if err != nil {
+		return nil, err
+	}
+	if address != "" {
+		voutDB.Address = address
+	}
+	return voutDB, nil
+}
+
+// reset 每写入一批后清空交易缓存, 区块高度保留
+func (f *outputFetcher) reset() {
+	f.txs = make(map[string]*btcjson.TxRawResult)
+}
+
+// migrateUtxoScripts 为旧的utxo记录补齐脚本信息, 并重写对应的vout记录.
+// 已花费输出的记录由 migrateLegacyRecords 补齐.
+func migrateUtxoScripts(db *RawDB, params *chaincfg.Params) error {
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(utxoPrefix)), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	fetcher := newOutputFetcher(db, params)
+	migrated := 0
+	for iter.Next() {
+		var vin *Vin
+		if err := rlp.DecodeBytes(iter.Value(), &vin); err != nil {
+			return err
+		}
+		if !vin.Legacy() {
+			continue
+		}
+
+		voutDB, err := fetcher.output(vin.Txid, vin.Vout, vin.Address)
+		if err != nil {
+			return fmt.Errorf("utxo %s-%d: %w", vin.Txid, vin.Vout, err)
+		}
+
+		utxoData, err := rlp.EncodeToBytes(voutDB.AsVin(vin.Txid))
+		if err != nil {
+			return err
+		}
+		voutData, err := rlp.EncodeToBytes(voutDB)
+		if err != nil {
+			return err
+		}
+		batch.Put(append([]byte{}, iter.Key()...), utxoData)
+		batch.Put(voutKey(vin.Txid, vin.Vout), voutData)
+		migrated++
+
+		if batch.Len() >= 1000 {
+			if err := db.DB.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+			fetcher.reset()
+			log.Info("migrate", "utxo", migrated)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	log.Info("migrate", "utxo", migrated, "status", "done")
+	return nil
+}
+
+// migrateLegacyRecords 补齐已花费输出的旧格式记录: 先从节点重写 vout- 记录和对应的 script- 记录,
+// 再用重写后的 vout- 记录重写交易记录中的输入和输出. 完成后数据库中不再有旧格式的记录.
+func migrateLegacyRecords(db *RawDB, params *chaincfg.Params) error {
+	batch := new(leveldb.Batch)
+	fetcher := newOutputFetcher(db, params)
+	flush := func(force bool) error {
+		if !force && batch.Len() < 1000 {
+			return nil
+		}
+		if err := db.DB.Write(batch, nil); err != nil {
+			return err
+		}
+		batch.Reset()
+		fetcher.reset()
+		return nil
+	}
+
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(voutPrefix)), nil)
+	vouts := 0
+	for iter.Next() {
+		var vout *Vout
+		if err := rlp.DecodeBytes(iter.Value(), &vout); err != nil {
+			iter.Release()
+			return err
+		}
+		if !vout.Legacy() {
+			continue
+		}
+		// vout-{txid}-{index}
+		parts := strings.Split(string(iter.Key()), "-")
+		if len(parts) != 3 {
+			continue
+		}
+		voutDB, err := fetcher.output(parts[1], vout.Index, vout.Address)
+		if err != nil {
+			iter.Release()
+			return fmt.Errorf("vout %s-%d: %w", parts[1], vout.Index, err)
+		}
+		data, err := rlp.EncodeToBytes(voutDB)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		batch.Put(append([]byte{}, iter.Key()...), data)
+		if ok, _ := db.DB.Has(scriptKey(voutDB.ScriptHash, parts[1], vout.Index), nil); ok {
+			batch.Put(scriptKey(voutDB.ScriptHash, parts[1], vout.Index), data)
+		}
+		vouts++
+		if err := flush(false); err != nil {
+			iter.Release()
+			return err
+		}
+		if vouts%10000 == 0 {
+			log.Info("migrate", "vout", vouts)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := flush(true); err != nil {
+		return err
+	}
+
+	// tx- 前缀同时包括 tx-address- 记录
+	iter = db.DB.NewIterator(util.BytesPrefix([]byte(txPrefix)), nil)
+	defer iter.Release()
+	txs := 0
+	for iter.Next() {
+		if strings.HasPrefix(string(iter.Key()), txAddressPrefix) {
+			continue
+		}
+		var tx *Tx
+		if err := rlp.DecodeBytes(iter.Value(), &tx); err != nil {
+			return err
+		}
+
+		migrated := false
+		for i, vout := range tx.Vouts {
+			if !vout.Legacy() {
+				continue
+			}
+			if voutDB, err := db.GetVout(tx.Txid, vout.Index); err == nil && !voutDB.Legacy() {
+				tx.Vouts[i] = voutDB
+				migrated = true
+			}
+		}
+		for i, vin := range tx.Vins {
+			if !vin.Legacy() {
+				continue
+			}
+			if voutDB, err := db.GetVout(vin.Txid, vin.Vout); err == nil && !voutDB.Legacy() {
+				if vin.Address != "" {
+					voutDB.Address = vin.Address
+				}
+				tx.Vins[i] = voutDB.AsVin(vin.Txid)
+				migrated = true
+			}
+		}
+		if !migrated {
+			continue
+		}
+
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			return err
+		}
+		batch.Put(append([]byte{}, iter.Key()...), data)
+		txs++
+		if err := flush(false); err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := flush(true); err != nil {
+		return err
+	}
+	log.Info("migrate", "vout", vouts, "tx", txs, "status", "done")
+	return nil
+}
+
+// migrateAddressIndexes 从 balance- 记录建立持币排行索引, 从地址交易索引和交易记录计算地址统计
+func migrateAddressIndexes(db *RawDB) error {
+	batch := new(leveldb.Batch)
+	flush := func() error {
+		if batch.Len() < 1000 {
+			return nil
+		}
+		if err := db.DB.Write(batch, nil); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
+	}
+
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(balancePrefix)), nil)
+	for iter.Next() {
+		balance, err := strconv.ParseFloat(string(iter.Value()), 64)
+		if err != nil {
+			continue
+		}
+		putRichList(batch, strings.TrimPrefix(string(iter.Key()), balancePrefix), 0, balance)
+		if err := flush(); err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// tx-address- 记录按地址排序, 逐个地址计算
+	var address string
+	var stats *AddressStats
+	addresses := 0
+	finish := func() error {
+		if stats == nil || stats.TxCount == 0 {
+			return nil
+		}
+		utxos := db.DB.NewIterator(util.BytesPrefix([]byte(utxoPrefix+address+"-")), nil)
+		for utxos.Next() {
+			stats.UtxoCount++
+		}
+		utxos.Release()
+
+		data, err := rlp.EncodeToBytes(stats)
+		if err != nil {
+			return err
+		}
+		batch.Put(addressStatsKey(address), data)
+		addresses++
+		if addresses%10000 == 0 {
+			log.Info("migrate", "address stats", addresses)
+		}
+		return flush()
+	}
+
+	iter = db.DB.NewIterator(util.BytesPrefix([]byte(txAddressPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		parts := strings.Split(string(iter.Key()), "-")
+		if len(parts) != 6 {
+			continue
+		}
+		if parts[2] != address {
+			if err := finish(); err != nil {
+				return err
+			}
+			address, stats = parts[2], &AddressStats{}
+		}
+		height, _ := strconv.ParseInt(parts[3], 10, 64)
+		tx, err := db.GetTx(parts[5])
+		if err != nil {
+			continue
+		}
+
+		involved := false
+		for _, vout := range tx.Vouts {
+			if vout.Owner() == address {
+				stats.Received += vout.Value
+				involved = true
+			}
+		}
+		for _, vin := range tx.Vins {
+			if vin.Owner() == address {
+				stats.Sent += vin.Value
+				involved = true
+			}
+		}
+		if !involved {
+			continue
+		}
+		if stats.TxCount == 0 || height < stats.FirstSeen {
+			stats.FirstSeen = height
+		}
+		if height > stats.LastSeen {
+			stats.LastSeen = height
+		}
+		stats.TxCount++
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	log.Info("migrate", "address stats", addresses, "status", "done")
+	return nil
+}
+
+// migrateUtxoSet 从现有的utxo记录计算utxo集合统计
+func migrateUtxoSet(db *RawDB) error {
+	set := newUtxoSet()
+	if height, err := db.GetHeight(); err == nil {
+		set.Height = height
+	}
+
+	iter := db.DB.NewIterator(util.BytesPrefix([]byte(utxoPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var coin Vin
+		if err := rlp.DecodeBytes(iter.Value(), &coin); err != nil {
+			return err
+		}
+		if err := set.Add(&coin); err != nil {
+			return fmt.Errorf("utxo %s: %w", iter.Key(), err)
+		}
+		if set.Count%100000 == 0 {
+			log.Info("migrate", "utxo set", set.Count)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	// 年龄分组保存时与已有记录合并, 重建前先删除旧记录
+	batch := new(leveldb.Batch)
+	ages := db.DB.NewIterator(util.BytesPrefix([]byte(utxoAgePrefix)), nil)
+	for ages.Next() {
+		batch.Delete(append([]byte(nil), ages.Key()...))
+	}
+	ages.Release()
+	if err := ages.Error(); err != nil {
+		return err
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	if err := db.SetUtxoSet(set); err != nil {
+		return err
+	}
+	log.Info("migrate", "utxo set", set.Count, "status", "done")
+	return nil
+}
+
+// migrateSpends 从已索引区块的交易记录建立 spend- 索引. 扫描时按缺失输入补记的交易
+// 不在区块记录中, 它们花费的输出没有索引. 交易记录不包括coinbase和未解析的输入, 不能得到输入在交易中的
+// 序号, 这些记录的输入序号为未知.
+func migrateSpends(db *RawDB) error {
+	tip, err := db.GetHeight()
+	if err != nil {
+		return nil
+	}
+	start := int64(0)
+	if anchor, err := db.GetAnchor(); err == nil {
+		start = anchor.Height
+	}
+
+	batch := new(leveldb.Batch)
+	count := 0
+	for height := start; height <= tip; height++ {
+		block, err := db.GetBlock(height)
+		if err != nil {
+			continue
+		}
+		for _, txid := range block.Txids {
+			tx, err := db.GetTx(txid)
+			if err != nil {
+				continue
+			}
+			for _, vin := range tx.Vins {
+				// 扫描时写入的记录带有输入序号, 不覆盖
+				if ok, err := db.DB.Has(spendKey(vin.Txid, vin.Vout), nil); err != nil || ok {
+					continue
+				}
+				data, err := rlp.EncodeToBytes(&Spend{Txid: txid, Height: height})
+				if err != nil {
+					return err
+				}
+				batch.Put(spendKey(vin.Txid, vin.Vout), data)
+				count++
+			}
+		}
+		if batch.Len() >= 1000 {
+			if err := db.DB.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		if height%10000 == 0 {
+			log.Info("migrate", "spends", height, "tip", tip)
+		}
+	}
+	if err := db.DB.Write(batch, nil); err != nil {
+		return err
+	}
+	log.Info("migrate", "spends", count, "status", "done")
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// muHashBytes MuHash3072中数的字节长度
+const muHashBytes = 384
+
+// muHashPrime 2^3072 - 1103717
+var muHashPrime = func() *big.Int {
+	p := new(big.Int).Lsh(big.NewInt(1), 3072)
+	return p.Sub(p, big.NewInt(1103717))
+}()
+
+// MuHash 与Bitcoin Core相同的MuHash3072, 加入和移除元素的顺序不影响结果
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+func NewMuHash() *MuHash {
+	return &MuHash{numerator: big.NewInt(1), denominator: big.NewInt(1)}
+}
+
+// muHashFromBytes 从保存的分子和分母恢复, 两者都是小端序
+func muHashFromBytes(numerator, denominator []byte) *MuHash {
+	m := NewMuHash()
+	if len(numerator) > 0 {
+		m.numerator = leToInt(numerator)
+	}
+	if len(denominator) > 0 {
+		m.denominator = leToInt(denominator)
+	}
+	return m
+}
+
+// muHashElement 用元素的sha256作为ChaCha20的key生成3072位的数
+func muHashElement(data []byte) *big.Int {
+	key := sha256.Sum256(data)
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err)
+	}
+	stream := make([]byte, muHashBytes)
+	cipher.XORKeyStream(stream, stream)
+	return leToInt(stream)
+}
+
+func (m *MuHash) Insert(data []byte) {
+	m.numerator.Mul(m.numerator, muHashElement(data))
+	m.numerator.Mod(m.numerator, muHashPrime)
+}
+
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, muHashElement(data))
+	m.denominator.Mod(m.denominator, muHashPrime)
+}
+
+// Bytes 返回用于保存的分子和分母
+func (m *MuHash) Bytes() ([]byte, []byte) {
+	return intToLE(m.numerator), intToLE(m.denominator)
+}
+
+// Finalize 返回与 gettxoutsetinfo muhash 相同显示顺序的十六进制哈希
+func (m *MuHash) Finalize() string {
+	inverse := new(big.Int).ModInverse(m.denominator, muHashPrime)
+	value := inverse.Mul(inverse, m.numerator)
+	value.Mod(value, muHashPrime)
+
+	sum := sha256.Sum256(intToLE(value))
+	// uint256按字节逆序显示
+	for i, j := 0, len(sum)-1; i < j; i, j = i+1, j-1 {
+		sum[i], sum[j] = sum[j], sum[i]
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+func leToInt(data []byte) *big.Int {
+	be := make([]byte, len(data))
+	for i, b := range data {
+		be[len(data)-1-i] = b
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+func intToLE(n *big.Int) []byte {
+	be := n.FillBytes(make([]byte, muHashBytes))
+	le := make([]byte, muHashBytes)
+	for i, b := range be {
+		le[muHashBytes-1-i] = b
+	}
+	return le
+}
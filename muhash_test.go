@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// 与Bitcoin Core crypto_tests中muhash_tests的结果相同
+func TestMuHash(t *testing.T) {
+	element := func(i byte) []byte {
+		data := make([]byte, 32)
+		data[0] = i
+		return data
+	}
+
+	m := NewMuHash()
+	m.Insert(element(0))
+	m.Insert(element(1))
+	m.Remove(element(2))
+	if got, want := m.Finalize(), "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863"; got != want {
+		t.Fatalf("muhash %s, want %s", got, want)
+	}
+
+	// 顺序无关, 保存后恢复结果不变
+	n := NewMuHash()
+	n.Remove(element(2))
+	n.Insert(element(1))
+	n.Insert(element(0))
+	restored := muHashFromBytes(n.Bytes())
+	if restored.Finalize() != m.Finalize() {
+		t.Fatal("muhash depends on order or does not survive a round trip")
+	}
+
+	if NewMuHash().Finalize() == m.Finalize() {
+		t.Fatal("empty set hashes like a non-empty one")
+	}
+}
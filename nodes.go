@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/doged/rpcclient"
+	"github.com/dogecoinw/doged/wire"
+	"github.com/dogecoinw/go-dogecoin/log"
+)
+
+// nodeCheckInterval 两次节点健康检查之间的最小间隔
+var nodeCheckInterval = 15 * time.Second
+
+// NodeStatus 节点最近一次健康检查的结果
+type NodeStatus struct {
+	RPC       string `json:"rpc"`
+	Healthy   bool   `json:"healthy"`
+	Current   bool   `json:"current"`
+	Height    int64  `json:"height"`
+	Chainwork string `json:"chainwork"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt int64  `json:"checked_at"`
+}
+
+type poolNode struct {
+	rpc    string
+	client *RPCClient
+
+	healthy   bool
+	height    int64
+	chainwork *big.Int
+	err       error
+	checkedAt time.Time
+}
+
+// NodePool 同一条链的多个节点. 扫描使用累计工作量最大的健康节点,
+// 广播发送到所有健康节点.
+type NodePool struct {
+	chain string
+
+	mu      sync.RWMutex
+	nodes   []*poolNode
+	current *poolNode
+}
+
+func NewNodePool(chain string, endpoints []RPCEndpoint) (*NodePool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no rpc endpoints")
+	}
+
+	pool := &NodePool{chain: chain}
+	for _, endpoint := range endpoints {
+		connCfg := &rpcclient.ConnConfig{
+			Host:         endpoint.RPC,
+			Endpoint:     "ws",
+			User:         endpoint.UserName,
+			Pass:         endpoint.PassWord,
+			CookiePath:   endpoint.CookieFile,
+			HTTPPostMode: true, // Bitcoin core only supports HTTP POST mode
+			DisableTLS:   true, // Bitcoin core does not provide TLS by default
+		}
+		client, err := rpcclient.New(connCfg, nil)
+		if err != nil {
+			pool.Shutdown()
+			return nil, fmt.Errorf("rpc client %s: %w", endpoint.RPC, err)
+		}
+		// 第一次检查之前假定节点可用
+		pool.nodes = append(pool.nodes, &poolNode{rpc: endpoint.RPC, client: &RPCClient{Client: client, chain: chain}, healthy: true})
+	}
+	pool.current = pool.nodes[0]
+	return pool, nil
+}
+
+// Client 返回当前选中的节点
+func (p *NodePool) Client() *RPCClient {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current.client
+}
+
+// Check 查询每个节点的高度和累计工作量, 重新选择当前节点.
+// force为false时距离上次检查不足nodeCheckInterval则跳过.
+func (p *NodePool) Check(force bool) {
+	p.mu.RLock()
+	fresh := !force && time.Since(p.current.checkedAt) < nodeCheckInterval
+	p.mu.RUnlock()
+	if fresh {
+		return
+	}
+
+	type result struct {
+		height    int64
+		chainwork *big.Int
+		err       error
+	}
+	results := make([]result, len(p.nodes))
+	var wg sync.WaitGroup
+	for i, node := range p.nodes {
+		wg.Add(1)
+		go func(i int, client *RPCClient) {
+			defer wg.Done()
+			info, err := client.GetBlockChainInfo()
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			work, ok := new(big.Int).SetString(info.ChainWork, 16)
+			if !ok {
+				results[i].err = fmt.Errorf("invalid chainwork %q", info.ChainWork)
+				return
+			}
+			results[i] = result{height: int64(info.Blocks), chainwork: work}
+		}(i, node.client)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i, node := range p.nodes {
+		node.checkedAt = now
+		node.err = results[i].err
+		node.healthy = results[i].err == nil
+		if node.healthy {
+			node.height = results[i].height
+			node.chainwork = results[i].chainwork
+			metricNodeHeight.WithLabelValues(p.chain, node.rpc).Set(float64(node.height))
+			metricNodeHealthy.WithLabelValues(p.chain, node.rpc).Set(1)
+		} else {
+			log.Warn("nodes", "chain", p.chain, "rpc", node.rpc, "err", node.err)
+			metricNodeHealthy.WithLabelValues(p.chain, node.rpc).Set(0)
+		}
+	}
+	p.selectLocked()
+}
+
+// Fail 当前节点请求失败时标记为不可用并切换到其他健康节点
+func (p *NodePool) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nodes) == 1 {
+		return
+	}
+	p.current.healthy = false
+	p.current.err = err
+	p.selectLocked()
+}
+
+// selectLocked 选择累计工作量最大的健康节点, 相同时保留当前节点
+func (p *NodePool) selectLocked() {
+	var best *poolNode
+	for _, node := range p.nodes {
+		if !node.healthy {
+			continue
+		}
+		if best == nil || node.work().Cmp(best.work()) > 0 || (node == p.current && node.work().Cmp(best.work()) == 0) {
+			best = node
+		}
+	}
+	if best == nil || best == p.current {
+		return
+	}
+	log.Info("nodes", "chain", p.chain, "switch", best.rpc, "height", best.height)
+	p.current = best
+}
+
+func (n *poolNode) work() *big.Int {
+	if n.chainwork == nil {
+		return new(big.Int)
+	}
+	return n.chainwork
+}
+
+// SendRawTransaction 广播到所有健康节点(没有健康节点时尝试全部节点),
+// 任意一个节点接受即成功
+func (p *NodePool) SendRawTransaction(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	p.mu.RLock()
+	var clients []*RPCClient
+	for _, node := range p.nodes {
+		if node.healthy {
+			clients = append(clients, node.client)
+		}
+	}
+	if len(clients) == 0 {
+		for _, node := range p.nodes {
+			clients = append(clients, node.client)
+		}
+	}
+	p.mu.RUnlock()
+
+	var (
+		txhash *chainhash.Hash
+		errs   []error
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *RPCClient) {
+			defer wg.Done()
+			hash, err := client.SendRawTransaction(tx, true)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			txhash = hash
+		}(client)
+	}
+	wg.Wait()
+
+	if txhash == nil {
+		return nil, errors.Join(errs...)
+	}
+	return txhash, nil
+}
+
+// Status 返回每个节点最近一次检查的结果
+func (p *NodePool) Status() []*NodeStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := make([]*NodeStatus, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		status := &NodeStatus{
+			RPC:       node.rpc,
+			Healthy:   node.healthy,
+			Current:   node == p.current,
+			Height:    node.height,
+			Chainwork: node.work().Text(16),
+			CheckedAt: node.checkedAt.Unix(),
+		}
+		if node.err != nil {
+			status.Error = node.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (p *NodePool) Shutdown() {
+	for _, node := range p.nodes {
+		node.client.Shutdown()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestNodePoolSelect(t *testing.T) {
+	a := &poolNode{rpc: "a", healthy: true, chainwork: big.NewInt(100)}
+	b := &poolNode{rpc: "b", healthy: true, chainwork: big.NewInt(200)}
+	c := &poolNode{rpc: "c", healthy: true, chainwork: big.NewInt(200)}
+	pool := &NodePool{nodes: []*poolNode{a, b, c}, current: a}
+
+	pool.selectLocked()
+	if pool.current != b {
+		t.Fatalf("expected node with most work, got %s", pool.current.rpc)
+	}
+
+	// 工作量相同时不切换
+	pool.current = c
+	pool.selectLocked()
+	if pool.current != c {
+		t.Fatalf("expected current node to be kept, got %s", pool.current.rpc)
+	}
+
+	pool.Fail(errors.New("connection refused"))
+	if pool.current != b || c.healthy {
+		t.Fatalf("expected failover to b, got %s", pool.current.rpc)
+	}
+
+	b.healthy = false
+	a.healthy = false
+	pool.selectLocked()
+	if pool.current != b {
+		t.Fatalf("expected current node kept when none healthy, got %s", pool.current.rpc)
+	}
+}
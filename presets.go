@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+)
+
+// chainPreset 内置的链参数, chain_config 中的字段只用于覆盖
+type chainPreset struct {
+	params       chaincfg.Params
+	powAlgorithm string
+}
+
+// chainPresets 按 chain_name 查找内置参数
+var chainPresets = map[string]*chainPreset{
+	"bitcoin": {
+		params: chaincfg.Params{
+			GenesisHash:      chaincfg.MainNetParams.GenesisHash,
+			CoinbaseMaturity: 100,
+			Bech32HRPSegwit:  "bc",
+			PubKeyHashAddrID: 0x00, // 1开头
+			ScriptHashAddrID: 0x05, // 3开头
+			PrivateKeyID:     0x80,
+			HDPublicKeyID:    [4]byte{0x04, 0x88, 0xb2, 0x1e}, // xpub
+			HDPrivateKeyID:   [4]byte{0x04, 0x88, 0xad, 0xe4}, // xprv
+			HDCoinType:       0,
+		},
+		powAlgorithm: powSha256d,
+	},
+	"bitcoin-testnet": {
+		params: chaincfg.Params{
+			GenesisHash:      chaincfg.TestNet3Params.GenesisHash,
+			CoinbaseMaturity: 100,
+			Bech32HRPSegwit:  "tb",
+			PubKeyHashAddrID: 0x6f, // m或n开头
+			ScriptHashAddrID: 0xc4, // 2开头
+			PrivateKeyID:     0xef,
+			HDPublicKeyID:    [4]byte{0x04, 0x35, 0x87, 0xcf}, // tpub
+			HDPrivateKeyID:   [4]byte{0x04, 0x35, 0x83, 0x94}, // tprv
+			HDCoinType:       1,
+		},
+		powAlgorithm: powSha256d,
+	},
+	"regtest": {
+		params: chaincfg.Params{
+			GenesisHash:      chaincfg.RegressionNetParams.GenesisHash,
+			CoinbaseMaturity: 100,
+			Bech32HRPSegwit:  "bcrt",
+			PubKeyHashAddrID: 0x6f,
+			ScriptHashAddrID: 0xc4,
+			PrivateKeyID:     0xef,
+			HDPublicKeyID:    [4]byte{0x04, 0x35, 0x87, 0xcf},
+			HDPrivateKeyID:   [4]byte{0x04, 0x35, 0x83, 0x94},
+			HDCoinType:       1,
+		},
+		powAlgorithm: powSha256d,
+	},
+	"litecoin": {
+		params: chaincfg.Params{
+			GenesisHash:      presetHash("12a765e31ffd4059bada1e25190f6e98c99d9714d334efa41a195a7e7e04bfe2"),
+			CoinbaseMaturity: 100,
+			Bech32HRPSegwit:  "ltc",
+			PubKeyHashAddrID: 0x30, // L开头
+			ScriptHashAddrID: 0x32, // M开头
+			PrivateKeyID:     0xb0,
+			HDPublicKeyID:    [4]byte{0x04, 0x88, 0xb2, 0x1e},
+			HDPrivateKeyID:   [4]byte{0x04, 0x88, 0xad, 0xe4},
+			HDCoinType:       2,
+		},
+		powAlgorithm: powScrypt,
+	},
+	"dogecoin": {
+		params: chaincfg.Params{
+			GenesisHash:      presetHash("1a91e3dace36e2be3bf030a65679fe821aa1d6ef92e7c9902eb318182c355691"),
+			CoinbaseMaturity: 240,
+			PubKeyHashAddrID: 0x1e, // D开头
+			ScriptHashAddrID: 0x16, // 9或A开头
+			PrivateKeyID:     0x9e,
+			HDPublicKeyID:    [4]byte{0x02, 0xfa, 0xca, 0xfd}, // dgub
+			HDPrivateKeyID:   [4]byte{0x02, 0xfa, 0xc3, 0x98}, // dgpv
+			HDCoinType:       3,
+		},
+		powAlgorithm: powScrypt,
+	},
+	"dogecoin-testnet": {
+		params: chaincfg.Params{
+			GenesisHash:      presetHash("bb0a78264637406b6360aad926284d544d7049f45189db5664f3c4d07350559e"),
+			CoinbaseMaturity: 240,
+			PubKeyHashAddrID: 0x71, // n开头
+			ScriptHashAddrID: 0xc4, // 2开头
+			PrivateKeyID:     0xf1,
+			HDPublicKeyID:    [4]byte{0x04, 0x35, 0x87, 0xcf},
+			HDPrivateKeyID:   [4]byte{0x04, 0x35, 0x83, 0x94},
+			HDCoinType:       1,
+		},
+		powAlgorithm: powScrypt,
+	},
+}
+
+func presetHash(s string) *chainhash.Hash {
+	hash, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
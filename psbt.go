@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dogecoinw/doged/btcutil"
+	"github.com/dogecoinw/doged/btcutil/hdkeychain"
+	"github.com/dogecoinw/doged/btcutil/psbt"
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/doged/txscript"
+	"github.com/dogecoinw/doged/wire"
+)
+
+const (
+	// defaultXpubGap 每条链(外部/找零)派生的地址数
+	defaultXpubGap = 20
+	// maxXpubGap 每条链最多派生的地址数
+	maxXpubGap = 1000
+	// defaultDustLimit 低于该值(聪)的找零并入手续费
+	defaultDustLimit = 546
+	// txOverheadVsize 版本号、锁定时间、输入输出计数和见证标记
+	txOverheadVsize = 11
+	// defaultP2shInputVsize P2SH输入的大小取决于赎回脚本, 默认按2-of-3多签估算
+	defaultP2shInputVsize = 297
+)
+
+var errInsufficientFunds = errors.New("insufficient funds")
+
+// inputVsize 按脚本类型估算签名后输入的虚拟大小, P2SH见 estimateInputVsize
+var inputVsize = map[string]int64{
+	txscript.PubKeyHashTy.String():          148,
+	txscript.PubKeyTy.String():              114,
+	txscript.WitnessV0PubKeyHashTy.String(): 68,
+	txscript.WitnessV0ScriptHashTy.String(): 104,
+	txscript.WitnessV1TaprootTy.String():    58,
+}
+
+type PsbtOutput struct {
+	Address string  `json:"address"`
+	Value   float64 `json:"value"`
+}
+
+type PsbtRequest struct {
+	Addresses     []string      `json:"addresses"`
+	Xpub          string        `json:"xpub"`
+	XpubGap       uint32        `json:"xpub_gap"`
+	Outputs       []*PsbtOutput `json:"outputs"`
+	FeeRate       int64         `json:"fee_rate"` // 聪/vbyte
+	ChangeAddress string        `json:"change_address"`
+	DustLimit     int64         `json:"dust_limit"`
+	MinConf       int64         `json:"min_conf"`
+	// P2shInputVsize 每个P2SH输入签名后的虚拟大小, 0时使用defaultP2shInputVsize
+	P2shInputVsize int64 `json:"p2sh_input_vsize"`
+}
+
+type PsbtResult struct {
+	Psbt   string  `json:"psbt"`
+	Inputs []*Vin  `json:"inputs"`
+	Fee    float64 `json:"fee"`
+	Change float64 `json:"change"`
+}
+
+// buildPsbt 从索引中的utxo选币, 构造未签名的PSBT
+func buildPsbt(db *RawDB, params *chaincfg.Params, req *PsbtRequest, filter *UtxoFilter) (*PsbtResult, error) {
+	if len(req.Outputs) == 0 {
+		return nil, errors.New("no outputs")
+	}
+	if req.FeeRate <= 0 {
+		return nil, errors.New("fee_rate must be positive")
+	}
+	if req.DustLimit < 0 {
+		return nil, errors.New("dust_limit must not be negative")
+	}
+	if req.DustLimit == 0 {
+		req.DustLimit = defaultDustLimit
+	}
+	if req.P2shInputVsize < 0 {
+		return nil, errors.New("p2sh_input_vsize must not be negative")
+	}
+	if req.P2shInputVsize == 0 {
+		req.P2shInputVsize = defaultP2shInputVsize
+	}
+
+	sources, err := psbtSources(req, params)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no source addresses")
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	target := int64(0)
+	outVsize := int64(0)
+	for i, out := range req.Outputs {
+		txOut, err := newTxOut(out.Address, out.Value, params)
+		if err != nil {
+			return nil, err
+		}
+		if txOut.Value <= 0 {
+			return nil, fmt.Errorf("output %d: value must be positive", i)
+		}
+		if txOut.Value < req.DustLimit {
+			return nil, fmt.Errorf("output %d: value below dust limit %d", i, req.DustLimit)
+		}
+		tx.AddTxOut(txOut)
+		target += txOut.Value
+		outVsize += int64(txOut.SerializeSize())
+	}
+
+	changeOut, err := newTxOut(req.ChangeAddress, 0, params)
+	if err != nil {
+		return nil, fmt.Errorf("change_address: %w", err)
+	}
+
+	var utxos []*Vin
+	for _, address := range sources {
+		vins, _, err := db.GetAllUtxo(address, math.MaxFloat64, math.MaxInt64, 0, filter)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, vins...)
+	}
+
+	selected, fee, change, err := selectCoins(utxos, target, req.FeeRate, outVsize, int64(changeOut.SerializeSize()), req.DustLimit, req.P2shInputVsize)
+	if err != nil {
+		return nil, err
+	}
+	if change > 0 {
+		changeOut.Value = change
+		tx.AddTxOut(changeOut)
+	}
+
+	for _, vin := range selected {
+		hash, err := chainhash.NewHashFromStr(vin.Txid)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, vin.Vout), nil, nil))
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	prevTxs := make(map[string]*wire.MsgTx)
+	for i, vin := range selected {
+		if err := fillPsbtInput(db, &packet.Inputs[i], vin, prevTxs); err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err := packet.B64Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &PsbtResult{
+		Psbt:   encoded,
+		Inputs: selected,
+		Fee:    btcutil.Amount(fee).ToBTC(),
+		Change: btcutil.Amount(change).ToBTC(),
+	}, nil
+}
+
+// psbtSources 汇总地址列表和xpub派生出的地址
+func psbtSources(req *PsbtRequest, params *chaincfg.Params) ([]string, error) {
+	seen := make(map[string]bool)
+	var sources []string
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			sources = append(sources, address)
+		}
+	}
+	for _, address := range req.Addresses {
+		if address == "" {
+			return nil, errors.New("empty address")
+		}
+		add(address)
+	}
+	if req.Xpub == "" {
+		return sources, nil
+	}
+
+	derived, err := deriveXpub(req.Xpub, req.XpubGap, params)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range derived {
+		add(d.Address)
+	}
+	return sources, nil
+}
+
+// xpubAddress 从xpub派生的地址
+type xpubAddress struct {
+	Address string
+	Path    string
+}
+
+// deriveXpub 派生外部链 m/0/i 和找零链 m/1/i 的前gap个地址, gap为0时使用默认值
+func deriveXpub(xpub string, gap uint32, params *chaincfg.Params) ([]*xpubAddress, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("xpub: %w", err)
+	}
+	if key.IsPrivate() {
+		return nil, errors.New("xpub: private keys are not accepted")
+	}
+	if gap == 0 {
+		gap = defaultXpubGap
+	}
+	if gap > maxXpubGap {
+		return nil, fmt.Errorf("xpub: gap %d exceeds %d", gap, maxXpubGap)
+	}
+
+	var derived []*xpubAddress
+	for branch := uint32(0); branch < 2; branch++ {
+		branchKey, err := key.Derive(branch)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < gap; i++ {
+			child, err := branchKey.Derive(i)
+			if err != nil {
+				return nil, err
+			}
+			addr, err := child.Address(params)
+			if err != nil {
+				return nil, err
+			}
+			derived = append(derived, &xpubAddress{
+				Address: addr.EncodeAddress(),
+				Path:    fmt.Sprintf("m/%d/%d", branch, i),
+			})
+		}
+	}
+	return derived, nil
+}
+
+// estimateInputVsize 返回输入签名后的虚拟大小, 无法估算的脚本类型返回false
+func estimateInputVsize(class string, p2sh int64) (int64, bool) {
+	if class == txscript.ScriptHashTy.String() {
+		return p2sh, p2sh > 0
+	}
+	vsize, ok := inputVsize[class]
+	return vsize, ok
+}
+
+// selectCoins 从大到小选币直到覆盖目标金额和手续费, 金额单位为聪.
+// 找零低于dust时不创建找零输出, 差额计入手续费. p2sh为每个P2SH输入的虚拟大小.
+func selectCoins(utxos []*Vin, target, feeRate, outVsize, changeVsize, dust, p2sh int64) ([]*Vin, int64, int64, error) {
+	candidates := make([]*Vin, 0, len(utxos))
+	for _, vin := range utxos {
+		if _, ok := estimateInputVsize(vin.Class, p2sh); ok && vin.Script != "" {
+			candidates = append(candidates, vin)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Value > candidates[j].Value
+	})
+
+	var selected []*Vin
+	total := int64(0)
+	vsize := txOverheadVsize + outVsize
+	for _, vin := range candidates {
+		amount, err := btcutil.NewAmount(vin.Value)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		selected = append(selected, vin)
+		total += int64(amount)
+		size, _ := estimateInputVsize(vin.Class, p2sh)
+		vsize += size
+
+		fee := vsize * feeRate
+		if total < target+fee {
+			continue
+		}
+
+		feeWithChange := (vsize + changeVsize) * feeRate
+		if change := total - target - feeWithChange; change >= dust {
+			return selected, feeWithChange, change, nil
+		}
+		return selected, total - target, 0, nil
+	}
+	return nil, 0, 0, errInsufficientFunds
+}
+
+// newTxOut 构造支付到地址的输出
+func newTxOut(address string, value float64, params *chaincfg.Params) (*wire.TxOut, error) {
+	addr, err := decodeAddress(address, params)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := btcutil.NewAmount(value)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewTxOut(int64(amount), pkScript), nil
+}
+
+// fillPsbtInput 见证输入填充WitnessUtxo, 其他输入填充完整的前序交易
+func fillPsbtInput(db *RawDB, input *psbt.PInput, vin *Vin, prevTxs map[string]*wire.MsgTx) error {
+	pkScript, err := hex.DecodeString(vin.Script)
+	if err != nil {
+		return err
+	}
+	amount, err := btcutil.NewAmount(vin.Value)
+	if err != nil {
+		return err
+	}
+
+	switch vin.Class {
+	case txscript.WitnessV0PubKeyHashTy.String(), txscript.WitnessV0ScriptHashTy.String(), txscript.WitnessV1TaprootTy.String():
+		input.WitnessUtxo = wire.NewTxOut(int64(amount), pkScript)
+		return nil
+	}
+
+	prevTx, ok := prevTxs[vin.Txid]
+	if !ok {
+		hash, err := chainhash.NewHashFromStr(vin.Txid)
+		if err != nil {
+			return err
+		}
+		tx, err := db.Node.Client().GetRawTransaction(hash)
+		if err != nil {
+			return fmt.Errorf("fetch %s: %w", vin.Txid, err)
+		}
+		prevTx = tx.MsgTx()
+		prevTxs[vin.Txid] = prevTx
+	}
+	input.NonWitnessUtxo = prevTx
+	return nil
+}
+
+// finalizePsbt 补全已签名的PSBT并提取出可广播的交易
+func finalizePsbt(encoded string) (*wire.MsgTx, error) {
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(strings.TrimSpace(encoded)), true)
+	if err != nil {
+		return nil, err
+	}
+	if err := psbt.MaybeFinalizeAll(packet); err != nil {
+		return nil, err
+	}
+	return psbt.Extract(packet)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/dogecoinw/doged/btcutil"
+	"github.com/dogecoinw/doged/btcutil/hdkeychain"
+	"github.com/dogecoinw/doged/btcutil/psbt"
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/wire"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestSelectCoins(t *testing.T) {
+	utxos := []*Vin{
+		{Txid: "a", Value: 0.1, Class: "pubkeyhash", Script: "00"},
+		{Txid: "b", Value: 0.5, Class: "pubkeyhash", Script: "00"},
+		{Txid: "c", Value: 9, Class: "nonstandard", Script: "00"},
+		{Txid: "d", Value: 0.3, Class: "witness_v0_keyhash", Script: "00"},
+	}
+
+	// 0.5 不足以支付 0.5 + 手续费, 需要再选 0.3
+	selected, fee, change, err := selectCoins(utxos, 50000000, 10, 34, 34, 546, defaultP2shInputVsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 2 || selected[0].Txid != "b" || selected[1].Txid != "d" {
+		t.Fatalf("unexpected selection %v", selected)
+	}
+	wantFee := int64(11+34+148+68+34) * 10
+	if fee != wantFee || change != 30000000-wantFee {
+		t.Errorf("fee %d change %d", fee, change)
+	}
+
+	// 找零低于dust时并入手续费
+	selected, fee, change, err = selectCoins(utxos, 49997970, 10, 34, 34, 546, defaultP2shInputVsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || change != 0 || fee != 2030 {
+		t.Errorf("selected %d fee %d change %d", len(selected), fee, change)
+	}
+
+	if _, _, _, err := selectCoins(utxos, 100000000, 10, 34, 34, 546, defaultP2shInputVsize); err != errInsufficientFunds {
+		t.Errorf("expected insufficient funds, got %v", err)
+	}
+
+	// P2SH输入按传入的大小计算
+	p2sh := []*Vin{{Txid: "e", Value: 1, Class: "scripthash", Script: "00"}}
+	if _, fee, _, err := selectCoins(p2sh, 1000000, 10, 34, 34, 546, 297); err != nil || fee != int64(11+34+297+34)*10 {
+		t.Errorf("p2sh fee %d (%v)", fee, err)
+	}
+}
+
+func TestBuildPsbt(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	params := &chaincfg.MainNetParams
+	src, err := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{1}, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := btcutil.NewAddressPubKeyHash(bytes.Repeat([]byte{2}, 20), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witness := "0014" + strings.Repeat("01", 20)
+	txid := strings.Repeat("ab", 32)
+	db.SetUtxo(src.EncodeAddress(), txid, 0, &Vin{Txid: txid, Vout: 0, Address: src.EncodeAddress(), Value: 1, Script: witness, Class: "witness_v0_keyhash", Height: 1})
+	// 以该地址开头的其他地址的utxo不能被选中
+	other := strings.Repeat("cd", 32)
+	db.SetUtxo(src.EncodeAddress()+"x", other, 0, &Vin{Txid: other, Vout: 0, Address: src.EncodeAddress() + "x", Value: 100, Script: witness, Class: "witness_v0_keyhash", Height: 1})
+
+	req := func() *PsbtRequest {
+		return &PsbtRequest{
+			Addresses:     []string{src.EncodeAddress()},
+			Outputs:       []*PsbtOutput{{Address: dest.EncodeAddress(), Value: 0.5}},
+			FeeRate:       10,
+			ChangeAddress: src.EncodeAddress(),
+		}
+	}
+	result, err := buildPsbt(db, params, req(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Inputs) != 1 || result.Inputs[0].Txid != txid {
+		t.Fatalf("inputs %+v", result.Inputs)
+	}
+	wantFee := int64(11+34+68+34) * 10
+	if result.Fee != btcutil.Amount(wantFee).ToBTC() || result.Change != btcutil.Amount(50000000-wantFee).ToBTC() {
+		t.Errorf("fee %v change %v", result.Fee, result.Change)
+	}
+	packet, err := psbt.NewFromRawBytes(strings.NewReader(result.Psbt), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.UnsignedTx.TxOut) != 2 || packet.Inputs[0].WitnessUtxo == nil || packet.Inputs[0].WitnessUtxo.Value != 100000000 {
+		t.Errorf("packet %+v", packet.UnsignedTx)
+	}
+
+	for name, modify := range map[string]func(*PsbtRequest){
+		"zero output":  func(r *PsbtRequest) { r.Outputs[0].Value = 0 },
+		"negative":     func(r *PsbtRequest) { r.Outputs[0].Value = -1 },
+		"dust output":  func(r *PsbtRequest) { r.Outputs[0].Value = 0.000001 },
+		"empty source": func(r *PsbtRequest) { r.Addresses = []string{""} },
+		"dust limit":   func(r *PsbtRequest) { r.DustLimit = -1 },
+	} {
+		r := req()
+		modify(r)
+		if _, err := buildPsbt(db, params, r, nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{3}, 32), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, err := master.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := req()
+	r.Xpub, r.XpubGap = xpub.String(), 4000000000
+	if _, err := buildPsbt(db, params, r, nil); err == nil {
+		t.Error("expected gap error")
+	}
+}
+
+func TestFillPsbtInput(t *testing.T) {
+	txid := strings.Repeat("ab", 32)
+	script := "76a914" + strings.Repeat("01", 20) + "88ac"
+	prev := wire.NewMsgTx(wire.TxVersion)
+	pkScript, _ := hex.DecodeString(script)
+	prev.AddTxOut(wire.NewTxOut(150000000, pkScript))
+
+	// 非见证输入使用完整的前序交易, 已缓存时不访问节点
+	input := &psbt.PInput{}
+	vin := &Vin{Txid: txid, Vout: 0, Value: 1.5, Script: script, Class: "pubkeyhash"}
+	if err := fillPsbtInput(nil, input, vin, map[string]*wire.MsgTx{txid: prev}); err != nil {
+		t.Fatal(err)
+	}
+	if input.NonWitnessUtxo != prev || input.WitnessUtxo != nil {
+		t.Errorf("non-witness input %+v", input)
+	}
+
+	witness := "0014" + strings.Repeat("01", 20)
+	input = &psbt.PInput{}
+	vin = &Vin{Txid: txid, Vout: 1, Value: 0.25, Script: witness, Class: "witness_v0_keyhash"}
+	if err := fillPsbtInput(nil, input, vin, nil); err != nil {
+		t.Fatal(err)
+	}
+	if input.WitnessUtxo == nil || input.WitnessUtxo.Value != 25000000 || hex.EncodeToString(input.WitnessUtxo.PkScript) != witness {
+		t.Errorf("witness input %+v", input.WitnessUtxo)
+	}
+	if input.NonWitnessUtxo != nil {
+		t.Error("witness input has the previous transaction")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// rollbackTo 从已索引的最高区块逐个撤销到target(保留target), 每个区块在一个批次中写入.
+// 撤销依赖区块记录中的txid和交易记录中的输入输出, 缺少这些记录的区块无法撤销.
+func rollbackTo(db *RawDB, target int64) error {
+	height, err := db.GetHeight()
+	if err != nil {
+		return fmt.Errorf("no indexed height: %w", err)
+	}
+	if target >= height {
+		return fmt.Errorf("target %d is not below indexed height %d", target, height)
+	}
+
+	for h := height; h > target; h-- {
+		if err := rollbackBlock(db, h); err != nil {
+			return fmt.Errorf("rollback block %d: %w", h, err)
+		}
+	}
+	return nil
+}
+
+// forkPoint 从已索引的最高区块向下找到哈希与节点一致的区块(共同祖先).
+// 第一个索引的区块也不一致时无法撤销, 返回 errChainMismatch.
+func forkPoint(db *RawDB, nodeHash func(height int64) (string, error)) (int64, error) {
+	height, err := db.GetHeight()
+	if err != nil {
+		return 0, fmt.Errorf("no indexed height: %w", err)
+	}
+	anchor, _ := db.GetAnchor()
+
+	for h := height; h >= 0 && height-h <= maxReorgDepth; h-- {
+		if anchor != nil && h < anchor.Height {
+			break
+		}
+		block, err := db.GetBlock(h)
+		if err == leveldb.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		hash, err := nodeHash(h)
+		if err != nil {
+			return 0, err
+		}
+		if hash == block.Hash {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no indexed block within %d blocks of %d matches the node", errChainMismatch, maxReorgDepth, height)
+}
+
+// rollbackFork 撤销共同祖先之后已不在节点主链上的区块, 返回共同祖先的高度
+func rollbackFork(db *RawDB, nodeHash func(height int64) (string, error)) (int64, error) {
+	ancestor, err := forkPoint(db, nodeHash)
+	if err != nil {
+		return 0, err
+	}
+	if height, err := db.GetHeight(); err != nil || height == ancestor {
+		return ancestor, err
+	}
+	return ancestor, rollbackTo(db, ancestor)
+}
+
+// rollbackBlock 撤销单个区块: 删除新建的输出和索引, 恢复被花费的utxo, 回退余额和高度
+func rollbackBlock(db *RawDB, height int64) error {
+	block, err := db.GetBlock(height)
+	if err != nil {
+		return fmt.Errorf("block record: %w", err)
+	}
+
+	set, err := db.GetUtxoSet()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	events, err := newEventWriter(db, batch)
+	if err != nil {
+		return err
+	}
+	balances := make(map[string]float64)
+	// 同一区块内创建又被花费的输出, 恢复后还要随创建它的交易一起删除
+	restored := make(map[string]bool)
+	stats := make(map[string]*statsDelta)
+	stat := func(address string) *statsDelta {
+		if stats[address] == nil {
+			stats[address] = newStatsDelta()
+		}
+		return stats[address]
+	}
+	for i := len(block.Txids) - 1; i >= 0; i-- {
+		txid := block.Txids[i]
+		tx, err := db.GetTx(txid)
+		if err == leveldb.ErrNotFound {
+			// 扫描时取不到的交易没有写入任何记录
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("tx %s: %w", txid, err)
+		}
+
+		for _, vout := range tx.Vouts {
+			key := utxoKey(vout.Owner(), txid, vout.Index)
+			ok, err := db.has(key)
+			if err != nil {
+				return err
+			}
+			if ok || restored[string(key)] {
+				batch.Delete(key)
+				balances[vout.Owner()] -= vout.Value
+				delta := stat(vout.Owner())
+				delta.seen(txid, height)
+				delta.received += vout.Value
+				delta.utxos++
+				if err := set.Spend(vout.AsVin(txid)); err != nil {
+					return err
+				}
+			}
+			if err := rollbackDeposit(db, batch, events, txid, vout.Index); err != nil {
+				return err
+			}
+			batch.Delete(voutKey(txid, vout.Index))
+			batch.Delete(scriptKey(vout.ScriptHash, txid, vout.Index))
+			if script, err := hex.DecodeString(vout.Script); err == nil {
+				if data, ok := nullData(script); ok {
+					batch.Delete(nullDataKey(hex.EncodeToString(data), txid, vout.Index))
+				}
+			}
+			for _, owner := range vout.Owners() {
+				batch.Delete(addressTxKey(owner, txid, height, block.Time))
+			}
+		}
+
+		for _, vin := range tx.Vins {
+			data, err := rlp.EncodeToBytes(vin)
+			if err != nil {
+				return err
+			}
+			key := utxoKey(vin.Owner(), vin.Txid, vin.Vout)
+			batch.Put(key, data)
+			batch.Delete(spendKey(vin.Txid, vin.Vout))
+			restored[string(key)] = true
+			balances[vin.Owner()] += vin.Value
+			delta := stat(vin.Owner())
+			delta.seen(txid, height)
+			delta.sent += vin.Value
+			delta.utxos--
+			if err := set.Add(vin); err != nil {
+				return err
+			}
+
+			owners := []string{vin.Owner()}
+			if vout, err := db.GetVout(vin.Txid, vin.Vout); err == nil {
+				owners = vout.Owners()
+			}
+			for _, owner := range owners {
+				batch.Delete(addressTxKey(owner, txid, height, block.Time))
+			}
+		}
+		batch.Delete(txKey(txid))
+	}
+
+	for address, delta := range balances {
+		balance, _ := db.GetBalance(address)
+		batch.Put(balanceKey(address), []byte(strconv.FormatFloat(balance+delta, 'f', 8, 64)))
+		putRichList(batch, address, balance, balance+delta)
+		batch.Delete(balanceChangeKey(address, height))
+	}
+
+	if err := rollbackAddressStats(db, batch, height, stats); err != nil {
+		return err
+	}
+	set.Height = height - 1
+	if err := db.writeUtxoSet(batch, set); err != nil {
+		return err
+	}
+
+	batch.Delete(blockKey(height))
+	batch.Delete(blockHashKey(block.Hash))
+	batch.Delete(feeKey(height))
+	if anchor, err := db.GetAnchor(); err == nil && anchor.Height >= height {
+		batch.Delete([]byte("anchor"))
+	}
+	if height > 0 {
+		batch.Put([]byte("height"), []byte(strconv.FormatInt(height-1, 10)))
+	} else {
+		batch.Delete([]byte("height"))
+	}
+	return db.write(batch)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// applyTestBlock 按扫描的方式写入一个区块的记录
+func applyTestBlock(t *testing.T, db *RawDB, height int64, txs []*Tx) {
+	block := &Block{Height: height, Hash: string(rune('a' + height)), Time: 1000 + height}
+	balances := make(map[string]float64)
+	stats := make(map[string]*statsDelta)
+	set, err := db.GetUtxoSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := func(address string) *statsDelta {
+		if stats[address] == nil {
+			stats[address] = newStatsDelta()
+		}
+		return stats[address]
+	}
+	for _, tx := range txs {
+		for _, vout := range tx.Vouts {
+			vout.Height = height
+			db.SetVout(tx.Txid, vout.Index, vout)
+			db.SetScriptOutput(tx.Txid, vout)
+			db.SetUtxo(vout.Owner(), tx.Txid, vout.Index, vout.AsVin(tx.Txid))
+			db.SetAddressTx(vout.Owner(), tx.Txid, height, block.Time)
+			balances[vout.Owner()] += vout.Value
+			stat(vout.Owner()).seen(tx.Txid, height)
+			stat(vout.Owner()).received += vout.Value
+			stat(vout.Owner()).utxos++
+			set.Add(vout.AsVin(tx.Txid))
+		}
+		for i, vin := range tx.Vins {
+			db.DelUtxo(vin.Owner(), vin.Txid, vin.Vout)
+			db.SetSpend(vin.Txid, vin.Vout, newSpend(tx.Txid, i, height))
+			db.SetAddressTx(vin.Owner(), tx.Txid, height, block.Time)
+			balances[vin.Owner()] -= vin.Value
+			stat(vin.Owner()).seen(tx.Txid, height)
+			stat(vin.Owner()).sent += vin.Value
+			stat(vin.Owner()).utxos--
+			set.Spend(vin)
+		}
+		db.SetTx(tx)
+		block.Txids = append(block.Txids, tx.Txid)
+	}
+	for address, delta := range balances {
+		balance, _ := db.GetBalance(address)
+		db.SetBalance(address, balance+delta)
+		db.AddBalanceChange(address, height, block.Time, delta, balance+delta)
+	}
+	for address, delta := range stats {
+		db.ApplyAddressStats(address, delta)
+	}
+	set.Height = height
+	if err := db.SetUtxoSet(set); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetBlock(height, block); err != nil {
+		t.Fatal(err)
+	}
+	db.SetHeight(height)
+}
+
+func TestRollback(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	coinbase := &Vout{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}
+	applyTestBlock(t, db, 1, []*Tx{{Txid: "A", Vouts: []*Vout{coinbase}}})
+	before, err := db.GetUtxoSetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// B花费A:0, C在同一区块内花费B:1
+	payY := &Vout{Index: 0, Address: "Y", Value: 30, ScriptHash: "sy"}
+	change := &Vout{Index: 1, Address: "X", Value: 19, ScriptHash: "sx", Height: 2}
+	payZ := &Vout{Index: 0, Address: "Z", Value: 19, ScriptHash: "sz"}
+	applyTestBlock(t, db, 2, []*Tx{
+		{Txid: "B", Vins: []*Vin{coinbase.AsVin("A")}, Vouts: []*Vout{payY, change}},
+		{Txid: "C", Vins: []*Vin{change.AsVin("B")}, Vouts: []*Vout{payZ}},
+	})
+	if err := verifyBalances(db); err != nil {
+		t.Fatal(err)
+	}
+	richList := func() []string {
+		entries, err := db.GetRichList(10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, entry := range entries {
+			list = append(list, fmt.Sprintf("%s:%v", entry.Address, entry.Balance))
+		}
+		return list
+	}
+	if list := richList(); strings.Join(list, ",") != "Y:30,Z:19" {
+		t.Errorf("rich list %v", list)
+	}
+	// 从utxo记录重新计算的结果与逐块更新的相同
+	incremental, _ := db.GetUtxoSetInfo()
+	if err := migrateUtxoSet(db); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt, _ := db.GetUtxoSetInfo(); rebuilt.MuHash != incremental.MuHash || rebuilt.Count != 2 || rebuilt.Supply != 49 {
+		t.Errorf("rebuilt utxo set %+v, incremental %+v", rebuilt, incremental)
+	}
+	if stats, _ := db.GetAddressStats("X"); stats.TxCount != 3 || stats.Received != 69 || stats.Sent != 69 || stats.UtxoCount != 0 || stats.LastSeen != 2 {
+		t.Errorf("stats of X %+v", stats)
+	}
+
+	if err := rollbackTo(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBalances(db); err != nil {
+		t.Error(err)
+	}
+	if height, _ := db.GetHeight(); height != 1 {
+		t.Errorf("height %d, want 1", height)
+	}
+	if ok, _ := db.DB.Has(utxoKey("X", "A", 0), nil); !ok {
+		t.Error("spent output not restored")
+	}
+	for _, key := range [][]byte{utxoKey("X", "B", 1), utxoKey("Y", "B", 0), utxoKey("Z", "C", 0), txKey("B"), voutKey("C", 0), blockKey(2), balanceChangeKey("Y", 2), spendKey("A", 0), spendKey("B", 1)} {
+		if ok, _ := db.DB.Has(key, nil); ok {
+			t.Errorf("%s not removed", key)
+		}
+	}
+	if balance, _ := db.GetBalance("X"); balance != 50 {
+		t.Errorf("balance of X %v, want 50", balance)
+	}
+	if txs, _, _ := db.GetAddressTxs("Y", 10, 0); len(txs) != 0 {
+		t.Errorf("address history of Y not removed: %d", len(txs))
+	}
+	if list := richList(); strings.Join(list, ",") != "X:50" {
+		t.Errorf("rich list after rollback %v", list)
+	}
+	if stats, _ := db.GetAddressStats("X"); stats.TxCount != 1 || stats.Received != 50 || stats.Sent != 0 || stats.UtxoCount != 1 || stats.FirstSeen != 1 || stats.LastSeen != 1 {
+		t.Errorf("stats of X after rollback %+v", stats)
+	}
+	if ok, _ := db.DB.Has(addressStatsKey("Y"), nil); ok {
+		t.Error("stats of Y not removed")
+	}
+	if after, _ := db.GetUtxoSetInfo(); after.MuHash != before.MuHash || after.Count != 1 || after.Height != 1 || after.ByAgeBlocks[0].Count != 1 {
+		t.Errorf("utxo set after rollback %+v, want %+v", after, before)
+	}
+}
+
+func TestRollbackFork(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	for h := int64(1); h <= 4; h++ {
+		applyTestBlock(t, db, h, []*Tx{{Txid: fmt.Sprint("cb", h), Vouts: []*Vout{{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}}}})
+	}
+	db.SetAnchor(&Checkpoint{Height: 1, Hash: "b"})
+
+	// 节点在高度3之后是另一条分支
+	branch := map[int64]string{1: "b", 2: "c", 3: "x", 4: "y"}
+	nodeHash := func(h int64) (string, error) { return branch[h], nil }
+	ancestor, err := rollbackFork(db, nodeHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := db.GetHeight(); ancestor != 2 || height != 2 {
+		t.Errorf("ancestor %d, height %d, want 2", ancestor, height)
+	}
+	if balance, _ := db.GetBalance("X"); balance != 100 {
+		t.Errorf("balance of X %v, want 100", balance)
+	}
+
+	// 第一个索引的区块也不一致时不撤销
+	branch[1], branch[2] = "z", "w"
+	if _, err := rollbackFork(db, nodeHash); !errors.Is(err, errChainMismatch) {
+		t.Errorf("expected chain mismatch, got %v", err)
+	}
+	if height, _ := db.GetHeight(); height != 2 {
+		t.Errorf("height %d after mismatch, want 2", height)
+	}
+}
@@ -3,23 +3,130 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/dogecoinw/doged/chaincfg"
 	"github.com/dogecoinw/doged/chaincfg/chainhash"
 	"github.com/dogecoinw/doged/wire"
+	"github.com/dogecoinw/go-dogecoin/log"
 	"github.com/gin-gonic/gin"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type Router struct {
-	rawdb *RawDB
+	rawdb    *RawDB
+	params   *chaincfg.Params
+	fees     *FeeEstimator
+	cache    *ResponseCache
+	deposits *DepositLedger
+
+	// walletMu 串行化钱包的读-改-写
+	walletMu sync.Mutex
 }
 
-func NewRouter(rawdb *RawDB) *Router {
+func NewRouter(chain *ChainContext, fees *FeeEstimator) *Router {
 	return &Router{
-		rawdb: rawdb,
+		rawdb:    chain.DB,
+		params:   chain.Params,
+		fees:     fees,
+		cache:    chain.Cache,
+		deposits: chain.Deposits,
+	}
+}
+
+const (
+	snapshotKey   = "snapshot"
+	generationKey = "cache-generation"
+)
+
+// snapshot 让一个请求的所有读取都来自同一个区块提交后的快照
+func (r *Router) snapshot(c *gin.Context) {
+	// 先读取缓存的代数再取快照, 取快照前后有新的提交时响应不会进入缓存
+	c.Set(generationKey, r.cache.Generation())
+	view, release, err := r.rawdb.View()
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+	c.Set(snapshotKey, view)
+	c.Next()
+}
+
+// view 返回请求使用的快照, 没有经过snapshot中间件时直接读取数据库
+func (r *Router) view(c *gin.Context) *RawDB {
+	if v, ok := c.Get(snapshotKey); ok {
+		return v.(*RawDB)
+	}
+	return r.rawdb
+}
+
+// cached 按 接口+参数 读取缓存, 没有时调用load并保存成功的响应
+func (r *Router) cached(c *gin.Context, address, key string, load func() gin.H) {
+	key = c.FullPath() + "|" + address + "|" + key
+	if body, ok := r.cache.Get(key); ok {
+		c.JSON(200, body)
+		return
+	}
+
+	body := load()
+	if _, failed := body["error"]; !failed {
+		if generation, ok := c.Get(generationKey); ok {
+			r.cache.Put(address, key, generation.(uint64), body)
+		}
 	}
+	c.JSON(200, body)
+}
+
+// Register 注册该链的所有接口, 广播接口需要broadcast权限, 修改钱包和确认充值事件需要admin权限, 其他接口需要read权限
+func (r *Router) Register(g *gin.RouterGroup, auth *Auth) {
+	read := g.Group("", auth.Require(scopeRead), r.snapshot)
+	send := g.Group("", auth.Require(scopeBroadcast), r.snapshot)
+	admin := g.Group("", auth.Require(scopeAdmin))
+
+	read.POST("/utxo", r.GetUtxo)                             // 获取指定地址的UTXO列表，支持按金额和数量筛选
+	read.POST("/getBalance", r.GetBalance)                    // 获取指定地址的余额
+	read.POST("/getTxByAddress", r.GetTxByAddress)            // 根据地址获取交易历史记录，支持分页
+	read.POST("/getTx", r.GetTx)                              // 根据交易哈希获取交易详细信息
+	send.POST("/broadcast", r.Broadcast)                      // 广播已签名的交易到区块链网络
+	read.GET("/currentBlock", r.GetCurrentBlock)              // 获取当前遍历到的区块高度
+	read.POST("/getOutputsByScript", r.GetOutputsByScript)    // 根据脚本哈希获取输出, 包括多签和非标准脚本
+	read.POST("/getNullData", r.GetNullData)                  // 根据十六进制前缀查询OP_RETURN数据
+	read.POST("/createPsbt", r.CreatePsbt)                    // 根据地址或xpub选币, 构造未签名的PSBT
+	send.POST("/broadcastPsbt", r.BroadcastPsbt)              // 补全已签名的PSBT并广播
+	read.GET("/fees", r.GetFees)                              // 按确认目标估算手续费率(聪/vB), 并与节点estimatesmartfee对比
+	read.POST("/getBlock", r.GetBlock)                        // 根据高度(height)或哈希(hash)获取区块头
+	read.POST("/getBlockTxs", r.GetBlockTxs)                  // 分页获取区块内的交易
+	read.GET("/tipBlock", r.GetTipBlock)                      // 获取已索引的最新区块头
+	read.POST("/getRecentBlocks", r.GetRecentBlocks)          // 获取最近的区块列表
+	read.POST("/getBalanceAt", r.GetBalanceAt)                // 获取地址在指定高度(height)或时间(time)的余额
+	read.POST("/getBalanceChanges", r.GetBalanceChanges)      // 分页获取地址每个区块的余额变化
+	read.POST("/getBalanceSeries", r.GetBalanceSeries)        // 按小时或天获取地址在时间范围内的余额序列
+	read.POST("/getRichList", r.GetRichList)                  // 按余额从大到小分页获取地址
+	read.POST("/getAddressStats", r.GetAddressStats)          // 获取地址的首末出现高度、交易数、收发总额和utxo数量
+	read.GET("/utxoSetInfo", r.GetUtxoSetInfo)                // 获取utxo集合的数量、总额、按金额和年龄的分布以及MuHash
+	read.GET("/verifyUtxoSet", r.VerifyUtxoSet)               // 与节点gettxoutsetinfo的数量、总额和MuHash比较
+	read.POST("/getWallets", r.GetWallets)                    // 获取所有钱包的名称
+	read.POST("/getWallet", r.GetWallet)                      // 获取钱包的条目和展开后的地址
+	read.POST("/getWalletBalance", r.GetWalletBalance)        // 获取钱包的总余额和各地址余额
+	read.POST("/getWalletUtxo", r.GetWalletUtxo)              // 获取钱包所有地址的utxo
+	read.POST("/getWalletTxs", r.GetWalletTxs)                // 分页获取钱包所有地址合并后的交易历史
+	admin.POST("/addWalletAddress", r.AddWalletAddress)       // 向钱包加入地址或xpub, 钱包不存在时创建
+	admin.POST("/removeWalletAddress", r.RemoveWalletAddress) // 从钱包移除地址或xpub
+	admin.POST("/deleteWallet", r.DeleteWallet)               // 删除钱包
+	read.POST("/getDeposits", r.GetDeposits)                  // 按钱包、地址和状态分页获取充值
+	read.POST("/getDepositEvents", r.GetDepositEvents)        // 获取序号after之后的充值状态变化
+	admin.POST("/ackDepositEvents", r.AckDepositEvents)       // 确认已处理的充值事件, 可以重复调用
+	read.GET("/exportHistory", r.ExportHistory)               // 按CSV或JSONL流式导出地址或钱包的交易流水
+	read.POST("/traceTx", r.TraceTx)                          // 从交易或输出沿花费方向和/或资金来源方向追踪, 返回交易图
+	read.GET("/outpoint/:txid/:vout", r.GetOutpoint)          // 查询输出是否已花费, 以及花费它的交易、输入序号和高度
 }
 
 func (r *Router) GetUtxo(c *gin.Context) {
@@ -59,7 +166,7 @@ func (r *Router) GetUtxo(c *gin.Context) {
 		return
 	}
 
-	allUtxo, amountA, err := r.rawdb.GetAllUtxo(address, amountF, countF, smallChangeF)
+	filter, err := r.utxoFilter(c)
 	if err != nil {
 		c.JSON(200, gin.H{
 			"error": err.Error(),
@@ -67,25 +174,35 @@ func (r *Router) GetUtxo(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{
-		"utxo":   allUtxo,
-		"amount": amountA,
+	// 确认数和成熟度依赖最新高度, 高度写进key
+	key := fmt.Sprintf("%s|%d|%d|%d|%d|%t|%d", amount, countF, smallChangeF, filter.MinConf, filter.MaxConf, filter.Immature, filter.Tip)
+	r.cached(c, address, key, func() gin.H {
+		allUtxo, amountA, err := r.view(c).GetAllUtxo(address, amountF, countF, smallChangeF, filter)
+		if err != nil {
+			return gin.H{
+				"error": err.Error(),
+			}
+		}
+		return gin.H{
+			"utxo":   allUtxo,
+			"amount": amountA,
+		}
 	})
 }
 
 func (r *Router) GetBalance(c *gin.Context) {
 	address := c.PostForm("address")
 
-	balance, err := r.rawdb.GetBalance(address)
-	if err != nil {
-		c.JSON(200, gin.H{
-			"error": err.Error(),
-		})
-		return
-	}
-
-	c.JSON(200, gin.H{
-		"balance": balance,
+	r.cached(c, address, "", func() gin.H {
+		balance, err := r.view(c).GetBalance(address)
+		if err != nil {
+			return gin.H{
+				"error": err.Error(),
+			}
+		}
+		return gin.H{
+			"balance": balance,
+		}
 	})
 }
 
@@ -115,27 +232,26 @@ func (r *Router) GetTxByAddress(c *gin.Context) {
 		limitF = 50
 	}
 
-	tx, state, err := r.rawdb.GetAddressTxs(address, limitF, offsetF)
-	if err != nil {
-		c.JSON(200, gin.H{
-			"error": err.Error(),
+	r.cached(c, address, fmt.Sprintf("%d|%d", limitF, offsetF), func() gin.H {
+		tx, state, err := r.view(c).GetAddressTxs(address, limitF, offsetF)
+		if err != nil {
+			return gin.H{
+				"error": err.Error(),
+				"state": state,
+			}
+		}
+		return gin.H{
+			"tx":    tx,
 			"state": state,
-		})
-		return
-	}
-
-	c.JSON(200, gin.H{
-		"tx":    tx,
-		"state": state,
+		}
 	})
-
 }
 
 func (r *Router) GetTx(c *gin.Context) {
 
 	txhash := c.PostForm("txhash")
 	hash, _ := chainhash.NewHashFromStr(txhash)
-	transactionVerbose, err := r.rawdb.Node.GetRawTransactionVerboseBool(hash)
+	transactionVerbose, err := r.rawdb.Node.Client().GetRawTransactionVerboseBool(hash)
 	if err != nil {
 		c.JSON(200, gin.H{
 			"error": err.Error(),
@@ -143,8 +259,34 @@ func (r *Router) GetTx(c *gin.Context) {
 		return
 	}
 
+	// 每个输出是否已被花费, 以及花费它的交易. 未索引的输出不知道是否已花费, spent为null
+	db := r.view(c)
+	outputs := make([]gin.H, 0, len(transactionVerbose.Vout))
+	for _, vout := range transactionVerbose.Vout {
+		output := gin.H{"vout": vout.N, "spent": nil}
+		voutDB, err := db.GetVout(txhash, vout.N)
+		if err != nil {
+			outputs = append(outputs, output)
+			continue
+		}
+		output["spent"] = false
+		if spend, err := db.lookupSpend(txhash, voutDB); err == nil {
+			output["spent"] = true
+			// 升级前花费的输出不知道花费交易
+			if spend.Txid != "" {
+				output["spent_by"] = spend.Txid
+				output["spent_height"] = spend.Height
+			}
+			if spend.Vin != nil {
+				output["spent_vin"] = *spend.Vin
+			}
+		}
+		outputs = append(outputs, output)
+	}
+
 	c.JSON(200, gin.H{
-		"tx": transactionVerbose,
+		"tx":      transactionVerbose,
+		"outputs": outputs,
 	})
 
 }
@@ -179,7 +321,7 @@ func (r *Router) Broadcast(c *gin.Context) {
 		return
 	}
 
-	txhash, err := r.rawdb.Node.SendRawTransaction(msgTx, true)
+	txhash, err := r.rawdb.Node.SendRawTransaction(msgTx)
 	if err != nil {
 		c.JSON(200, gin.H{
 			"error": err.Error(),
@@ -205,7 +347,7 @@ func (r *Router) Broadcast(c *gin.Context) {
 }
 
 func (r *Router) GetCurrentBlock(c *gin.Context) {
-	height, err := r.rawdb.GetHeight()
+	height, err := r.view(c).GetHeight()
 	if err != nil {
 		c.JSON(200, gin.H{
 			"error": err.Error(),
@@ -219,4 +361,890 @@ func (r *Router) GetCurrentBlock(c *gin.Context) {
 	})
 }
 
+func (r *Router) GetOutputsByScript(c *gin.Context) {
+	scriptHash := c.PostForm("script_hash")
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	outputs, err := r.view(c).GetScriptOutputs(scriptHash, limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"outputs": outputs,
+	})
+}
+
+func (r *Router) GetNullData(c *gin.Context) {
+	prefix := c.PostForm("prefix")
+	if strings.Trim(prefix, "0123456789abcdefABCDEF") != "" {
+		c.JSON(200, gin.H{
+			"error": "prefix must be hex",
+		})
+		return
+	}
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	items, err := r.view(c).GetNullData(prefix, limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"data": items,
+	})
+}
+
+func (r *Router) CreatePsbt(c *gin.Context) {
+	req := &PsbtRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// 选币和确认数使用同一个快照
+	db := r.view(c)
+	tip, err := db.GetHeight()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter := &UtxoFilter{
+		Tip:      tip,
+		MinConf:  req.MinConf,
+		Maturity: int64(r.params.CoinbaseMaturity),
+	}
+
+	result, err := buildPsbt(db, r.params, req, filter)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func (r *Router) BroadcastPsbt(c *gin.Context) {
+	type params struct {
+		Psbt string `json:"psbt"`
+	}
+
+	p := &params{}
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	msgTx, err := finalizePsbt(p.Psbt)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	txhash, err := r.rawdb.Node.SendRawTransaction(msgTx)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"tx_hash": txhash.String(),
+	})
+}
+
+func (r *Router) GetFees(c *gin.Context) {
+	height, err := r.view(c).GetHeight()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"height":    height,
+		"estimates": r.fees.Estimate(),
+		"mempool":   r.fees.Mempool(),
+		"blocks":    r.fees.Blocks(10),
+	})
+}
+
+func (r *Router) GetBlock(c *gin.Context) {
+	block, err := r.block(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"block": block,
+	})
+}
+
+func (r *Router) GetBlockTxs(c *gin.Context) {
+	block, err := r.block(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	txs := make([]*Tx, 0)
+	for i := offset; i < int64(len(block.Txids)) && i < offset+limit; i++ {
+		tx, err := r.view(c).GetTx(block.Txids[i])
+		if err != nil {
+			c.JSON(200, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		tx.Height = block.Height
+		tx.Time = block.Time
+		txs = append(txs, tx)
+	}
+
+	c.JSON(200, gin.H{
+		"tx":    txs,
+		"total": len(block.Txids),
+	})
+}
+
+func (r *Router) GetTipBlock(c *gin.Context) {
+	height, err := r.view(c).GetHeight()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	block, err := r.view(c).GetBlock(height)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"block": block,
+	})
+}
+
+func (r *Router) GetRecentBlocks(c *gin.Context) {
+	count, err := strconv.ParseInt(c.DefaultPostForm("count", "10"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if count <= 0 || count > 50 {
+		count = 50
+	}
+
+	blocks, err := r.view(c).GetRecentBlocks(count)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"blocks": blocks,
+	})
+}
+
+func (r *Router) GetBalanceAt(c *gin.Context) {
+	address := c.PostForm("address")
+	db := r.view(c)
+
+	if t := c.PostForm("time"); t != "" {
+		timestamp, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			c.JSON(200, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		balance, height, err := db.balanceAtTime(address, timestamp)
+		if err != nil {
+			c.JSON(200, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(200, gin.H{
+			"balance": balance,
+			"height":  height,
+		})
+		return
+	}
+
+	height, err := strconv.ParseInt(c.PostForm("height"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if tip, err := db.GetHeight(); err != nil || height > tip {
+		c.JSON(200, gin.H{
+			"error": fmt.Sprintf("height %d is not indexed yet", height),
+		})
+		return
+	}
+	balance, err := db.GetBalanceAt(address, height)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"balance": balance,
+		"height":  height,
+	})
+}
+
+func (r *Router) GetBalanceChanges(c *gin.Context) {
+	address := c.PostForm("address")
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
+	changes, err := r.view(c).GetBalanceChanges(address, limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"changes": changes,
+	})
+}
+
+func (r *Router) GetBalanceSeries(c *gin.Context) {
+	address := c.PostForm("address")
+	from, err := strconv.ParseInt(c.PostForm("from"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	to, err := strconv.ParseInt(c.DefaultPostForm("to", strconv.FormatInt(time.Now().Unix(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	series, err := r.view(c).GetBalanceSeries(address, from, to, c.DefaultPostForm("interval", "day"))
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"series": series,
+	})
+}
+
+func (r *Router) GetRichList(c *gin.Context) {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	entries, err := r.view(c).GetRichList(limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"list": entries,
+	})
+}
+
+func (r *Router) GetAddressStats(c *gin.Context) {
+	address := c.PostForm("address")
+
+	r.cached(c, address, "", func() gin.H {
+		db := r.view(c)
+		stats, err := db.GetAddressStats(address)
+		if err != nil {
+			return gin.H{
+				"error": err.Error(),
+			}
+		}
+		stats.Address = address
+		stats.Balance, _ = db.GetBalance(address)
+		return gin.H{
+			"stats": stats,
+		}
+	})
+}
+
+func (r *Router) GetUtxoSetInfo(c *gin.Context) {
+	info, err := r.view(c).GetUtxoSetInfo()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"utxo_set": info,
+	})
+}
+
+func (r *Router) VerifyUtxoSet(c *gin.Context) {
+	info, err := r.view(c).GetUtxoSetInfo()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	node, err := getNodeUtxoSetInfo(r.rawdb.Node.Client(), info.Height)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	mismatches := compareUtxoSet(info, node)
+	c.JSON(200, gin.H{
+		"match":      len(mismatches) == 0,
+		"mismatches": mismatches,
+		"index": gin.H{
+			"height": info.Height,
+			"count":  info.Count,
+			"supply": info.Supply,
+			"muhash": info.MuHash,
+		},
+		"node": node,
+	})
+}
+
+func (r *Router) GetWallets(c *gin.Context) {
+	names, err := r.rawdb.GetWallets()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"wallets": names,
+	})
+}
+
+func (r *Router) GetWallet(c *gin.Context) {
+	w, addresses, err := r.wallet(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"wallet":    w,
+		"addresses": addresses,
+	})
+}
+
+func (r *Router) GetWalletBalance(c *gin.Context) {
+	_, addresses, err := r.wallet(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	balance, balances, err := r.view(c).GetWalletBalance(addresses)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"balance":   balance,
+		"addresses": balances,
+	})
+}
+
+func (r *Router) GetWalletUtxo(c *gin.Context) {
+	_, addresses, err := r.wallet(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	filter, err := r.utxoFilter(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	utxos, amount, err := r.view(c).GetWalletUtxo(addresses, filter)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"utxo":   utxos,
+		"amount": amount,
+	})
+}
+
+func (r *Router) GetWalletTxs(c *gin.Context) {
+	_, addresses, err := r.wallet(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	txs, err := r.view(c).GetWalletTxs(addresses, limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"tx": txs,
+	})
+}
+
+// walletRequest 修改钱包的请求, 加入时address和xpub只能有一个
+type walletRequest struct {
+	Name string `json:"name"`
+	WalletEntry
+}
+
+func (r *Router) AddWalletAddress(c *gin.Context) {
+	req := &walletRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	entry := req.WalletEntry
+	if err := entry.validate(r.params); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+	w, err := r.rawdb.GetWallet(req.Name)
+	if err == leveldb.ErrNotFound {
+		w, err = &Wallet{Name: req.Name}, nil
+	}
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	w.Put(&entry)
+	if err := r.rawdb.SetWallet(w); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	r.deposits.Reload()
+	c.JSON(200, gin.H{
+		"wallet": w,
+	})
+}
+
+func (r *Router) RemoveWalletAddress(c *gin.Context) {
+	req := &walletRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+	w, err := r.rawdb.GetWallet(req.Name)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !w.Remove(req.key()) {
+		c.JSON(200, gin.H{
+			"error": fmt.Sprintf("%s is not in wallet %s", req.key(), req.Name),
+		})
+		return
+	}
+	if err := r.rawdb.SetWallet(w); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	r.deposits.Reload()
+	c.JSON(200, gin.H{
+		"wallet": w,
+	})
+}
+
+func (r *Router) DeleteWallet(c *gin.Context) {
+	name := c.PostForm("name")
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+	if _, err := r.rawdb.GetWallet(name); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := r.rawdb.DelWallet(name); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	r.deposits.Reload()
+	c.JSON(200, gin.H{
+		"deleted": name,
+	})
+}
+
+func (r *Router) GetDeposits(c *gin.Context) {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	tip, err := r.rawdb.GetHeight()
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	deposits, err := r.rawdb.GetDeposits(c.PostForm("wallet"), c.PostForm("address"), c.PostForm("status"), tip, limit, offset)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"deposits": deposits,
+		"height":   tip,
+	})
+}
+
+func (r *Router) GetDepositEvents(c *gin.Context) {
+	after, err := strconv.ParseUint(c.DefaultPostForm("after", "0"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	limit, _, err := pageParams(c)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	events, err := r.rawdb.GetDepositEvents(after, limit, c.PostForm("unacked") == "1")
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"events": events,
+	})
+}
+
+func (r *Router) AckDepositEvents(c *gin.Context) {
+	type params struct {
+		Seqs []uint64 `json:"seqs"`
+	}
+	req := &params{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	unknown, err := r.rawdb.AckDepositEvents(req.Seqs)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"acked":   len(req.Seqs) - len(unknown),
+		"unknown": unknown,
+	})
+}
+
+func (r *Router) ExportHistory(c *gin.Context) {
+	req := &StatementRequest{
+		Address: c.Query("address"),
+		Wallet:  c.Query("wallet"),
+		Format:  c.DefaultQuery("format", "csv"),
+		From:    c.Query("from"),
+		To:      c.Query("to"),
+	}
+	var err error
+	if req.FromHeight, err = strconv.ParseInt(c.DefaultQuery("from_height", "0"), 10, 64); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if req.ToHeight, err = strconv.ParseInt(c.DefaultQuery("to_height", "0"), 10, 64); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	s, err := prepareStatement(r.view(c), r.params, req)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// 开始写出后无法再返回错误, 只能中断响应
+	name := req.Address + req.Wallet
+	if s.format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "statement-"+name+"."+s.format))
+	c.Status(200)
+	if err := s.Write(c.Writer); err != nil {
+		log.Error("export history", "name", name, "err", err)
+	}
+}
+
+func (r *Router) GetOutpoint(c *gin.Context) {
+	vout, err := strconv.ParseUint(c.Param("vout"), 10, 32)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	outpoint, err := r.view(c).GetOutpoint(c.Param("txid"), uint32(vout))
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"outpoint": outpoint,
+	})
+}
+
+func (r *Router) TraceTx(c *gin.Context) {
+	req := &TraceRequest{
+		Txid:      c.PostForm("txid"),
+		Direction: c.PostForm("direction"),
+	}
+	if vout := c.PostForm("vout"); vout != "" {
+		n, err := strconv.ParseUint(vout, 10, 32)
+		if err != nil {
+			c.JSON(200, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		index := uint32(n)
+		req.Vout = &index
+	}
+	var err error
+	if req.Depth, err = strconv.Atoi(c.DefaultPostForm("depth", "0")); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if req.Fanout, err = strconv.Atoi(c.DefaultPostForm("fanout", "0")); err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	graph, err := r.view(c).TraceTx(req)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"graph": graph,
+	})
+}
+
+// wallet 按name参数读取钱包并展开地址
+func (r *Router) wallet(c *gin.Context) (*Wallet, []*WalletAddress, error) {
+	w, err := r.rawdb.GetWallet(c.PostForm("name"))
+	if err != nil {
+		return nil, nil, err
+	}
+	addresses, err := w.Addresses(r.params)
+	if err != nil {
+		return nil, nil, err
+	}
+	return w, addresses, nil
+}
+
+// block 按height或hash参数查找已索引的区块
+func (r *Router) block(c *gin.Context) (*Block, error) {
+	if hash := c.PostForm("hash"); hash != "" {
+		return r.view(c).GetBlockByHash(hash)
+	}
+	height, err := strconv.ParseInt(c.PostForm("height"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return r.view(c).GetBlock(height)
+}
+
+// utxoFilter 解析确认数参数, 默认排除未成熟的coinbase输出
+func (r *Router) utxoFilter(c *gin.Context) (*UtxoFilter, error) {
+	tip, err := r.view(c).GetHeight()
+	if err != nil {
+		return nil, err
+	}
+	minConf, err := strconv.ParseInt(c.DefaultPostForm("min_conf", "0"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	maxConf, err := strconv.ParseInt(c.DefaultPostForm("max_conf", "0"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &UtxoFilter{
+		Tip:      tip,
+		MinConf:  minConf,
+		MaxConf:  maxConf,
+		Maturity: int64(r.params.CoinbaseMaturity),
+		Immature: c.PostForm("include_immature") == "1",
+	}, nil
+}
+
+// pageParams 解析分页参数, limit最大50
+func pageParams(c *gin.Context) (int64, int64, error) {
+	limit, err := strconv.ParseInt(c.DefaultPostForm("limit", "50"), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := strconv.ParseInt(c.DefaultPostForm("offset", "0"), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offset < 0 {
+		return 0, 0, errors.New("offset must not be negative")
+	}
+	if limit <= 0 || limit > 50 {
+		limit = 50
+	}
+	return limit, offset, nil
+}
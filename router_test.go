@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPageParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	parse := func(form url.Values) (int64, int64, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return pageParams(c)
+	}
+
+	limit, offset, err := parse(url.Values{"limit": {"500"}, "offset": {"3"}})
+	if err != nil || limit != 50 || offset != 3 {
+		t.Fatalf("got %d %d %v", limit, offset, err)
+	}
+	// 负数offset会让分页切片越界, 必须拒绝
+	if _, _, err := parse(url.Values{"offset": {"-1"}}); err == nil {
+		t.Fatal("negative offset accepted")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/btcutil"
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/doged/rpcclient"
+	"github.com/dogecoinw/doged/wire"
+)
+
+// RPCClient 在节点客户端上记录每个方法的耗时和错误, 只覆盖索引用到的方法
+type RPCClient struct {
+	*rpcclient.Client
+	chain string
+}
+
+func (c *RPCClient) RawRequest(method string, params []json.RawMessage) (result json.RawMessage, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, method, start, err) }(time.Now())
+	return c.Client.RawRequest(method, params)
+}
+
+func (c *RPCClient) GetBlockCount() (count int64, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getblockcount", start, err) }(time.Now())
+	return c.Client.GetBlockCount()
+}
+
+func (c *RPCClient) GetBlockHash(height int64) (hash *chainhash.Hash, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getblockhash", start, err) }(time.Now())
+	return c.Client.GetBlockHash(height)
+}
+
+func (c *RPCClient) GetBlockVerboseBool(hash *chainhash.Hash) (block *btcjson.GetBlockVerboseResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getblock", start, err) }(time.Now())
+	return c.Client.GetBlockVerboseBool(hash)
+}
+
+func (c *RPCClient) GetBlockHeaderVerbose(hash *chainhash.Hash) (header *btcjson.GetBlockHeaderVerboseResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getblockheader", start, err) }(time.Now())
+	return c.Client.GetBlockHeaderVerbose(hash)
+}
+
+func (c *RPCClient) GetBlockChainInfo() (info *btcjson.GetBlockChainInfoResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getblockchaininfo", start, err) }(time.Now())
+	return c.Client.GetBlockChainInfo()
+}
+
+func (c *RPCClient) GetRawTransaction(hash *chainhash.Hash) (tx *btcutil.Tx, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getrawtransaction", start, err) }(time.Now())
+	return c.Client.GetRawTransaction(hash)
+}
+
+func (c *RPCClient) GetRawTransactionVerboseBool(hash *chainhash.Hash) (tx *btcjson.TxRawResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getrawtransaction", start, err) }(time.Now())
+	return c.Client.GetRawTransactionVerboseBool(hash)
+}
+
+func (c *RPCClient) GetRawMempoolVerbose() (entries map[string]btcjson.GetRawMempoolVerboseResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "getrawmempool", start, err) }(time.Now())
+	return c.Client.GetRawMempoolVerbose()
+}
+
+func (c *RPCClient) EstimateSmartFee(target int64, mode *btcjson.EstimateSmartFeeMode) (result *btcjson.EstimateSmartFeeResult, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "estimatesmartfee", start, err) }(time.Now())
+	return c.Client.EstimateSmartFee(target, mode)
+}
+
+func (c *RPCClient) SendRawTransaction(tx *wire.MsgTx, allowHighFees bool) (hash *chainhash.Hash, err error) {
+	defer func(start time.Time) { observeRPC(c.chain, "sendrawtransaction", start, err) }(time.Now())
+	return c.Client.SendRawTransaction(tx, allowHighFees)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dogecoinw/doged/btcjson"
+	"github.com/dogecoinw/doged/btcutil"
+	"github.com/dogecoinw/doged/btcutil/bech32"
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/dogecoinw/doged/txscript"
+)
+
+// decodeAddress 解码地址并确认属于该链. btcutil只识别已注册网络的bech32前缀,
+// 内置链参数没有注册, 带有该链前缀的隔离见证地址在这里直接解码.
+func decodeAddress(address string, params *chaincfg.Params) (btcutil.Address, error) {
+	if hrp := params.Bech32HRPSegwit; hrp != "" && strings.HasPrefix(strings.ToLower(address), hrp+"1") {
+		return decodeSegwitAddress(address, params)
+	}
+	addr, err := btcutil.DecodeAddress(address, params)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IsForNet(params) {
+		return nil, fmt.Errorf("address %s is not for chain %s", address, params.Name)
+	}
+	return addr, nil
+}
+
+// decodeSegwitAddress 解码版本0(bech32)和版本1(bech32m)的隔离见证地址
+func decodeSegwitAddress(address string, params *chaincfg.Params) (btcutil.Address, error) {
+	hrp, data, encoding, err := bech32.DecodeGeneric(address)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(hrp, params.Bech32HRPSegwit) || len(data) < 1 {
+		return nil, fmt.Errorf("invalid segwit address %s", address)
+	}
+	program, err := bech32.ConvertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version := data[0]; {
+	case version == 0 && encoding == bech32.Version0 && len(program) == 20:
+		return btcutil.NewAddressWitnessPubKeyHash(program, params)
+	case version == 0 && encoding == bech32.Version0 && len(program) == 32:
+		return btcutil.NewAddressWitnessScriptHash(program, params)
+	case version == 1 && encoding == bech32.VersionM && len(program) == 32:
+		return btcutil.NewAddressTaproot(program, params)
+	}
+	return nil, errors.New("unsupported segwit address " + address)
+}
+
+// newVout 解析输出脚本, 返回索引记录和原始脚本
+func newVout(vout btcjson.Vout, params *chaincfg.Params, height int64, coinbase bool) (*Vout, []byte, error) {
+	pkScript, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	voutDB := &Vout{
+		Index:      vout.N,
+		Value:      vout.Value,
+		ScriptHash: scriptHash(pkScript),
+		Class:      class.String(),
+		Script:     vout.ScriptPubKey.Hex,
+		Height:     height,
+		Coinbase:   coinbase,
+	}
+	for _, addr := range addrs {
+		voutDB.Addresses = append(voutDB.Addresses, addr.EncodeAddress())
+	}
+
+	// 多签即使只有一个公钥也按脚本记账
+	if len(voutDB.Addresses) == 1 && class != txscript.MultiSigTy {
+		voutDB.Address = voutDB.Addresses[0]
+	}
+	return voutDB, pkScript, nil
+}
+
+// scriptHash 返回脚本的sha256, 按字节反序编码 (与Electrum的scripthash一致)
+func scriptHash(pkScript []byte) string {
+	hash := sha256.Sum256(pkScript)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:])
+}
+
+// nullData 提取OP_RETURN输出携带的数据
+func nullData(pkScript []byte) ([]byte, bool) {
+	if len(pkScript) == 0 || pkScript[0] != txscript.OP_RETURN {
+		return nil, false
+	}
+
+	pushes, err := txscript.PushedData(pkScript[1:])
+	if err != nil {
+		// 非标准的数据段按原始字节保存
+		return pkScript[1:], true
+	}
+
+	var data []byte
+	for _, push := range pushes {
+		data = append(data, push...)
+	}
+	return data, true
+}
+
+// isCoinbase 判断交易是否为coinbase
+func isCoinbase(tx *btcjson.TxRawResult) bool {
+	return len(tx.Vin) > 0 && tx.Vin[0].IsCoinBase()
+}
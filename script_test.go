@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLitecoinSegwitAddress(t *testing.T) {
+	params, err := (&ChainSetting{Chain: Chain{ChainName: "litecoin"}}).Params()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := decodeAddress("ltc1qw46h2at4w46h2at4w46h2at4w46h2at4w7ttue", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(addr.EncodeAddress(), "ltc1") || len(addr.ScriptAddress()) != 20 {
+		t.Errorf("decoded %s", addr.EncodeAddress())
+	}
+	if _, err := newTxOut("ltc1qw46h2at4w46h2at4w46h2at4w46h2at4w7ttue", 1, params); err != nil {
+		t.Errorf("psbt output: %v", err)
+	}
+	entry := &WalletEntry{Address: "ltc1qw46h2at4w46h2at4w46h2at4w46h2at4w7ttue"}
+	if err := entry.validate(params); err != nil {
+		t.Errorf("wallet entry: %v", err)
+	}
+
+	// 其他链的地址不属于该链
+	if _, err := decodeAddress("bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", params); err == nil {
+		t.Error("bitcoin address accepted on litecoin")
+	}
+}
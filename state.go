@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dogecoinw/doged/btcjson"
 	"github.com/dogecoinw/doged/chaincfg/chainhash"
-	"github.com/dogecoinw/doged/rpcclient"
 	"github.com/dogecoinw/doged/txscript"
 	"github.com/dogecoinw/go-dogecoin/log"
 )
@@ -16,139 +16,253 @@ import (
 var (
 	delBlock      = int64(1000)
 	startInterval = 3 * time.Second
+	// maxReorgDepth 自动撤销的最多区块数, 更深的分叉视为节点与数据库不是同一条链
+	maxReorgDepth = int64(100)
 )
 
 type State struct {
-	Node      *rpcclient.Client
+	Node      *NodePool
 	DB        *RawDB
+	Fees      *FeeEstimator
+	chain     *ChainContext
 	fromBlock int64
+	lastScan  atomic.Int64          // 上次成功扫描的unix时间
+	stopped   atomic.Pointer[error] // 扫描器停止的原因
+	touched   map[string]bool       // 当前区块涉及的地址, 提交后清除对应的缓存
+	current   *Block                // 正在扫描的区块, 余额变化记在这个区块上
+	stats     map[string]*statsDelta
+	utxos     *UtxoSet   // 当前区块写完后保存的utxo集合统计
+	deposits  []*Deposit // 当前区块中付给钱包地址的输出
+	block     *RawDB     // 当前区块的写入, 区块扫描完后一次写入数据库
 
 	ctx context.Context
-	wg  *sync.WaitGroup
 }
 
-func NewState(ctx context.Context, wg *sync.WaitGroup, node *rpcclient.Client, db *RawDB) *State {
+func NewState(ctx context.Context, chain *ChainContext) *State {
 	return &State{
-		Node: node,
-		DB:   db,
-		ctx:  ctx,
-		wg:   wg,
+		Node:  chain.Node,
+		DB:    chain.DB,
+		Fees:  NewFeeEstimator(chain.DB, chain.Node),
+		chain: chain,
+		ctx:   ctx,
 	}
 }
 
-func (s *State) Start(fromBlock int64) {
-	defer s.wg.Done()
-	if fromBlock == 0 {
-		height, err := s.DB.GetHeight()
-		if err != nil {
-			s.fromBlock = 0
-		} else {
-			s.fromBlock = height
-		}
-	} else {
-		s.fromBlock = fromBlock
+// Start 持续扫描直到ctx取消, 节点与数据库不是同一条链时返回错误
+func (s *State) Start(fromBlock int64) error {
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	s.fromBlock = startHeight(s.DB, fromBlock)
+	if height, err := s.DB.GetHeight(); err == nil {
+		metricIndexedHeight.WithLabelValues(s.chain.Name).Set(float64(height))
 	}
 
+	// 启动检查成功之前不扫描, 节点不可用时下一轮重试
+	checked := false
 	startTicker := time.NewTicker(startInterval)
-out:
+	defer startTicker.Stop()
 	for {
 		select {
 		case <-startTicker.C:
+			s.Node.Check(false)
+			if !checked {
+				if err := s.startCheck(); err != nil {
+					log.Error("scanning", "checkChain", err)
+					if errors.Is(err, errChainMismatch) {
+						return s.stop(err)
+					}
+					s.Node.Fail(err)
+					continue
+				}
+				checked = true
+			}
 			if err := s.scan(); err != nil {
 				log.Error("scanning", "scanning", err)
+				// 节点和数据库不是同一条链, 停止扫描避免混入两条链的数据
+				if errors.Is(err, errChainMismatch) {
+					return s.stop(err)
+				}
+				// 切换到其他健康节点, 下一轮重试
+				s.Node.Fail(err)
+			} else {
+				s.lastScan.Store(time.Now().Unix())
+			}
+			if err := s.Fees.UpdateMempool(); err != nil {
+				log.Error("scanning", "mempool", err)
 			}
 		case <-s.ctx.Done():
-			log.Info("scanning", "stop", "Done")
-			break out
+			log.Info("scanning", "chain", s.chain.Name, "stop", "Done")
+			return nil
 		}
 	}
 }
 
+// startCheck 检查数据库与节点是否为同一条链, 停止期间节点切换了分支时回滚
+func (s *State) startCheck() error {
+	err := s.checkChain()
+	if errors.Is(err, errReorg) {
+		return s.reorg()
+	}
+	return err
+}
+
+// resumeHeight 返回继续扫描的高度. 保存的高度是最后一个写完的区块, 余额变化等记录按区块累加,
+// 重复处理这个区块会重复计入, 所以从下一个区块开始.
+func resumeHeight(db *RawDB) int64 {
+	height, err := db.GetHeight()
+	if err != nil {
+		return 0
+	}
+	return height + 1
+}
+
+// stop 记录扫描器停止的原因并返回err
+func (s *State) stop(err error) error {
+	s.stopped.Store(&err)
+	return err
+}
+
+// Stopped 返回扫描器因错误停止的原因, 仍在运行时为nil
+func (s *State) Stopped() error {
+	if err := s.stopped.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// startHeight 返回启动时开始扫描的高度: 配置的from_block和已索引高度的下一个区块中较高的一个.
+// 已索引的区块不重新扫描, 需要重新扫描时用 reindex 先回滚.
+func startHeight(db *RawDB, fromBlock int64) int64 {
+	height := resumeHeight(db)
+	if fromBlock > height {
+		return fromBlock
+	}
+	return height
+}
+
+// LastScan 返回上次成功扫描的时间, 还没有成功扫描时为零值
+func (s *State) LastScan() time.Time {
+	if t := s.lastScan.Load(); t != 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Time{}
+}
+
 func (s *State) scan() error {
-	blockCount, _ := s.Node.GetBlockCount()
+	node := s.Node.Client()
+	blockCount, err := node.GetBlockCount()
+	if err != nil {
+		return err
+	}
 
 	if blockCount-s.fromBlock > 100 {
 		blockCount = s.fromBlock + 100
 	}
 
 	for ; s.fromBlock < blockCount; s.fromBlock++ {
-		blockHash, err := s.Node.GetBlockHash(s.fromBlock)
+		// 只在区块之间停止, 不会留下写了一半的区块
+		if s.ctx.Err() != nil {
+			return nil
+		}
+
+		blockHash, err := node.GetBlockHash(s.fromBlock)
+		if err != nil {
+			return err
+		}
+
+		log.Info("scanning", "chain", s.chain.Name, "fromBlock", s.fromBlock)
+		block, err := node.GetBlockVerboseBool(blockHash)
 		if err != nil {
 			return err
 		}
 
-		log.Info("scanning", "fromBlock", s.fromBlock)
-		block, err := s.Node.GetBlockVerboseBool(blockHash)
+		prev, _ := s.DB.GetBlock(s.fromBlock - 1)
+		blockDB, err := s.checkHeader(prev, block)
+		if errors.Is(err, errReorg) {
+			// 撤销孤块后, 下一轮从共同祖先的下一个区块继续扫描
+			return s.reorg()
+		}
 		if err != nil {
 			return err
 		}
 
+		s.block = s.DB.Begin()
+
 		addrMap := make(map[string]float64, 0)
+		s.touched = make(map[string]bool)
+		s.current = blockDB
+		s.stats = make(map[string]*statsDelta)
+		s.deposits = nil
+		if s.utxos, err = s.block.GetUtxoSet(); err != nil {
+			return err
+		}
+		feeSamples := make([]feeSample, 0, len(block.Tx))
+		totalFee := int64(0)
 		for _, tx := range block.Tx {
 			txhash, _ := chainhash.NewHashFromStr(tx)
-			transactionVerbose, err := s.Node.GetRawTransactionVerboseBool(txhash)
+			transactionVerbose, err := node.GetRawTransactionVerboseBool(txhash)
 			if err != nil {
 				continue
 			}
 
+			coinbase := isCoinbase(transactionVerbose)
 			vouts := make([]*Vout, 0)
 			for _, vout := range transactionVerbose.Vout {
-
-				hexb, _ := hex.DecodeString(vout.ScriptPubKey.Hex)
-				_, addrs, _, err := txscript.ExtractPkScriptAddrs(hexb, &ChainCfg)
+				voutDB, pkScript, err := newVout(vout, s.chain.Params, block.Height, coinbase)
 				if err != nil {
 					return err
 				}
 
-				if len(addrs) == 0 {
-					continue
-				}
-				voutDB := &Vout{
-					Index:   vout.N,
-					Value:   vout.Value,
-					Address: addrs[0].EncodeAddress(),
-				}
-
 				vouts = append(vouts, voutDB)
-				s.DB.SetVout(tx, vout.N, voutDB)
+				s.indexVout(tx, voutDB, pkScript, addrMap)
 
-				vinDB := &Vin{
-					Txid:    tx,
-					Vout:    vout.N,
-					Address: voutDB.Address,
-					Value:   voutDB.Value,
+				if data, ok := nullData(pkScript); ok {
+					s.block.SetNullData(data, tx, vout.N, block.Height)
+				}
+				for _, owner := range voutDB.Owners() {
+					s.block.SetAddressTx(owner, tx, block.Height, block.Time)
+					s.touched[owner] = true
 				}
-
-				s.DB.SetUtxo(voutDB.Address, tx, vout.N, vinDB)
-				s.DB.SetAddressTx(voutDB.Address, tx, block.Height, block.Time)
-				addrMap[addrs[0].EncodeAddress()] += vout.Value
 			}
 
 			vins := make([]*Vin, 0)
-			for _, vin := range transactionVerbose.Vin {
+			resolved := true
+			for i, vin := range transactionVerbose.Vin {
 				if vin.Coinbase != "" {
 					continue
 				}
-				voutDB, _ := s.DB.GetVout(vin.Txid, vin.Vout)
+				voutDB, _ := s.block.GetVout(vin.Txid, vin.Vout)
 				if voutDB == nil {
 					fmt.Println("voutDB is nil", vin.Txid, vin.Vout)
+					metricMissingPrevouts.WithLabelValues(s.chain.Name).Inc()
 					s.fork(vin.Txid)
-					voutDB, _ = s.DB.GetVout(vin.Txid, vin.Vout)
+					voutDB, _ = s.block.GetVout(vin.Txid, vin.Vout)
 					if voutDB == nil {
 						fmt.Println("voutDB is still nil after fork, skipping", vin.Txid, vin.Vout)
+						resolved = false
 						continue
 					}
 				}
-				vinDB := &Vin{
-					Txid:    vin.Txid,
-					Vout:    vin.Vout,
-					Address: voutDB.Address,
-					Value:   voutDB.Value,
-				}
+				vinDB := voutDB.AsVin(vin.Txid)
 				vins = append(vins, vinDB)
-				addrMap[voutDB.Address] -= voutDB.Value
-				s.DB.DelUtxo(voutDB.Address, vinDB.Txid, vinDB.Vout)
-				s.DB.SetAddressTx(voutDB.Address, tx, block.Height, block.Time)
+				addrMap[voutDB.Owner()] -= voutDB.Value
+				s.block.DelUtxo(voutDB.Owner(), vinDB.Txid, vinDB.Vout)
+				s.block.SetSpend(vinDB.Txid, vinDB.Vout, newSpend(tx, i, block.Height))
+				s.spent(tx, vinDB, block.Height)
+				for _, owner := range voutDB.Owners() {
+					s.block.SetAddressTx(owner, tx, block.Height, block.Time)
+					s.touched[owner] = true
+				}
+			}
+
+			// 所有输入都能解析时才能计算手续费
+			if !coinbase && resolved {
+				if fee, ok := txFee(vins, vouts); ok {
+					vsize := txVsize(transactionVerbose)
+					feeSamples = append(feeSamples, feeSample{rate: fee * 1000 / vsize, vsize: vsize})
+					totalFee += fee
+				}
 			}
 
 			txDB := &Tx{
@@ -156,22 +270,139 @@ func (s *State) scan() error {
 				Vins:  vins,
 				Vouts: vouts,
 			}
-			s.DB.SetTx(txDB)
+			s.block.SetTx(txDB)
 		}
 
 		for addr, value := range addrMap {
 			s.updateBalance(addr, value)
 		}
-		s.DB.SetHeight(s.fromBlock)
+
+		for addr, delta := range s.stats {
+			if err := s.block.ApplyAddressStats(addr, delta); err != nil {
+				return err
+			}
+		}
+
+		s.utxos.Height = block.Height
+		if err := s.block.SetUtxoSet(s.utxos); err != nil {
+			return err
+		}
+
+		s.block.SetBlock(block.Height, blockDB)
+		if err := s.chain.Deposits.Process(s.block, block.Height, s.deposits); err != nil {
+			return err
+		}
+		if _, err := s.block.GetAnchor(); err != nil {
+			s.block.SetAnchor(&Checkpoint{Height: block.Height, Hash: block.Hash})
+		}
+
+		blockFees := newBlockFees(block.Height, feeSamples, totalFee)
+		s.block.SetBlockFees(blockFees)
+		s.block.SetHeight(s.fromBlock)
+
+		// 区块的全部记录和高度一起写入, 中途失败时这个区块下一轮重新扫描
+		if err := s.block.Flush(); err != nil {
+			return err
+		}
+		s.Fees.AddBlock(blockFees)
+
+		// 接口从这个区块开始读取新的快照, 并丢弃涉及的地址的缓存
+		if err := s.DB.Commit(); err != nil {
+			return err
+		}
+		s.chain.Cache.Invalidate(s.touched)
+
+		metricIndexedHeight.WithLabelValues(s.chain.Name).Set(float64(block.Height))
+		metricBlocks.WithLabelValues(s.chain.Name).Inc()
+		metricTxs.WithLabelValues(s.chain.Name).Add(float64(len(block.Tx)))
 	}
 	return nil
 }
 
+// newBlock 从节点返回的区块生成存储记录
+func newBlock(block *btcjson.GetBlockVerboseResult) *Block {
+	return &Block{
+		Height:       block.Height,
+		Hash:         block.Hash,
+		PreviousHash: block.PreviousHash,
+		MerkleRoot:   block.MerkleRoot,
+		Version:      block.Version,
+		Time:         block.Time,
+		Bits:         block.Bits,
+		Nonce:        block.Nonce,
+		Size:         block.Size,
+		TxCount:      len(block.Tx),
+		Txids:        block.Tx,
+	}
+}
+
+// 保存输出及其脚本索引, 可花费的输出计入utxo和余额
+func (s *State) indexVout(txid string, voutDB *Vout, pkScript []byte, addrMap map[string]float64) {
+	s.block.SetVout(txid, voutDB.Index, voutDB)
+	s.block.SetScriptOutput(txid, voutDB)
+
+	// OP_RETURN等不可花费的输出不进入utxo集合
+	if txscript.IsUnspendable(pkScript) {
+		return
+	}
+
+	s.block.SetUtxo(voutDB.Owner(), txid, voutDB.Index, voutDB.AsVin(txid))
+	addrMap[voutDB.Owner()] += voutDB.Value
+	if deposit := s.chain.Deposits.Detect(txid, voutDB); deposit != nil {
+		s.deposits = append(s.deposits, deposit)
+	}
+
+	if delta := s.stat(voutDB.Owner()); delta != nil {
+		delta.seen(txid, voutDB.Height)
+		delta.received += voutDB.Value
+		delta.utxos++
+	}
+	if s.utxos != nil {
+		if err := s.utxos.Add(voutDB.AsVin(txid)); err != nil {
+			log.Error("scanning", "utxo set", err)
+		}
+	}
+}
+
+// spent 记录txid在height花费了coin
+func (s *State) spent(txid string, coin *Vin, height int64) {
+	if delta := s.stat(coin.Owner()); delta != nil {
+		delta.seen(txid, height)
+		delta.sent += coin.Value
+		delta.utxos--
+	}
+	if s.utxos != nil {
+		if err := s.utxos.Spend(coin); err != nil {
+			log.Error("scanning", "utxo set", err)
+		}
+	}
+}
+
+// stat 返回当前区块中地址的统计变化, 不在扫描中时返回nil
+func (s *State) stat(address string) *statsDelta {
+	if s.stats == nil {
+		return nil
+	}
+	if s.stats[address] == nil {
+		s.stats[address] = newStatsDelta()
+	}
+	return s.stats[address]
+}
+
 // 更新余额
 func (s *State) updateBalance(address string, value float64) error {
-	balance, _ := s.DB.GetBalance(address)
+	if s.touched != nil {
+		s.touched[address] = true
+	}
+	balance, _ := s.block.GetBalance(address)
 	balance += value
-	return s.DB.SetBalance(address, balance)
+	if err := s.block.SetBalance(address, balance); err != nil {
+		return err
+	}
+	if s.current == nil {
+		return nil
+	}
+	return s.block.AddBalanceChange(address, s.current.Height, s.current.Time, value, balance)
 }
 
 func (s *State) fork(hash string) error {
@@ -185,69 +416,52 @@ func (s *State) forkWithDepth(hash string, depth int) error {
 		return nil
 	}
 
+	metricForks.WithLabelValues(s.chain.Name).Inc()
 	txhash, _ := chainhash.NewHashFromStr(hash)
-	transactionVerbose, err := s.Node.GetRawTransactionVerboseBool(txhash)
+	transactionVerbose, err := s.Node.Client().GetRawTransactionVerboseBool(txhash)
 	if err != nil {
 		return err
 	}
 
+	height, err := s.txHeight(transactionVerbose)
+	if err != nil {
+		return err
+	}
+
+	coinbase := isCoinbase(transactionVerbose)
 	vouts := make([]*Vout, 0)
 	addrMap := make(map[string]float64, 0)
 	for _, vout := range transactionVerbose.Vout {
-
-		hexb, _ := hex.DecodeString(vout.ScriptPubKey.Hex)
-		_, addrs, _, err := txscript.ExtractPkScriptAddrs(hexb, &ChainCfg)
+		voutDB, pkScript, err := newVout(vout, s.chain.Params, height, coinbase)
 		if err != nil {
 			return err
 		}
 
-		if len(addrs) == 0 {
-			continue
-		}
-
-		voutDB := &Vout{
-			Index:   vout.N,
-			Value:   vout.Value,
-			Address: addrs[0].EncodeAddress(),
-		}
 		vouts = append(vouts, voutDB)
-		s.DB.SetVout(hash, vout.N, voutDB)
-
-		vinDB := &Vin{
-			Txid:    hash,
-			Vout:    vout.N,
-			Address: voutDB.Address,
-			Value:   voutDB.Value,
-		}
-
-		s.DB.SetUtxo(voutDB.Address, hash, vout.N, vinDB)
-		addrMap[addrs[0].EncodeAddress()] += vout.Value
+		s.indexVout(hash, voutDB, pkScript, addrMap)
 	}
 
 	vins := make([]*Vin, 0)
-	for _, vin := range transactionVerbose.Vin {
+	for i, vin := range transactionVerbose.Vin {
 		if vin.Coinbase != "" {
 			continue
 		}
-		voutDB, _ := s.DB.GetVout(vin.Txid, vin.Vout)
+		voutDB, _ := s.block.GetVout(vin.Txid, vin.Vout)
 		if voutDB == nil {
 			fmt.Println("voutDB is nil", vin.Txid, vin.Vout)
 			s.forkWithDepth(vin.Txid, depth+1)
-			voutDB, _ = s.DB.GetVout(vin.Txid, vin.Vout)
+			voutDB, _ = s.block.GetVout(vin.Txid, vin.Vout)
 			if voutDB == nil {
 				fmt.Println("voutDB is still nil after fork in fork method, skipping", vin.Txid, vin.Vout)
 				continue
 			}
 		}
-		vinDB := &Vin{
-			Txid:    vin.Txid,
-			Vout:    vin.Vout,
-			Address: voutDB.Address,
-			Value:   voutDB.Value,
-		}
+		vinDB := voutDB.AsVin(vin.Txid)
 		vins = append(vins, vinDB)
-		addrMap[voutDB.Address] -= voutDB.Value
-		s.DB.DelUtxo(voutDB.Address, vinDB.Txid, vinDB.Vout)
+		addrMap[voutDB.Owner()] -= voutDB.Value
+		s.block.DelUtxo(voutDB.Owner(), vinDB.Txid, vinDB.Vout)
+		s.block.SetSpend(vinDB.Txid, vinDB.Vout, newSpend(hash, i, height))
+		s.spent(hash, vinDB, height)
 	}
 
 	for addr, value := range addrMap {
@@ -256,3 +470,24 @@ func (s *State) forkWithDepth(hash string, depth int) error {
 	return nil
 
 }
+
+// txHeight 返回交易所在区块的高度, 未确认的交易返回0
+func (s *State) txHeight(tx *btcjson.TxRawResult) (int64, error) {
+	return blockHeight(s.Node.Client(), tx.BlockHash)
+}
+
+// blockHeight 根据区块哈希查询高度, 空哈希(未确认)返回0
+func blockHeight(node *RPCClient, hash string) (int64, error) {
+	if hash == "" {
+		return 0, nil
+	}
+	blockHash, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return 0, err
+	}
+	header, err := node.GetBlockHeaderVerbose(blockHash)
+	if err != nil {
+		return 0, err
+	}
+	return int64(header.Height), nil
+}
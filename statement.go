@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// statementFlushRows 每写入这么多行刷新一次输出
+const statementFlushRows = 100
+
+var statementColumns = []string{"timestamp", "height", "txid", "direction", "amount", "fee", "balance", "counterparties"}
+
+// StatementRequest 导出流水的参数. from/to 为日期(2006-01-02, UTC)或unix秒, 与高度范围同时给出时取交集
+type StatementRequest struct {
+	Address    string
+	Wallet     string
+	Format     string // csv 或 jsonl
+	FromHeight int64
+	ToHeight   int64 // 0表示到已索引的最新区块
+	From       string
+	To         string
+}
+
+// StatementRow 导出流水中的一个交易, Amount为导出地址的净变化, 导出地址参与支付时才有Fee
+type StatementRow struct {
+	Timestamp      string   `json:"timestamp"`
+	Height         int64    `json:"height"`
+	Txid           string   `json:"txid"`
+	Direction      string   `json:"direction"`
+	Amount         float64  `json:"amount"`
+	Fee            float64  `json:"fee"`
+	Balance        float64  `json:"balance"`
+	Counterparties []string `json:"counterparties"`
+}
+
+// statement 已解析的导出范围和地址
+type statement struct {
+	db        *RawDB
+	format    string
+	addresses []string
+	owned     map[string]bool
+	from, to  int64
+}
+
+// parseStatementTime 解析日期或unix秒, end为true时日期取当天最后一秒
+func parseStatementTime(s string, end bool) (int64, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			return t.Unix() + 86400 - 1, nil
+		}
+		return t.Unix(), nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// prepareStatement 校验参数, 展开钱包地址并把时间范围换算成高度范围
+func prepareStatement(db *RawDB, params *chaincfg.Params, req *StatementRequest) (*statement, error) {
+	s := &statement{db: db, format: req.Format, owned: make(map[string]bool)}
+	if s.format == "" {
+		s.format = "csv"
+	}
+	if s.format != "csv" && s.format != "jsonl" {
+		return nil, fmt.Errorf("unknown format %q", req.Format)
+	}
+
+	switch {
+	case req.Address != "" && req.Wallet != "":
+		return nil, errors.New("address and wallet are exclusive")
+	case req.Address != "":
+		s.addresses = []string{req.Address}
+	case req.Wallet != "":
+		w, err := db.GetWallet(req.Wallet)
+		if err != nil {
+			return nil, fmt.Errorf("wallet %s: %w", req.Wallet, err)
+		}
+		addresses, err := w.Addresses(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addresses {
+			s.addresses = append(s.addresses, a.Address)
+		}
+	default:
+		return nil, errors.New("address or wallet is required")
+	}
+	for _, address := range s.addresses {
+		s.owned[address] = true
+	}
+
+	tip, err := db.GetHeight()
+	if err != nil {
+		return nil, err
+	}
+	s.from, s.to = req.FromHeight, req.ToHeight
+	if s.to <= 0 || s.to > tip {
+		s.to = tip
+	}
+	if req.From != "" {
+		t, err := parseStatementTime(req.From, false)
+		if err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+		height, err := db.HeightAtTime(t - 1)
+		if err != nil {
+			return nil, err
+		}
+		if height+1 > s.from {
+			s.from = height + 1
+		}
+	}
+	if req.To != "" {
+		t, err := parseStatementTime(req.To, true)
+		if err != nil {
+			return nil, fmt.Errorf("to: %w", err)
+		}
+		height, err := db.HeightAtTime(t)
+		if err != nil {
+			return nil, err
+		}
+		if height < s.to {
+			s.to = height
+		}
+	}
+	return s, nil
+}
+
+// historyCursor 按高度从旧到新遍历一个地址的 tx-address- 记录. key中的高度没有补齐,
+// 位数相同的高度按key的顺序就是按高度的顺序, 所以按位数从少到多各遍历一次, 不需要读入全部记录.
+type historyCursor struct {
+	db        *RawDB
+	prefix    string
+	from, to  int64
+	digits    int
+	maxDigits int
+	iter      iterator.Iterator
+	ref       *walletTxRef
+	err       error
+}
+
+func newHistoryCursor(db *RawDB, address string, from, to int64) *historyCursor {
+	return &historyCursor{
+		db:        db,
+		prefix:    txAddressPrefix + address + "-",
+		from:      from,
+		to:        to,
+		digits:    len(strconv.FormatInt(from, 10)),
+		maxDigits: len(strconv.FormatInt(to, 10)),
+	}
+}
+
+// Next 移到下一条记录, 没有更多记录或出错时返回false
+func (c *historyCursor) Next() bool {
+	for c.err == nil && c.digits <= c.maxDigits {
+		if c.iter == nil {
+			c.iter = c.db.read().NewIterator(util.BytesPrefix([]byte(c.prefix)), nil)
+		}
+		if !c.iter.Next() {
+			c.err = c.iter.Error()
+			c.iter.Release()
+			c.iter = nil
+			c.digits++
+			continue
+		}
+
+		parts := strings.Split(string(c.iter.Key()[len(c.prefix):]), "-")
+		if len(parts) != 3 || len(parts[0]) != c.digits {
+			continue
+		}
+		height, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || height < c.from || height > c.to {
+			continue
+		}
+		c.ref = &walletTxRef{txid: parts[2], height: height}
+		c.ref.time, _ = strconv.ParseInt(parts[1], 10, 64)
+		return true
+	}
+	c.ref = nil
+	return false
+}
+
+func (c *historyCursor) Release() {
+	if c.iter != nil {
+		c.iter.Release()
+		c.iter = nil
+	}
+}
+
+// before 同一区块内与key的顺序相同, 按txid排序
+func (r *walletTxRef) before(o *walletTxRef) bool {
+	if r.height != o.height {
+		return r.height < o.height
+	}
+	return r.txid < o.txid
+}
+
+// Write 合并所有地址的记录, 逐行写出, 同一交易只写一次. 余额从from之前的余额开始累加.
+func (s *statement) Write(w io.Writer) error {
+	balance := int64(0)
+	if s.from > 0 {
+		for _, address := range s.addresses {
+			b, err := s.db.GetBalanceAt(address, s.from-1)
+			if err != nil {
+				return err
+			}
+			balance += int64(toSats(b))
+		}
+	}
+
+	cursors := make([]*historyCursor, 0, len(s.addresses))
+	for _, address := range s.addresses {
+		cursor := newHistoryCursor(s.db, address, s.from, s.to)
+		defer cursor.Release()
+		if cursor.Next() {
+			cursors = append(cursors, cursor)
+		} else if cursor.err != nil {
+			return cursor.err
+		}
+	}
+
+	out := newStatementWriter(s.format, w)
+	if err := out.header(); err != nil {
+		return err
+	}
+	last := ""
+	for len(cursors) > 0 {
+		next := 0
+		for i, cursor := range cursors {
+			if cursor.ref.before(cursors[next].ref) {
+				next = i
+			}
+		}
+		ref := cursors[next].ref
+		if !cursors[next].Next() {
+			if err := cursors[next].err; err != nil {
+				return err
+			}
+			cursors = append(cursors[:next], cursors[next+1:]...)
+		}
+		if ref.txid == last {
+			continue
+		}
+		last = ref.txid
+
+		tx, err := s.db.GetTx(ref.txid)
+		if err != nil {
+			continue
+		}
+		row, delta := s.row(tx, ref)
+		balance += delta
+		row.Balance = float64(balance) / 1e8
+		if err := out.write(row); err != nil {
+			return err
+		}
+	}
+	return out.flush()
+}
+
+// row 计算交易对导出地址的净变化, 对方地址为另一侧不属于导出地址的所有者
+func (s *statement) row(tx *Tx, ref *walletTxRef) (*StatementRow, int64) {
+	received, sent := int64(0), int64(0)
+	for _, vout := range tx.Vouts {
+		if s.owned[vout.Owner()] {
+			received += int64(toSats(vout.Value))
+		}
+	}
+	for _, vin := range tx.Vins {
+		if s.owned[vin.Owner()] {
+			sent += int64(toSats(vin.Value))
+		}
+	}
+	delta := received - sent
+
+	row := &StatementRow{
+		Timestamp:      time.Unix(ref.time, 0).UTC().Format(time.RFC3339),
+		Height:         ref.height,
+		Txid:           ref.txid,
+		Amount:         float64(delta) / 1e8,
+		Counterparties: make([]string, 0),
+	}
+	seen := make(map[string]bool)
+	counterparty := func(owner string) {
+		if !s.owned[owner] && !seen[owner] {
+			seen[owner] = true
+			row.Counterparties = append(row.Counterparties, owner)
+		}
+	}
+	switch {
+	case delta > 0:
+		row.Direction = "in"
+		for _, vin := range tx.Vins {
+			counterparty(vin.Owner())
+		}
+	case delta < 0:
+		row.Direction = "out"
+		for _, vout := range tx.Vouts {
+			counterparty(vout.Owner())
+		}
+	default:
+		row.Direction = "self"
+	}
+	sort.Strings(row.Counterparties)
+
+	if sent > 0 {
+		if fee, ok := txFee(tx.Vins, tx.Vouts); ok {
+			row.Fee = float64(fee) / 1e8
+		}
+	}
+	return row, delta
+}
+
+// statementWriter 按格式写出行, 每statementFlushRows行刷新一次, 输出为HTTP响应时同时推送给客户端
+type statementWriter struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	json   *json.Encoder
+	rows   int
+}
+
+func newStatementWriter(format string, w io.Writer) *statementWriter {
+	out := &statementWriter{format: format, w: w}
+	if format == "csv" {
+		out.csv = csv.NewWriter(w)
+	} else {
+		out.json = json.NewEncoder(w)
+	}
+	return out
+}
+
+func (o *statementWriter) header() error {
+	if o.csv != nil {
+		return o.csv.Write(statementColumns)
+	}
+	return nil
+}
+
+func (o *statementWriter) write(row *StatementRow) error {
+	if o.csv != nil {
+		fee := ""
+		if row.Fee > 0 {
+			fee = strconv.FormatFloat(row.Fee, 'f', 8, 64)
+		}
+		err := o.csv.Write([]string{
+			row.Timestamp,
+			strconv.FormatInt(row.Height, 10),
+			row.Txid,
+			row.Direction,
+			strconv.FormatFloat(row.Amount, 'f', 8, 64),
+			fee,
+			strconv.FormatFloat(row.Balance, 'f', 8, 64),
+			strings.Join(row.Counterparties, ";"),
+		})
+		if err != nil {
+			return err
+		}
+	} else if err := o.json.Encode(row); err != nil {
+		return err
+	}
+
+	o.rows++
+	if o.rows%statementFlushRows == 0 {
+		return o.flush()
+	}
+	return nil
+}
+
+func (o *statementWriter) flush() error {
+	if o.csv != nil {
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestStatement(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	// 高度9到11检查未补齐的高度按数值顺序导出
+	a0 := &Vout{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}
+	applyTestBlock(t, db, 9, []*Tx{{Txid: "A", Vouts: []*Vout{a0}}})
+	db.SetAnchor(&Checkpoint{Height: 9, Hash: "j"})
+	b0 := &Vout{Index: 0, Address: "Y", Value: 30, ScriptHash: "sy"}
+	applyTestBlock(t, db, 10, []*Tx{{Txid: "B", Vins: []*Vin{a0.AsVin("A")}, Vouts: []*Vout{b0, {Index: 1, Address: "X", Value: 19.5, ScriptHash: "sx"}}}})
+	applyTestBlock(t, db, 11, []*Tx{{Txid: "C", Vins: []*Vin{b0.AsVin("B")}, Vouts: []*Vout{{Index: 0, Address: "X", Value: 10, ScriptHash: "sx"}, {Index: 1, Address: "Y", Value: 19.9, ScriptHash: "sy"}}}})
+
+	export := func(req *StatementRequest) string {
+		s, err := prepareStatement(db, nil, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := s.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	want := strings.Join([]string{
+		"timestamp,height,txid,direction,amount,fee,balance,counterparties",
+		"1970-01-01T00:16:49Z,9,A,in,50.00000000,,50.00000000,",
+		"1970-01-01T00:16:50Z,10,B,out,-30.50000000,0.50000000,19.50000000,Y",
+		"1970-01-01T00:16:51Z,11,C,in,10.00000000,,29.50000000,Y",
+	}, "\n") + "\n"
+	if got := export(&StatementRequest{Address: "X"}); got != want {
+		t.Errorf("csv:\n%s\nwant:\n%s", got, want)
+	}
+
+	// 从高度10开始, 余额从高度9之后的余额开始累加
+	got := export(&StatementRequest{Address: "X", Format: "jsonl", FromHeight: 10, To: "1010"})
+	if lines := strings.Split(strings.TrimSpace(got), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `"txid":"B"`) || !strings.Contains(lines[0], `"balance":19.5`) {
+		t.Errorf("jsonl range:\n%s", got)
+	}
+
+	if err := db.SetWallet(&Wallet{Name: "w", Entries: []*WalletEntry{{Address: "X"}, {Address: "Y"}}}); err != nil {
+		t.Fatal(err)
+	}
+	got = export(&StatementRequest{Wallet: "w"})
+	if !strings.Contains(got, "10,B,out,-0.50000000,0.50000000,49.50000000,\n") || strings.Count(got, ",B,") != 1 {
+		t.Errorf("wallet csv:\n%s", got)
+	}
+
+	if _, err := prepareStatement(db, nil, &StatementRequest{Address: "X", Format: "xml"}); err == nil {
+		t.Error("expected unknown format error")
+	}
+}
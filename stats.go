@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	addressStatsPrefix = "addrstats-"
+	richListPrefix     = "richlist-"
+)
+
+// AddressStats 地址的统计, 与 balance- 记录一样按Vout.Owner记录
+type AddressStats struct {
+	Address   string  `json:"address"`
+	FirstSeen int64   `json:"first_seen"`
+	LastSeen  int64   `json:"last_seen"`
+	TxCount   int64   `json:"tx_count"`
+	Received  float64 `json:"received"`
+	Sent      float64 `json:"sent"`
+	UtxoCount int64   `json:"utxo_count"`
+	Balance   float64 `json:"balance"`
+}
+
+type extAddressStats struct {
+	FirstSeen uint64
+	LastSeen  uint64
+	TxCount   uint64
+	Received  []byte
+	Sent      []byte
+	UtxoCount uint64
+}
+
+// DecodeRLP implements rlp.Decoder
+func (a *AddressStats) DecodeRLP(s *rlp.Stream) error {
+	var ext extAddressStats
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	received, err := strconv.ParseFloat(string(ext.Received), 64)
+	if err != nil {
+		return err
+	}
+	sent, err := strconv.ParseFloat(string(ext.Sent), 64)
+	if err != nil {
+		return err
+	}
+	a.FirstSeen = int64(ext.FirstSeen)
+	a.LastSeen = int64(ext.LastSeen)
+	a.TxCount = int64(ext.TxCount)
+	a.Received = received
+	a.Sent = sent
+	a.UtxoCount = int64(ext.UtxoCount)
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (a *AddressStats) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, extAddressStats{
+		FirstSeen: uint64(a.FirstSeen),
+		LastSeen:  uint64(a.LastSeen),
+		TxCount:   uint64(a.TxCount),
+		Received:  []byte(strconv.FormatFloat(a.Received, 'f', 8, 64)),
+		Sent:      []byte(strconv.FormatFloat(a.Sent, 'f', 8, 64)),
+		UtxoCount: uint64(a.UtxoCount),
+	})
+}
+
+// RichEntry 持币排行中的一项
+type RichEntry struct {
+	Rank    int64   `json:"rank"`
+	Address string  `json:"address"`
+	Balance float64 `json:"balance"`
+}
+
+// statsDelta 一个区块对地址统计的改变, 区块写完后合并到 addrstats- 记录
+type statsDelta struct {
+	txs       map[string]bool
+	received  float64
+	sent      float64
+	utxos     int64
+	firstSeen int64
+	lastSeen  int64
+}
+
+func newStatsDelta() *statsDelta {
+	return &statsDelta{txs: make(map[string]bool), firstSeen: math.MaxInt64, lastSeen: -1}
+}
+
+func (d *statsDelta) seen(txid string, height int64) {
+	d.txs[txid] = true
+	if height < d.firstSeen {
+		d.firstSeen = height
+	}
+	if height > d.lastSeen {
+		d.lastSeen = height
+	}
+}
+
+func addressStatsKey(address string) []byte {
+	return []byte(addressStatsPrefix + address)
+}
+
+// richListKey 余额按聪取反后补齐, 按key的顺序就是按余额从大到小的顺序
+func richListKey(address string, balance float64) []byte {
+	sats := uint64(math.Round(balance * 1e8))
+	return []byte(fmt.Sprintf("%s%020d-%s", richListPrefix, math.MaxUint64-sats, address))
+}
+
+// putRichList 把地址在排行索引中的位置从旧余额移到新余额, 余额为0时不在排行中
+func putRichList(batch *leveldb.Batch, address string, old, balance float64) {
+	if old > 0 {
+		batch.Delete(richListKey(address, old))
+	}
+	if balance > 0 {
+		batch.Put(richListKey(address, balance), nil)
+	}
+}
+
+// 获取地址统计, 没有记录时返回零值
+func (d *RawDB) GetAddressStats(address string) (*AddressStats, error) {
+	stats := &AddressStats{}
+	data, err := d.read().Get(addressStatsKey(address), nil)
+	if err == leveldb.ErrNotFound {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := rlp.DecodeBytes(data, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// 合并一个区块的统计变化
+func (d *RawDB) ApplyAddressStats(address string, delta *statsDelta) error {
+	stats, err := d.GetAddressStats(address)
+	if err != nil {
+		return err
+	}
+	if stats.TxCount == 0 || delta.firstSeen < stats.FirstSeen {
+		stats.FirstSeen = delta.firstSeen
+	}
+	if delta.lastSeen > stats.LastSeen {
+		stats.LastSeen = delta.lastSeen
+	}
+	stats.TxCount += int64(len(delta.txs))
+	stats.Received += delta.received
+	stats.Sent += delta.sent
+	stats.UtxoCount += delta.utxos
+
+	data, err := rlp.EncodeToBytes(stats)
+	if err != nil {
+		return err
+	}
+	return d.put(addressStatsKey(address), data)
+}
+
+// GetRichList 按余额从大到小分页返回地址
+func (d *RawDB) GetRichList(limit, offset int64) ([]*RichEntry, error) {
+	iter := d.read().NewIterator(util.BytesPrefix([]byte(richListPrefix)), nil)
+	defer iter.Release()
+
+	entries := make([]*RichEntry, 0)
+	rank := int64(0)
+	for iter.Next() && int64(len(entries)) < limit {
+		rank++
+		if rank <= offset {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(string(iter.Key()), richListPrefix), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		inverted, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &RichEntry{
+			Rank:    rank,
+			Address: parts[1],
+			Balance: float64(math.MaxUint64-inverted) / 1e8,
+		})
+	}
+	return entries, iter.Error()
+}
+
+// rollbackAddressStats 撤销一个区块对地址统计的改变. 撤销后 last_seen 取该地址在更早区块中
+// 最后一次余额变化的高度.
+func rollbackAddressStats(db *RawDB, batch *leveldb.Batch, height int64, deltas map[string]*statsDelta) error {
+	for address, delta := range deltas {
+		stats, err := db.GetAddressStats(address)
+		if err != nil {
+			return err
+		}
+		stats.TxCount -= int64(len(delta.txs))
+		stats.Received -= delta.received
+		stats.Sent -= delta.sent
+		stats.UtxoCount -= delta.utxos
+		if stats.TxCount <= 0 {
+			batch.Delete(addressStatsKey(address))
+			continue
+		}
+
+		if stats.LastSeen >= height {
+			iter := db.DB.NewIterator(&util.Range{
+				Start: []byte(balanceChangePrefix + address + "-"),
+				Limit: balanceChangeKey(address, height),
+			}, nil)
+			if iter.Last() {
+				var change BalanceChange
+				if err := rlp.DecodeBytes(iter.Value(), &change); err == nil {
+					stats.LastSeen = change.Height
+				}
+			}
+			iter.Release()
+		}
+
+		data, err := rlp.EncodeToBytes(stats)
+		if err != nil {
+			return err
+		}
+		batch.Put(addressStatsKey(address), data)
+	}
+	return nil
+}
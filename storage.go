@@ -1,36 +1,204 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/dogecoinw/doged/rpcclient"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
 	blockPrefix     = "block-"
+	blockHashPrefix = "blockhash-"
 	voutPrefix      = "vout-"
 	balancePrefix   = "balance-"
 	utxoPrefix      = "utxo-"
 	txPrefix        = "tx-"
 	txAddressPrefix = "tx-address-"
+	scriptPrefix    = "script-"
+	nullDataPrefix  = "nulldata-"
+	feePrefix       = "fee-"
 )
 
 type RawDB struct {
 	DB   *leveldb.DB
-	Node *rpcclient.Client
+	Node *NodePool
+
+	// reader 不为nil时读取快照, 见 View
+	reader leveldb.Reader
+	// pending 不为nil时写入暂存到一个批次, 见 Begin
+	pending *blockBatch
+
+	mu   sync.Mutex
+	snap *sharedSnapshot
+}
+
+// sharedSnapshot 区块提交时的快照, 最后一个读取者释放后才关闭
+type sharedSnapshot struct {
+	snap  *leveldb.Snapshot
+	refs  int
+	stale bool
 }
 
 func (d *RawDB) Stop() error {
+	d.mu.Lock()
+	if d.snap != nil {
+		d.snap.stale = true
+		if d.snap.refs == 0 {
+			d.snap.snap.Release()
+		}
+		d.snap = nil
+	}
+	d.mu.Unlock()
 	return d.DB.Close()
 }
 
+func (d *RawDB) read() leveldb.Reader {
+	if d.pending != nil {
+		return d.pending
+	}
+	if d.reader != nil {
+		return d.reader
+	}
+	return d.DB
+}
+
+func (d *RawDB) put(key, value []byte) error {
+	if d.pending != nil {
+		d.pending.Put(key, value)
+		return nil
+	}
+	return d.DB.Put(key, value, nil)
+}
+
+func (d *RawDB) delete(key []byte) error {
+	if d.pending != nil {
+		d.pending.Delete(key)
+		return nil
+	}
+	return d.DB.Delete(key, nil)
+}
+
+func (d *RawDB) write(batch *leveldb.Batch) error {
+	if d.pending != nil {
+		return batch.Replay(d.pending)
+	}
+	return d.DB.Write(batch, nil)
+}
+
+func (d *RawDB) has(key []byte) (bool, error) {
+	_, err := d.read().Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Begin 返回把写入暂存到一个批次的RawDB, 读取时先看暂存的写入, 调用 Flush 后一次写入数据库.
+// 扫描一个区块的全部记录和高度在同一个批次中写入, 中途退出不会留下写了一半的区块.
+func (d *RawDB) Begin() *RawDB {
+	return &RawDB{DB: d.DB, Node: d.Node, pending: newBlockBatch(d.read())}
+}
+
+// Flush 把暂存的写入一次写入数据库
+func (d *RawDB) Flush() error {
+	if d.pending == nil {
+		return nil
+	}
+	return d.DB.Write(d.pending.batch, nil)
+}
+
+// blockBatch 暂存的写入. 迭代只读取数据库中已有的记录, 扫描中不需要遍历本区块写入的记录.
+type blockBatch struct {
+	base   leveldb.Reader
+	batch  *leveldb.Batch
+	values map[string][]byte // nil表示已删除
+}
+
+func newBlockBatch(base leveldb.Reader) *blockBatch {
+	return &blockBatch{base: base, batch: new(leveldb.Batch), values: make(map[string][]byte)}
+}
+
+func (b *blockBatch) Put(key, value []byte) {
+	b.batch.Put(key, value)
+	b.values[string(key)] = append([]byte{}, value...)
+}
+
+func (b *blockBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+	b.values[string(key)] = nil
+}
+
+func (b *blockBatch) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if value, ok := b.values[string(key)]; ok {
+		if value == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return value, nil
+	}
+	return b.base.Get(key, ro)
+}
+
+func (b *blockBatch) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return b.base.NewIterator(slice, ro)
+}
+
+// Commit 在一个区块全部写入后调用, 之后的 View 读取到这个区块为止的数据
+func (d *RawDB) Commit() error {
+	snap, err := d.DB.GetSnapshot()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old := d.snap; old != nil {
+		old.stale = true
+		if old.refs == 0 {
+			old.snap.Release()
+		}
+	}
+	d.snap = &sharedSnapshot{snap: snap}
+	return nil
+}
+
+// View 返回读取最近一次提交的快照的RawDB, 用完后调用release.
+// 还没有提交过时先提交当前数据.
+func (d *RawDB) View() (*RawDB, func(), error) {
+	d.mu.Lock()
+	if d.snap == nil {
+		d.mu.Unlock()
+		if err := d.Commit(); err != nil {
+			return nil, nil, err
+		}
+		d.mu.Lock()
+	}
+	shared := d.snap
+	shared.refs++
+	d.mu.Unlock()
+
+	release := func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		shared.refs--
+		if shared.stale && shared.refs == 0 {
+			shared.snap.Release()
+		}
+	}
+	return &RawDB{DB: d.DB, Node: d.Node, reader: shared.snap}, release, nil
+}
+
 // 保存当前高度
 func (d *RawDB) SetHeight(height int64) error {
-	if err := d.DB.Put([]byte("height"), []byte(strconv.FormatInt(height, 10)), nil); err != nil {
+	if err := d.put([]byte("height"), []byte(strconv.FormatInt(height, 10))); err != nil {
 		return err
 	}
 	return nil
@@ -39,7 +207,7 @@ func (d *RawDB) SetHeight(height int64) error {
 // 获取当前高度
 func (d *RawDB) GetHeight() (int64, error) {
 	var height int64
-	if data, err := d.DB.Get([]byte("height"), nil); err != nil {
+	if data, err := d.read().Get([]byte("height"), nil); err != nil {
 		return height, err
 	} else {
 		height, _ = strconv.ParseInt(string(data), 10, 64)
@@ -47,22 +215,42 @@ func (d *RawDB) GetHeight() (int64, error) {
 	return height, nil
 }
 
-// 保存区块信息
-func (d *RawDB) SetBlock(height int64, block *Block) error {
-	if data, err := rlp.EncodeToBytes(block); err != nil {
+// 保存数据库结构版本
+func (d *RawDB) SetSchema(version int64) error {
+	if err := d.put([]byte("schema"), []byte(strconv.FormatInt(version, 10))); err != nil {
 		return err
-	} else {
-		if err := d.DB.Put(blockKey(height), data, nil); err != nil {
-			return err
-		}
 	}
 	return nil
 }
 
+// 获取数据库结构版本, 未记录时为0
+func (d *RawDB) GetSchema() (int64, error) {
+	data, err := d.read().Get([]byte("schema"), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// 保存区块信息, 同时保存哈希到高度的索引
+func (d *RawDB) SetBlock(height int64, block *Block) error {
+	data, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(blockKey(height), data)
+	batch.Put(blockHashKey(block.Hash), []byte(strconv.FormatInt(height, 10)))
+	return d.write(batch)
+}
+
 // 获取区块信息
 func (d *RawDB) GetBlock(height int64) (*Block, error) {
 	var block *Block
-	if data, err := d.DB.Get(blockKey(height), nil); err != nil {
+	if data, err := d.read().Get(blockKey(height), nil); err != nil {
 		return block, err
 	} else {
 		if err := rlp.DecodeBytes(data, &block); err != nil {
@@ -72,9 +260,99 @@ func (d *RawDB) GetBlock(height int64) (*Block, error) {
 	return block, nil
 }
 
+// 根据区块哈希获取区块信息
+func (d *RawDB) GetBlockByHash(hash string) (*Block, error) {
+	data, err := d.read().Get(blockHashKey(hash), nil)
+	if err != nil {
+		return nil, err
+	}
+	height, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetBlock(height)
+}
+
 // 删除区块信息
 func (d *RawDB) DelBlock(height int64) error {
-	return d.DB.Delete(blockKey(height), nil)
+	block, err := d.GetBlock(height)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(blockKey(height))
+	batch.Delete(blockHashKey(block.Hash))
+	return d.write(batch)
+}
+
+// 保存第一个索引的区块, 用于启动时确认节点没有换链
+func (d *RawDB) SetAnchor(anchor *Checkpoint) error {
+	data, err := json.Marshal(anchor)
+	if err != nil {
+		return err
+	}
+	return d.put([]byte("anchor"), data)
+}
+
+// 获取第一个索引的区块
+func (d *RawDB) GetAnchor() (*Checkpoint, error) {
+	data, err := d.read().Get([]byte("anchor"), nil)
+	if err != nil {
+		return nil, err
+	}
+	anchor := &Checkpoint{}
+	if err := json.Unmarshal(data, anchor); err != nil {
+		return nil, err
+	}
+	return anchor, nil
+}
+
+// 获取最近的count个区块, 按高度降序
+func (d *RawDB) GetRecentBlocks(count int64) ([]*Block, error) {
+	height, err := d.GetHeight()
+	if err != nil {
+		return nil, err
+	}
+	var blocks []*Block
+	for h := height; h >= 0 && int64(len(blocks)) < count; h-- {
+		block, err := d.GetBlock(h)
+		if err == leveldb.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// 保存区块手续费统计
+func (d *RawDB) SetBlockFees(fees *BlockFees) error {
+	if data, err := rlp.EncodeToBytes(fees); err != nil {
+		return err
+	} else {
+		if err := d.put(feeKey(int64(fees.Height)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取区块手续费统计
+func (d *RawDB) GetBlockFees(height int64) (*BlockFees, error) {
+	var fees *BlockFees
+	if data, err := d.read().Get(feeKey(height), nil); err != nil {
+		return fees, err
+	} else {
+		if err := rlp.DecodeBytes(data, &fees); err != nil {
+			return fees, err
+		}
+	}
+	return fees, nil
 }
 
 // 保存vout信息
@@ -82,7 +360,7 @@ func (d *RawDB) SetVout(txid string, index uint32, vout *Vout) error {
 	if data, err := rlp.EncodeToBytes(vout); err != nil {
 		return err
 	} else {
-		if err := d.DB.Put(voutKey(txid, index), data, nil); err != nil {
+		if err := d.put(voutKey(txid, index), data); err != nil {
 			return err
 		}
 	}
@@ -92,7 +370,7 @@ func (d *RawDB) SetVout(txid string, index uint32, vout *Vout) error {
 // 获取vout信息
 func (d *RawDB) GetVout(txid string, index uint32) (*Vout, error) {
 	var vout *Vout
-	if data, err := d.DB.Get(voutKey(txid, index), nil); err != nil {
+	if data, err := d.read().Get(voutKey(txid, index), nil); err != nil {
 		return vout, err
 	} else {
 		if err := rlp.DecodeBytes(data, &vout); err != nil {
@@ -102,9 +380,13 @@ func (d *RawDB) GetVout(txid string, index uint32) (*Vout, error) {
 	return vout, nil
 }
 
-// 保存地址余额
+// 保存地址余额, 同时更新持币排行索引
 func (d *RawDB) SetBalance(address string, balance float64) error {
-	if err := d.DB.Put(balanceKey(address), []byte(strconv.FormatFloat(balance, 'f', 8, 64)), nil); err != nil {
+	old, _ := d.GetBalance(address)
+	batch := new(leveldb.Batch)
+	batch.Put(balanceKey(address), []byte(strconv.FormatFloat(balance, 'f', 8, 64)))
+	putRichList(batch, address, old, balance)
+	if err := d.write(batch); err != nil {
 		return err
 	}
 	return nil
@@ -112,7 +394,7 @@ func (d *RawDB) SetBalance(address string, balance float64) error {
 
 // 获取地址余额
 func (d *RawDB) GetBalance(address string) (float64, error) {
-	if data, err := d.DB.Get(balanceKey(address), nil); err != nil {
+	if data, err := d.read().Get(balanceKey(address), nil); err != nil {
 		return 0, err
 	} else {
 		if balance, err := strconv.ParseFloat(string(data), 64); err != nil {
@@ -128,18 +410,48 @@ func (d *RawDB) SetUtxo(address string, txid string, index uint32, vin *Vin) err
 	if data, err := rlp.EncodeToBytes(vin); err != nil {
 		return err
 	} else {
-		if err := d.DB.Put(utxoKey(address, txid, index), data, nil); err != nil {
+		if err := d.put(utxoKey(address, txid, index), data); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// 通过Iterator 获取所有utxo
-func (d *RawDB) GetAllUtxo(address string, amount float64, count, smallChangeF int64) ([]*Vin, float64, error) {
+// UtxoFilter 按确认数筛选utxo, 确认数按已索引的高度计算
+type UtxoFilter struct {
+	Tip      int64 // 已索引的高度
+	MinConf  int64
+	MaxConf  int64 // 0表示不限制
+	Maturity int64 // coinbase输出可花费所需的确认数
+	Immature bool  // 是否返回未成熟的coinbase输出
+}
+
+// Match 判断utxo是否满足筛选条件, 缺少高度的旧记录视为已成熟
+func (f *UtxoFilter) Match(vin *Vin) bool {
+	if f == nil || vin.Legacy() {
+		return true
+	}
+	conf := f.Tip - vin.Height + 1
+	if conf < f.MinConf {
+		return false
+	}
+	if f.MaxConf > 0 && conf > f.MaxConf {
+		return false
+	}
+	if vin.Coinbase && !f.Immature && conf < f.Maturity {
+		return false
+	}
+	return true
+}
+
+// 通过Iterator 获取所有utxo, 前缀带上分隔符, 不会匹配以该地址开头的其他地址
+func (d *RawDB) GetAllUtxo(address string, amount float64, count, smallChangeF int64, filter *UtxoFilter) ([]*Vin, float64, error) {
+	if address == "" {
+		return nil, 0, errors.New("address is required")
+	}
 	var vins []*Vin
-	startKey := []byte(utxoPrefix + address)
-	iter := d.DB.NewIterator(util.BytesPrefix(startKey), nil)
+	startKey := []byte(utxoPrefix + address + "-")
+	iter := d.read().NewIterator(util.BytesPrefix(startKey), nil)
 	temp := float64(0)
 	temp1 := int64(0)
 	for iter.Next() {
@@ -151,6 +463,9 @@ func (d *RawDB) GetAllUtxo(address string, amount float64, count, smallChangeF i
 		if smallChangeF == 1 && vin.Value == 0.001 {
 			continue
 		}
+		if !filter.Match(vin) {
+			continue
+		}
 
 		vins = append(vins, vin)
 
@@ -169,17 +484,102 @@ func (d *RawDB) GetAllUtxo(address string, amount float64, count, smallChangeF i
 
 // 删除utxo
 func (d *RawDB) DelUtxo(address string, txid string, index uint32) error {
-	if err := d.DB.Delete(utxoKey(address, txid, index), nil); err != nil {
+	if err := d.delete(utxoKey(address, txid, index)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 保存输出, 根据脚本哈希
+func (d *RawDB) SetScriptOutput(txid string, vout *Vout) error {
+	if data, err := rlp.EncodeToBytes(vout); err != nil {
 		return err
+	} else {
+		if err := d.put(scriptKey(vout.ScriptHash, txid, vout.Index), data); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// 获取脚本哈希下的所有输出
+func (d *RawDB) GetScriptOutputs(hash string, limit, offset int64) ([]*ScriptOutput, error) {
+	var outputs []*ScriptOutput
+	iter := d.read().NewIterator(util.BytesPrefix([]byte(scriptPrefix+hash+"-")), nil)
+	defer iter.Release()
+
+	temp := int64(0)
+	for iter.Next() {
+		if temp < offset {
+			temp++
+			continue
+		}
+
+		// script-{hash}-{txid}-{index}
+		parts := strings.Split(string(iter.Key()), "-")
+		if len(parts) != 4 {
+			continue
+		}
+
+		var vout *Vout
+		if err := rlp.DecodeBytes(iter.Value(), &vout); err != nil {
+			return outputs, err
+		}
+		outputs = append(outputs, &ScriptOutput{Txid: parts[2], Vout: vout})
+
+		if int64(len(outputs)) >= limit {
+			break
+		}
+	}
+	return outputs, iter.Error()
+}
+
+// 保存OP_RETURN数据
+func (d *RawDB) SetNullData(data []byte, txid string, index uint32, height int64) error {
+	if err := d.put(nullDataKey(hex.EncodeToString(data), txid, index), []byte(strconv.FormatInt(height, 10))); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 按十六进制前缀查询OP_RETURN数据
+func (d *RawDB) GetNullData(prefix string, limit, offset int64) ([]*NullData, error) {
+	var items []*NullData
+	iter := d.read().NewIterator(util.BytesPrefix([]byte(nullDataPrefix+strings.ToLower(prefix))), nil)
+	defer iter.Release()
+
+	temp := int64(0)
+	for iter.Next() {
+		if temp < offset {
+			temp++
+			continue
+		}
+
+		// nulldata-{data}-{txid}-{index}, 空数据时data为空串
+		parts := strings.Split(string(iter.Key()), "-")
+		if len(parts) != 4 {
+			continue
+		}
+		index, _ := strconv.ParseUint(parts[3], 10, 32)
+		height, _ := strconv.ParseInt(string(iter.Value()), 10, 64)
+		items = append(items, &NullData{
+			Txid:   parts[2],
+			Vout:   uint32(index),
+			Height: height,
+			Data:   parts[1],
+		})
+
+		if int64(len(items)) >= limit {
+			break
+		}
+	}
+	return items, iter.Error()
+}
+
 // 保存交易信息, 根据地址
 func (d *RawDB) SetAddressTx(address, txid string, height, time int64) error {
 
-	newkey := []byte("tx-address-" + address + "-" + strconv.FormatInt(height, 10) + "-" + strconv.FormatInt(time, 10) + "-" + txid)
-	if err := d.DB.Put(newkey, []byte{0}, nil); err != nil {
+	if err := d.put(addressTxKey(address, txid, height, time), []byte{0}); err != nil {
 		return err
 	}
 	return nil
@@ -187,11 +587,11 @@ func (d *RawDB) SetAddressTx(address, txid string, height, time int64) error {
 
 // 获取
 func (d *RawDB) GetAddressTxs(address string, limit, offset int64) ([]*Tx, int8, error) {
-	
+
 	var txs []*Tx
 	startKey := []byte(txAddressPrefix + address)
 
-	iter := d.DB.NewIterator(util.BytesPrefix(startKey), nil)
+	iter := d.read().NewIterator(util.BytesPrefix(startKey), nil)
 
 	temp := int64(0)
 	temp1 := int64(0)
@@ -235,7 +635,7 @@ func (d *RawDB) SetTx(tx *Tx) error {
 	if data, err := rlp.EncodeToBytes(tx); err != nil {
 		return err
 	} else {
-		if err := d.DB.Put(txKey(tx.Txid), data, nil); err != nil {
+		if err := d.put(txKey(tx.Txid), data); err != nil {
 			return err
 		}
 	}
@@ -245,7 +645,7 @@ func (d *RawDB) SetTx(tx *Tx) error {
 // 获取交易信息
 func (d *RawDB) GetTx(txid string) (*Tx, error) {
 	var tx *Tx
-	if data, err := d.DB.Get(txKey(txid), nil); err != nil {
+	if data, err := d.read().Get(txKey(txid), nil); err != nil {
 		return tx, err
 	} else {
 		if err := rlp.DecodeBytes(data, &tx); err != nil {
@@ -257,7 +657,7 @@ func (d *RawDB) GetTx(txid string) (*Tx, error) {
 
 // txreload
 func (d *RawDB) SetTxReload(address string, state uint8) error {
-	if err := d.DB.Put(txReloadKey(address), []byte{state}, nil); err != nil {
+	if err := d.put(txReloadKey(address), []byte{state}); err != nil {
 		return err
 	}
 	return nil
@@ -265,7 +665,7 @@ func (d *RawDB) SetTxReload(address string, state uint8) error {
 
 // 获取txreload
 func (d *RawDB) GetTxReload(address string) (uint8, error) {
-	if data, err := d.DB.Get(txReloadKey(address), nil); err != nil {
+	if data, err := d.read().Get(txReloadKey(address), nil); err != nil {
 		return 0, nil
 	} else {
 		return data[0], nil
@@ -277,6 +677,14 @@ func blockKey(height int64) []byte {
 	return []byte(blockPrefix + strconv.FormatInt(height, 10))
 }
 
+func blockHashKey(hash string) []byte {
+	return []byte(blockHashPrefix + hash)
+}
+
+func feeKey(height int64) []byte {
+	return []byte(feePrefix + strconv.FormatInt(height, 10))
+}
+
 func voutKey(txid string, index uint32) []byte {
 	return []byte(voutPrefix + txid + "-" + strconv.FormatUint(uint64(index), 10))
 }
@@ -297,6 +705,18 @@ func txAddressKey(address, txid string) []byte {
 	return []byte(txAddressPrefix + address + "-" + txid)
 }
 
+func addressTxKey(address, txid string, height, time int64) []byte {
+	return []byte(txAddressPrefix + address + "-" + strconv.FormatInt(height, 10) + "-" + strconv.FormatInt(time, 10) + "-" + txid)
+}
+
+func scriptKey(hash, txid string, index uint32) []byte {
+	return []byte(scriptPrefix + hash + "-" + txid + "-" + strconv.FormatUint(uint64(index), 10))
+}
+
+func nullDataKey(data, txid string, index uint32) []byte {
+	return []byte(nullDataPrefix + data + "-" + txid + "-" + strconv.FormatUint(uint64(index), 10))
+}
+
 // txreloadKey
 func txReloadKey(address string) []byte {
 	return []byte("-reload" + address)
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestUtxoFilter(t *testing.T) {
+	filter := &UtxoFilter{Tip: 1000, MinConf: 2, Maturity: 100}
+
+	cases := []struct {
+		vin  *Vin
+		want bool
+	}{
+		{&Vin{Height: 1000, version: recordVersion}, false},
+		{&Vin{Height: 999, version: recordVersion}, true},
+		{&Vin{Height: 950, Coinbase: true, version: recordVersion}, false},
+		{&Vin{Height: 901, Coinbase: true, version: recordVersion}, true},
+		{&Vin{Height: 1000}, true},
+	}
+	for i, c := range cases {
+		if got := filter.Match(c.vin); got != c.want {
+			t.Errorf("case %d: got %v, want %v", i, got, c.want)
+		}
+	}
+
+	filter.Immature = true
+	filter.MaxConf = 10
+	if !filter.Match(&Vin{Height: 995, Coinbase: true, version: recordVersion}) {
+		t.Error("immature coinbase excluded with include_immature")
+	}
+	if filter.Match(&Vin{Height: 900, version: recordVersion}) {
+		t.Error("utxo deeper than max_conf returned")
+	}
+}
+
+func TestBlockBatch(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	db.SetUtxo("X", "A", 0, &Vin{Txid: "A", Address: "X", Value: 1})
+	db.SetHeight(4)
+
+	block := db.Begin()
+	block.SetBalance("X", 2)
+	block.DelUtxo("X", "A", 0)
+	block.SetHeight(5)
+
+	// 暂存的写入只有批次自己能读到
+	if balance, err := block.GetBalance("X"); err != nil || balance != 2 {
+		t.Errorf("pending balance %v, %v", balance, err)
+	}
+	if ok, _ := block.has(utxoKey("X", "A", 0)); ok {
+		t.Error("deleted utxo still visible in batch")
+	}
+	if height, _ := db.GetHeight(); height != 4 {
+		t.Errorf("height %d written before flush", height)
+	}
+	if _, err := db.GetBalance("X"); err != leveldb.ErrNotFound {
+		t.Errorf("balance written before flush: %v", err)
+	}
+
+	if err := block.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := db.GetHeight(); height != 5 {
+		t.Errorf("height %d after flush", height)
+	}
+	if ok, _ := db.has(utxoKey("X", "A", 0)); ok {
+		t.Error("utxo not deleted after flush")
+	}
+}
@@ -1,85 +1,314 @@
 package main
 
 import (
-	"github.com/ethereum/go-ethereum/rlp"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"strconv"
+
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// recordVersion Vin和Vout记录的编码版本, 仍然可以读取版本0的旧记录
+const recordVersion = 1
+
 type Vin struct {
-	Txid    string  `json:"txid"`
-	Vout    uint32  `json:"vout"`
-	Address string  `json:"address"`
-	Value   float64 `json:"value"`
+	Txid       string  `json:"txid"`
+	Vout       uint32  `json:"vout"`
+	Address    string  `json:"address"`
+	Value      float64 `json:"value"`
+	ScriptHash string  `json:"script_hash"`
+	Script     string  `json:"script"`
+	Class      string  `json:"class"`
+	Height     int64   `json:"height"`
+	Coinbase   bool    `json:"coinbase"`
+
+	version uint64
 }
 
 type extVin struct {
-	Txid    string `json:"txid"`
-	Vout    uint32 `json:"vout"`
-	Address string `json:"address"`
-	Value   []byte `json:"value"`
+	Txid       string `json:"txid"`
+	Vout       uint32 `json:"vout"`
+	Address    string `json:"address"`
+	Value      []byte `json:"value"`
+	ScriptHash string `json:"script_hash" rlp:"optional"`
+}
+
+type extVinV1 struct {
+	Txid       string
+	Vout       uint32
+	Address    string
+	Value      []byte
+	ScriptHash string
+	Script     []byte
+	Class      string
+	Height     uint64
+	Coinbase   bool
 }
 
 func (v *Vin) DecodeRLP(s *rlp.Stream) error {
-	var ext extVin
-	if err := s.Decode(&ext); err != nil {
+	raw, err := s.Raw()
+	if err != nil {
+		return err
+	}
+	version, body, err := splitVersioned(raw)
+	if err != nil {
 		return err
 	}
-	v.Txid = ext.Txid
-	v.Vout = ext.Vout
-	v.Address = ext.Address
-	value, err := strconv.ParseFloat(string(ext.Value), 64)
+
+	var value []byte
+	switch version {
+	case 0:
+		var ext extVin
+		if err := rlp.DecodeBytes(body, &ext); err != nil {
+			return err
+		}
+		v.Txid = ext.Txid
+		v.Vout = ext.Vout
+		v.Address = ext.Address
+		v.ScriptHash = ext.ScriptHash
+		value = ext.Value
+	case 1:
+		var ext extVinV1
+		if err := rlp.DecodeBytes(body, &ext); err != nil {
+			return err
+		}
+		v.Txid = ext.Txid
+		v.Vout = ext.Vout
+		v.Address = ext.Address
+		v.ScriptHash = ext.ScriptHash
+		v.Script = hex.EncodeToString(ext.Script)
+		v.Class = ext.Class
+		v.Height = int64(ext.Height)
+		v.Coinbase = ext.Coinbase
+		value = ext.Value
+	default:
+		return fmt.Errorf("unknown vin record version %d", version)
+	}
+	v.version = version
+
+	parsed, err := strconv.ParseFloat(string(value), 64)
 	if err != nil {
-		value = 0
+		parsed = 0
 	}
-	v.Value = value
+	v.Value = parsed
 	return nil
 }
 
 func (v *Vin) EncodeRLP(w io.Writer) error {
+	script, err := hex.DecodeString(v.Script)
+	if err != nil {
+		return err
+	}
 	value := []byte(strconv.FormatFloat(v.Value, 'f', 8, 64))
-	return rlp.Encode(w, extVin{
-		Txid:    v.Txid,
-		Vout:    v.Vout,
-		Address: v.Address,
-		Value:   value,
-	})
+	return rlp.Encode(w, []interface{}{uint64(recordVersion), extVinV1{
+		Txid:       v.Txid,
+		Vout:       v.Vout,
+		Address:    v.Address,
+		Value:      value,
+		ScriptHash: v.ScriptHash,
+		Script:     script,
+		Class:      v.Class,
+		Height:     uint64(v.Height),
+		Coinbase:   v.Coinbase,
+	}})
+}
+
+// Legacy 旧编码的记录, 没有脚本、高度和coinbase标记
+func (v *Vin) Legacy() bool {
+	return v.version < recordVersion
+}
+
+// Owner 金额记在哪个地址或脚本哈希下
+func (v *Vin) Owner() string {
+	if v.Address != "" {
+		return v.Address
+	}
+	return v.ScriptHash
 }
 
+// Vout 已索引的输出. 只有单密钥脚本有Address, 其他输出记在ScriptHash下, 脚本涉及的地址在Addresses中
 type Vout struct {
-	Index   uint32  `json:"index"`
-	Address string  `json:"address"`
-	Value   float64 `json:"value"`
+	Index      uint32   `json:"index"`
+	Address    string   `json:"address"`
+	Value      float64  `json:"value"`
+	ScriptHash string   `json:"script_hash"`
+	Class      string   `json:"class"`
+	Addresses  []string `json:"addresses"`
+	Script     string   `json:"script"`
+	Height     int64    `json:"height"`
+	Coinbase   bool     `json:"coinbase"`
+
+	version uint64
 }
 
 type extVout struct {
-	Index   uint32 `json:"index"`
-	Address string `json:"address"`
-	Value   []byte `json:"value"`
+	Index      uint32   `json:"index"`
+	Address    string   `json:"address"`
+	Value      []byte   `json:"value"`
+	ScriptHash string   `json:"script_hash" rlp:"optional"`
+	Class      string   `json:"class" rlp:"optional"`
+	Addresses  []string `json:"addresses" rlp:"optional"`
+}
+
+type extVoutV1 struct {
+	Index      uint32
+	Address    string
+	Value      []byte
+	ScriptHash string
+	Class      string
+	Addresses  []string
+	Script     []byte
+	Height     uint64
+	Coinbase   bool
 }
 
 func (v *Vout) DecodeRLP(s *rlp.Stream) error {
-	var ext extVout
-	if err := s.Decode(&ext); err != nil {
+	raw, err := s.Raw()
+	if err != nil {
 		return err
 	}
-	v.Index = ext.Index
-	v.Address = ext.Address
-	value, err := strconv.ParseFloat(string(ext.Value), 64)
+	version, body, err := splitVersioned(raw)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	switch version {
+	case 0:
+		var ext extVout
+		if err := rlp.DecodeBytes(body, &ext); err != nil {
+			return err
+		}
+		v.Index = ext.Index
+		v.Address = ext.Address
+		v.ScriptHash = ext.ScriptHash
+		v.Class = ext.Class
+		v.Addresses = ext.Addresses
+		value = ext.Value
+	case 1:
+		var ext extVoutV1
+		if err := rlp.DecodeBytes(body, &ext); err != nil {
+			return err
+		}
+		v.Index = ext.Index
+		v.Address = ext.Address
+		v.ScriptHash = ext.ScriptHash
+		v.Class = ext.Class
+		v.Addresses = ext.Addresses
+		v.Script = hex.EncodeToString(ext.Script)
+		v.Height = int64(ext.Height)
+		v.Coinbase = ext.Coinbase
+		value = ext.Value
+	default:
+		return fmt.Errorf("unknown vout record version %d", version)
+	}
+	v.version = version
+
+	parsed, err := strconv.ParseFloat(string(value), 64)
 	if err != nil {
-		value = 0
+		parsed = 0
 	}
-	v.Value = value
+	v.Value = parsed
 	return nil
 }
 
 func (v *Vout) EncodeRLP(w io.Writer) error {
+	script, err := hex.DecodeString(v.Script)
+	if err != nil {
+		return err
+	}
 	value := []byte(strconv.FormatFloat(v.Value, 'f', 8, 64))
-	return rlp.Encode(w, extVout{
-		Index:   v.Index,
-		Address: v.Address,
-		Value:   value,
-	})
+	return rlp.Encode(w, []interface{}{uint64(recordVersion), extVoutV1{
+		Index:      v.Index,
+		Address:    v.Address,
+		Value:      value,
+		ScriptHash: v.ScriptHash,
+		Class:      v.Class,
+		Addresses:  v.Addresses,
+		Script:     script,
+		Height:     uint64(v.Height),
+		Coinbase:   v.Coinbase,
+	}})
+}
+
+// Legacy 旧编码的记录, 没有脚本、高度和coinbase标记
+func (v *Vout) Legacy() bool {
+	return v.version < recordVersion
+}
+
+// Owner 金额记在哪个地址或脚本哈希下
+func (v *Vout) Owner() string {
+	if v.Address != "" {
+		return v.Address
+	}
+	return v.ScriptHash
+}
+
+// Owners 交易历史中包含该输出的地址: Owner和多签脚本的每个地址
+func (v *Vout) Owners() []string {
+	owners := []string{v.Owner()}
+	for _, addr := range v.Addresses {
+		if addr != v.Address {
+			owners = append(owners, addr)
+		}
+	}
+	return owners
+}
+
+// AsVin 转换为utxo记录, 也是花费交易中的输入记录
+func (v *Vout) AsVin(txid string) *Vin {
+	return &Vin{
+		Txid:       txid,
+		Vout:       v.Index,
+		Address:    v.Address,
+		Value:      v.Value,
+		ScriptHash: v.ScriptHash,
+		Script:     v.Script,
+		Class:      v.Class,
+		Height:     v.Height,
+		Coinbase:   v.Coinbase,
+	}
+}
+
+// splitVersioned 拆分 [version, [fields...]] 格式的记录, 版本0的记录没有版本号, 原样返回
+func splitVersioned(raw []byte) (uint64, []byte, error) {
+	content, _, err := rlp.SplitList(raw)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, _, rest, err := rlp.Split(content)
+	if err != nil {
+		return 0, nil, err
+	}
+	kind, _, _, err := rlp.Split(rest)
+	if err != nil || kind != rlp.List {
+		return 0, raw, nil
+	}
+
+	version, rest, err := rlp.SplitUint64(content)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, _, tail, err := rlp.Split(rest)
+	if err != nil {
+		return 0, nil, err
+	}
+	return version, rest[:len(rest)-len(tail)], nil
+}
+
+// ScriptOutput 按脚本哈希索引查到的输出
+type ScriptOutput struct {
+	Txid string `json:"txid"`
+	*Vout
+}
+
+// NullData 按nulldata索引查到的OP_RETURN数据
+type NullData struct {
+	Txid   string `json:"txid"`
+	Vout   uint32 `json:"vout"`
+	Height int64  `json:"height"`
+	Data   string `json:"data"`
 }
 
 type Tx struct {
@@ -114,35 +343,116 @@ func (t *Tx) EncodeRLP(w io.Writer) error {
 }
 
 // Block represents a block in the blockchain
+// 只保存区块头和txid, 交易保存在 tx- 记录中
 type Block struct {
-	Height int64  `json:"height"`
-	Hash   string `json:"hash"`
-	Tx     []*Tx  `json:"tx"`
+	Height       int64    `json:"height"`
+	Hash         string   `json:"hash"`
+	PreviousHash string   `json:"previous_hash"`
+	MerkleRoot   string   `json:"merkle_root"`
+	Version      int32    `json:"version"`
+	Time         int64    `json:"time"`
+	Bits         string   `json:"bits"`
+	Nonce        uint32   `json:"nonce"`
+	Size         int32    `json:"size"`
+	TxCount      int      `json:"tx_count"`
+	Chainwork    string   `json:"chainwork"`
+	Txids        []string `json:"-"`
+}
+
+type extBlock struct {
+	Height       uint64
+	Hash         string
+	PreviousHash string
+	MerkleRoot   string
+	Version      uint32
+	Time         uint64
+	Bits         string
+	Nonce        uint32
+	Size         uint32
+	Txids        []string
+	Chainwork    string `rlp:"optional"`
 }
 
 // DecodeRLP implements rlp.Decoder
 func (b *Block) DecodeRLP(s *rlp.Stream) error {
-	var data []interface{}
-	if err := s.Decode(&data); err != nil {
+	var eb extBlock
+	if err := s.Decode(&eb); err != nil {
 		return err
 	}
-	b.Height = data[0].(int64)
-	b.Hash = data[1].(string)
-	for _, v := range data[2].([]interface{}) {
-		tx := &Tx{}
-		if err := tx.DecodeRLP(rlp.NewStream(v.(io.Reader), 0)); err != nil {
-			return err
-		}
-		b.Tx = append(b.Tx, tx)
-	}
+	b.Height = int64(eb.Height)
+	b.Hash = eb.Hash
+	b.PreviousHash = eb.PreviousHash
+	b.MerkleRoot = eb.MerkleRoot
+	b.Version = int32(eb.Version)
+	b.Time = int64(eb.Time)
+	b.Bits = eb.Bits
+	b.Nonce = eb.Nonce
+	b.Size = int32(eb.Size)
+	b.Txids = eb.Txids
+	b.TxCount = len(eb.Txids)
+	b.Chainwork = eb.Chainwork
 	return nil
 }
 
 // EncodeRLP implements rlp.Encoder
 func (b *Block) EncodeRLP(w io.Writer) error {
-	var txs []interface{}
-	for _, v := range b.Tx {
-		txs = append(txs, v)
+	return rlp.Encode(w, extBlock{
+		Height:       uint64(b.Height),
+		Hash:         b.Hash,
+		PreviousHash: b.PreviousHash,
+		MerkleRoot:   b.MerkleRoot,
+		Version:      uint32(b.Version),
+		Time:         uint64(b.Time),
+		Bits:         b.Bits,
+		Nonce:        b.Nonce,
+		Size:         uint32(b.Size),
+		Txids:        b.Txids,
+		Chainwork:    b.Chainwork,
+	})
+}
+
+// BalanceChange 地址在一个区块中的余额变化和区块之后的余额
+type BalanceChange struct {
+	Height  int64   `json:"height"`
+	Time    int64   `json:"time"`
+	Delta   float64 `json:"delta"`
+	Balance float64 `json:"balance"`
+}
+
+type extBalanceChange struct {
+	Height  uint64
+	Time    uint64
+	Delta   []byte
+	Balance []byte
+}
+
+// DecodeRLP implements rlp.Decoder
+func (b *BalanceChange) DecodeRLP(s *rlp.Stream) error {
+	var ext extBalanceChange
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	delta, err := strconv.ParseFloat(string(ext.Delta), 64)
+	if err != nil {
+		return err
+	}
+	balance, err := strconv.ParseFloat(string(ext.Balance), 64)
+	if err != nil {
+		return err
 	}
-	return rlp.Encode(w, []interface{}{b.Height, b.Hash, txs})
+	b.Height = int64(ext.Height)
+	b.Time = int64(ext.Time)
+	b.Delta = delta
+	b.Balance = balance
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (b *BalanceChange) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, extBalanceChange{
+		Height:  uint64(b.Height),
+		Time:    uint64(b.Time),
+		Delta:   []byte(strconv.FormatFloat(b.Delta, 'f', 8, 64)),
+		Balance: []byte(strconv.FormatFloat(b.Balance, 'f', 8, 64)),
+	})
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestVoutDecodeLegacy(t *testing.T) {
+	// 旧版本记录只有 index/address/value 三个字段
+	data, err := rlp.EncodeToBytes(extVout{
+		Index:   1,
+		Address: "D7EHnqQ3asCiShoDfJWigr7j489ES8HVCi",
+		Value:   []byte("17.88319000"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vout *Vout
+	if err := rlp.DecodeBytes(data, &vout); err != nil {
+		t.Fatal(err)
+	}
+	if vout.Owner() != "D7EHnqQ3asCiShoDfJWigr7j489ES8HVCi" || vout.Value != 17.88319 {
+		t.Errorf("unexpected vout %+v", vout)
+	}
+}
+
+func TestVoutMultisigOwners(t *testing.T) {
+	vout := &Vout{
+		Index:      0,
+		Value:      1,
+		ScriptHash: "ab",
+		Class:      "multisig",
+		Addresses:  []string{"A", "B"},
+	}
+	data, err := rlp.EncodeToBytes(vout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded *Vout
+	if err := rlp.DecodeBytes(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	owners := decoded.Owners()
+	if len(owners) != 3 || owners[0] != "ab" || owners[1] != "A" || owners[2] != "B" {
+		t.Errorf("unexpected owners %v", owners)
+	}
+}
+
+func TestNullData(t *testing.T) {
+	data, ok := nullData([]byte{0x6a, 0x03, 'f', 'o', 'o'})
+	if !ok || string(data) != "foo" {
+		t.Errorf("unexpected payload %q %v", data, ok)
+	}
+	if _, ok := nullData([]byte{0x76, 0xa9}); ok {
+		t.Error("non OP_RETURN script reported as nulldata")
+	}
+}
+
+func TestVoutRoundTrip(t *testing.T) {
+	vout := &Vout{
+		Index:      2,
+		Address:    "D7EHnqQ3asCiShoDfJWigr7j489ES8HVCi",
+		Value:      0.5,
+		ScriptHash: "ab",
+		Class:      "pubkeyhash",
+		Addresses:  []string{"D7EHnqQ3asCiShoDfJWigr7j489ES8HVCi"},
+		Script:     "76a914000000000000000000000000000000000000000088ac",
+		Height:     4000000,
+		Coinbase:   true,
+	}
+	data, err := rlp.EncodeToBytes(vout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded *Vout
+	if err := rlp.DecodeBytes(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Legacy() {
+		t.Error("new record decoded as legacy")
+	}
+	if decoded.Script != vout.Script || decoded.Height != vout.Height || !decoded.Coinbase || decoded.Value != vout.Value {
+		t.Errorf("unexpected vout %+v", decoded)
+	}
+
+	vin := decoded.AsVin("00")
+	if data, err = rlp.EncodeToBytes(vin); err != nil {
+		t.Fatal(err)
+	}
+	var decodedVin *Vin
+	if err := rlp.DecodeBytes(data, &decodedVin); err != nil {
+		t.Fatal(err)
+	}
+	if decodedVin.Script != vout.Script || decodedVin.Height != vout.Height || !decodedVin.Coinbase {
+		t.Errorf("unexpected vin %+v", decodedVin)
+	}
+}
+
+func TestVinDecodeLegacy(t *testing.T) {
+	data, err := rlp.EncodeToBytes(extVin{
+		Txid:    "6f7cf9580f1c2dfb3c4d5d043cdbb128c640e3f20161245aa7372e9666168516",
+		Vout:    3,
+		Address: "D7EHnqQ3asCiShoDfJWigr7j489ES8HVCi",
+		Value:   []byte("1.00000000"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vin *Vin
+	if err := rlp.DecodeBytes(data, &vin); err != nil {
+		t.Fatal(err)
+	}
+	if !vin.Legacy() || vin.Vout != 3 || vin.Value != 1 {
+		t.Errorf("unexpected vin %+v", vin)
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	block := &Block{
+		Height:       5000000,
+		Hash:         "b1",
+		PreviousHash: "b0",
+		MerkleRoot:   "m",
+		Version:      6422788,
+		Time:         1700000000,
+		Bits:         "1a01a5f2",
+		Nonce:        7,
+		Size:         1234,
+		Txids:        []string{"t1", "t2"},
+	}
+	data, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded *Block
+	if err := rlp.DecodeBytes(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Height != block.Height || decoded.PreviousHash != "b0" || decoded.TxCount != 2 || decoded.Txids[1] != "t2" {
+		t.Errorf("unexpected block %+v", decoded)
+	}
+}
+
+func TestMigrateLegacyTx(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	// 交易记录中的输入和输出仍是旧格式, 对应的 vout- 记录已经补齐
+	data, err := rlp.EncodeToBytes([]interface{}{
+		"T",
+		[]extVin{{Txid: "F", Vout: 0, Address: "X", Value: []byte("2.00000000")}},
+		[]extVout{{Index: 0, Address: "Y", Value: []byte("1.00000000")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Put(txKey("T"), data, nil)
+	db.SetVout("F", 0, &Vout{Index: 0, Address: "X", Value: 2, ScriptHash: "sx", Script: "51", Height: 7})
+	db.SetVout("T", 0, &Vout{Index: 0, Address: "Y", Value: 1, ScriptHash: "sy", Script: "52", Height: 9})
+	db.SetAddressTx("Y", "T", 9, 1000)
+
+	if err := migrateLegacyRecords(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.GetTx("T")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Vins[0].Legacy() || tx.Vins[0].Height != 7 || tx.Vins[0].Script != "51" {
+		t.Errorf("vin %+v", tx.Vins[0])
+	}
+	if tx.Vouts[0].Legacy() || tx.Vouts[0].Height != 9 {
+		t.Errorf("vout %+v", tx.Vouts[0])
+	}
+}
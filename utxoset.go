@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/dogecoinw/doged/chaincfg/chainhash"
+	"github.com/dogecoinw/doged/wire"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	utxoSetKey    = "utxoset"
+	utxoAgePrefix = "utxoage-"
+
+	// utxoAgeBucket 按创建高度分组的区块数
+	utxoAgeBucket = 100
+)
+
+// valueBuckets 金额分组的上限(聪), 最后一组没有上限
+var valueBuckets = []uint64{1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12}
+
+// ageBuckets 年龄分组的上限(区块数), 最后一组没有上限
+var ageBuckets = []int64{100, 1000, 10000, 100000}
+
+// UtxoSet is the running summary of the whole UTXO set: count, supply in
+// satoshis, counts and amounts per value bucket and the MuHash of all coins.
+type UtxoSet struct {
+	Height      int64
+	Count       uint64
+	Supply      uint64
+	ValueCounts []uint64
+	ValueSats   []uint64
+
+	muhash *MuHash
+	ages   map[int64]*utxoAge
+}
+
+type extUtxoSet struct {
+	Height      uint64
+	Count       uint64
+	Supply      uint64
+	ValueCounts []uint64
+	ValueSats   []uint64
+	Numerator   []byte
+	Denominator []byte
+}
+
+// utxoAge 一组创建高度内的utxo
+type utxoAge struct {
+	Count uint64
+	Sats  uint64
+}
+
+func newUtxoSet() *UtxoSet {
+	return &UtxoSet{
+		ValueCounts: make([]uint64, len(valueBuckets)+1),
+		ValueSats:   make([]uint64, len(valueBuckets)+1),
+		muhash:      NewMuHash(),
+		ages:        make(map[int64]*utxoAge),
+	}
+}
+
+// DecodeRLP implements rlp.Decoder
+func (u *UtxoSet) DecodeRLP(s *rlp.Stream) error {
+	var ext extUtxoSet
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	*u = *newUtxoSet()
+	u.Height = int64(ext.Height)
+	u.Count = ext.Count
+	u.Supply = ext.Supply
+	copy(u.ValueCounts, ext.ValueCounts)
+	copy(u.ValueSats, ext.ValueSats)
+	u.muhash = muHashFromBytes(ext.Numerator, ext.Denominator)
+	return nil
+}
+
+// EncodeRLP implements rlp.Encoder
+func (u *UtxoSet) EncodeRLP(w io.Writer) error {
+	numerator, denominator := u.muhash.Bytes()
+	return rlp.Encode(w, extUtxoSet{
+		Height:      uint64(u.Height),
+		Count:       u.Count,
+		Supply:      u.Supply,
+		ValueCounts: u.ValueCounts,
+		ValueSats:   u.ValueSats,
+		Numerator:   numerator,
+		Denominator: denominator,
+	})
+}
+
+func toSats(value float64) uint64 {
+	return uint64(math.Round(value * 1e8))
+}
+
+func valueBucket(sats uint64) int {
+	for i, limit := range valueBuckets {
+		if sats < limit {
+			return i
+		}
+	}
+	return len(valueBuckets)
+}
+
+// coinElement 与Bitcoin Core计算utxo集合MuHash时相同的序列化:
+// outpoint, height*2+coinbase, value, script
+func coinElement(coin *Vin) ([]byte, error) {
+	hash, err := chainhash.NewHashFromStr(coin.Txid)
+	if err != nil {
+		return nil, err
+	}
+	script, err := hex.DecodeString(coin.Script)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(hash[:])
+	binary.Write(&buf, binary.LittleEndian, coin.Vout)
+	code := uint32(coin.Height) << 1
+	if coin.Coinbase {
+		code |= 1
+	}
+	binary.Write(&buf, binary.LittleEndian, code)
+	binary.Write(&buf, binary.LittleEndian, int64(toSats(coin.Value)))
+	if err := wire.WriteVarBytes(&buf, 0, script); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Add 加入一个新的utxo
+func (u *UtxoSet) Add(coin *Vin) error {
+	element, err := coinElement(coin)
+	if err != nil {
+		return err
+	}
+	u.muhash.Insert(element)
+
+	sats := toSats(coin.Value)
+	bucket := valueBucket(sats)
+	u.Count++
+	u.Supply += sats
+	u.ValueCounts[bucket]++
+	u.ValueSats[bucket] += sats
+
+	age := u.age(coin.Height)
+	age.Count++
+	age.Sats += sats
+	return nil
+}
+
+// Spend 移除一个被花费的utxo
+func (u *UtxoSet) Spend(coin *Vin) error {
+	element, err := coinElement(coin)
+	if err != nil {
+		return err
+	}
+	u.muhash.Remove(element)
+
+	sats := toSats(coin.Value)
+	bucket := valueBucket(sats)
+	u.Count--
+	u.Supply -= sats
+	u.ValueCounts[bucket]--
+	u.ValueSats[bucket] -= sats
+
+	age := u.age(coin.Height)
+	age.Count--
+	age.Sats -= sats
+	return nil
+}
+
+// age 返回本次修改的创建高度分组, 保存时与数据库中的记录合并
+func (u *UtxoSet) age(height int64) *utxoAge {
+	start := height - height%utxoAgeBucket
+	if u.ages[start] == nil {
+		u.ages[start] = &utxoAge{}
+	}
+	return u.ages[start]
+}
+
+func utxoAgeKey(start int64) []byte {
+	return []byte(fmt.Sprintf("%s%012d", utxoAgePrefix, start))
+}
+
+// GetUtxoSet 读取utxo集合统计, 没有记录时返回空集合
+func (d *RawDB) GetUtxoSet() (*UtxoSet, error) {
+	data, err := d.read().Get([]byte(utxoSetKey), nil)
+	if err == leveldb.ErrNotFound {
+		return newUtxoSet(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	set := newUtxoSet()
+	if err := rlp.DecodeBytes(data, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// writeUtxoSet 把统计和本次修改的年龄分组写入batch
+func (d *RawDB) writeUtxoSet(batch *leveldb.Batch, set *UtxoSet) error {
+	data, err := rlp.EncodeToBytes(set)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(utxoSetKey), data)
+
+	for start, delta := range set.ages {
+		age := &utxoAge{}
+		if data, err := d.read().Get(utxoAgeKey(start), nil); err == nil {
+			if err := rlp.DecodeBytes(data, age); err != nil {
+				return err
+			}
+		}
+		// 计数用无符号数, 花费时的减法会回绕, 相加后得到正确的结果
+		age.Count += delta.Count
+		age.Sats += delta.Sats
+		if age.Count == 0 {
+			batch.Delete(utxoAgeKey(start))
+			continue
+		}
+		data, err := rlp.EncodeToBytes(age)
+		if err != nil {
+			return err
+		}
+		batch.Put(utxoAgeKey(start), data)
+	}
+	set.ages = make(map[int64]*utxoAge)
+	return nil
+}
+
+// SetUtxoSet 保存utxo集合统计
+func (d *RawDB) SetUtxoSet(set *UtxoSet) error {
+	batch := new(leveldb.Batch)
+	if err := d.writeUtxoSet(batch, set); err != nil {
+		return err
+	}
+	return d.write(batch)
+}
+
+// UtxoSetBucket 统计中的一组
+type UtxoSetBucket struct {
+	Below  interface{} `json:"below"` // 上限, 最后一组为null
+	Count  uint64      `json:"count"`
+	Amount float64     `json:"amount"`
+}
+
+// UtxoSetInfo 接口返回的utxo集合统计
+type UtxoSetInfo struct {
+	Height      int64            `json:"height"`
+	Count       uint64           `json:"count"`
+	Supply      float64          `json:"supply"`
+	MuHash      string           `json:"muhash"`
+	ByValue     []*UtxoSetBucket `json:"by_value"`
+	ByAgeBlocks []*UtxoSetBucket `json:"by_age_blocks"`
+}
+
+// GetUtxoSetInfo 汇总utxo集合统计, 年龄按已索引高度计算, 误差不超过一个分组(100个区块)
+func (d *RawDB) GetUtxoSetInfo() (*UtxoSetInfo, error) {
+	set, err := d.GetUtxoSet()
+	if err != nil {
+		return nil, err
+	}
+	tip, err := d.GetHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &UtxoSetInfo{
+		Height: set.Height,
+		Count:  set.Count,
+		Supply: float64(set.Supply) / 1e8,
+		MuHash: set.muhash.Finalize(),
+	}
+	for i := range set.ValueCounts {
+		bucket := &UtxoSetBucket{Count: set.ValueCounts[i], Amount: float64(set.ValueSats[i]) / 1e8}
+		if i < len(valueBuckets) {
+			bucket.Below = float64(valueBuckets[i]) / 1e8
+		}
+		info.ByValue = append(info.ByValue, bucket)
+	}
+
+	for i := 0; i <= len(ageBuckets); i++ {
+		bucket := &UtxoSetBucket{}
+		if i < len(ageBuckets) {
+			bucket.Below = ageBuckets[i]
+		}
+		info.ByAgeBlocks = append(info.ByAgeBlocks, bucket)
+	}
+	iter := d.read().NewIterator(util.BytesPrefix([]byte(utxoAgePrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var start int64
+		if _, err := fmt.Sscanf(string(iter.Key()[len(utxoAgePrefix):]), "%d", &start); err != nil {
+			continue
+		}
+		var age utxoAge
+		if err := rlp.DecodeBytes(iter.Value(), &age); err != nil {
+			return nil, err
+		}
+		i := len(ageBuckets)
+		for j, limit := range ageBuckets {
+			if tip-start < limit {
+				i = j
+				break
+			}
+		}
+		info.ByAgeBlocks[i].Count += age.Count
+		info.ByAgeBlocks[i].Amount += float64(age.Sats) / 1e8
+	}
+	return info, iter.Error()
+}
+
+// nodeUtxoSetInfo 节点 gettxoutsetinfo muhash 的结果
+type nodeUtxoSetInfo struct {
+	Height      int64   `json:"height"`
+	BestBlock   string  `json:"bestblock"`
+	TxOuts      uint64  `json:"txouts"`
+	TotalAmount float64 `json:"total_amount"`
+	MuHash      string  `json:"muhash"`
+}
+
+// getNodeUtxoSetInfo 先按高度查询(需要节点开启coinstatsindex), 失败时查询节点的最新状态
+func getNodeUtxoSetInfo(node *RPCClient, height int64) (*nodeUtxoSetInfo, error) {
+	hashType, _ := json.Marshal("muhash")
+	heightParam, _ := json.Marshal(height)
+	raw, err := node.RawRequest("gettxoutsetinfo", []json.RawMessage{hashType, heightParam})
+	if err != nil {
+		if raw, err = node.RawRequest("gettxoutsetinfo", []json.RawMessage{hashType}); err != nil {
+			return nil, err
+		}
+	}
+
+	var info nodeUtxoSetInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, err
+	}
+	if info.MuHash == "" {
+		return nil, errors.New("node does not report a muhash")
+	}
+	return &info, nil
+}
+
+// compareUtxoSet 比较索引与节点在同一高度的utxo集合, 返回不一致的项
+func compareUtxoSet(index *UtxoSetInfo, node *nodeUtxoSetInfo) []string {
+	if index.Height != node.Height {
+		return []string{fmt.Sprintf("height: index %d, node %d", index.Height, node.Height)}
+	}
+	var mismatches []string
+	if index.Count != node.TxOuts {
+		mismatches = append(mismatches, fmt.Sprintf("count: index %d, node %d", index.Count, node.TxOuts))
+	}
+	if toSats(index.Supply) != toSats(node.TotalAmount) {
+		mismatches = append(mismatches, fmt.Sprintf("supply: index %.8f, node %.8f", index.Supply, node.TotalAmount))
+	}
+	if index.MuHash != node.MuHash {
+		mismatches = append(mismatches, fmt.Sprintf("muhash: index %s, node %s", index.MuHash, node.MuHash))
+	}
+	return mismatches
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dogecoinw/doged/chaincfg"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const walletPrefix = "wallet-"
+
+var walletNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// WalletEntry 钱包的一个条目, 地址(或脚本哈希)或xpub, xpub包括前Gap个收款和找零地址
+type WalletEntry struct {
+	Address string `json:"address,omitempty"`
+	Xpub    string `json:"xpub,omitempty"`
+	Gap     uint32 `json:"gap,omitempty"`
+	Label   string `json:"label"`
+}
+
+// Wallet 只读钱包, 与区块无关, 从数据库读取而不是区块快照
+type Wallet struct {
+	Name    string         `json:"name"`
+	Entries []*WalletEntry `json:"entries"`
+}
+
+// WalletAddress 展开后的一个地址, xpub派生的地址带有路径
+type WalletAddress struct {
+	Address string `json:"address"`
+	Label   string `json:"label"`
+	Xpub    string `json:"xpub,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// WalletBalance 钱包中一个地址的余额
+type WalletBalance struct {
+	*WalletAddress
+	Balance float64 `json:"balance"`
+}
+
+// WalletUtxo 带有地址标签的utxo
+type WalletUtxo struct {
+	*Vin
+	Label string `json:"label"`
+}
+
+func walletKey(name string) []byte {
+	return []byte(walletPrefix + name)
+}
+
+// key 同一地址或xpub在钱包中只出现一次
+func (e *WalletEntry) key() string {
+	if e.Xpub != "" {
+		return e.Xpub
+	}
+	return e.Address
+}
+
+// validate 检查条目: 地址和xpub只能有一个, 地址可以是该链的地址或脚本哈希
+func (e *WalletEntry) validate(params *chaincfg.Params) error {
+	switch {
+	case e.Address != "" && e.Xpub != "":
+		return errors.New("entry has both address and xpub")
+	case e.Xpub != "":
+		_, err := deriveXpub(e.Xpub, e.Gap, params)
+		return err
+	case e.Address != "":
+		if _, err := decodeAddress(e.Address, params); err == nil {
+			return nil
+		}
+		if hash, err := hex.DecodeString(e.Address); err == nil && len(hash) == 32 {
+			return nil
+		}
+		return fmt.Errorf("invalid address %s", e.Address)
+	default:
+		return errors.New("entry has neither address nor xpub")
+	}
+}
+
+// Put 加入条目, 已有相同的地址或xpub时更新标签和gap
+func (w *Wallet) Put(entry *WalletEntry) {
+	for i, e := range w.Entries {
+		if e.key() == entry.key() {
+			w.Entries[i] = entry
+			return
+		}
+	}
+	w.Entries = append(w.Entries, entry)
+}
+
+// Remove 移除地址或xpub, 不存在时返回false
+func (w *Wallet) Remove(key string) bool {
+	for i, e := range w.Entries {
+		if e.key() == key {
+			w.Entries = append(w.Entries[:i], w.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses 展开所有条目, 同一地址出现多次时使用第一个条目的标签
+func (w *Wallet) Addresses(params *chaincfg.Params) ([]*WalletAddress, error) {
+	seen := make(map[string]bool)
+	addresses := make([]*WalletAddress, 0)
+	add := func(a *WalletAddress) {
+		if !seen[a.Address] {
+			seen[a.Address] = true
+			addresses = append(addresses, a)
+		}
+	}
+	for _, e := range w.Entries {
+		if e.Xpub == "" {
+			add(&WalletAddress{Address: e.Address, Label: e.Label})
+			continue
+		}
+		derived, err := deriveXpub(e.Xpub, e.Gap, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range derived {
+			add(&WalletAddress{Address: d.Address, Label: e.Label, Xpub: e.Xpub, Path: d.Path})
+		}
+	}
+	return addresses, nil
+}
+
+// 保存钱包
+func (d *RawDB) SetWallet(w *Wallet) error {
+	if !walletNamePattern.MatchString(w.Name) {
+		return fmt.Errorf("invalid wallet name %q", w.Name)
+	}
+	data, err := rlp.EncodeToBytes(w)
+	if err != nil {
+		return err
+	}
+	return d.DB.Put(walletKey(w.Name), data, nil)
+}
+
+// 获取钱包, 始终读取最新数据
+func (d *RawDB) GetWallet(name string) (*Wallet, error) {
+	data, err := d.DB.Get(walletKey(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	w := &Wallet{}
+	if err := rlp.DecodeBytes(data, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// 删除钱包
+func (d *RawDB) DelWallet(name string) error {
+	return d.DB.Delete(walletKey(name), nil)
+}
+
+// GetWallets 返回所有钱包的名称
+func (d *RawDB) GetWallets() ([]string, error) {
+	iter := d.DB.NewIterator(util.BytesPrefix([]byte(walletPrefix)), nil)
+	defer iter.Release()
+
+	names := make([]string, 0)
+	for iter.Next() {
+		names = append(names, strings.TrimPrefix(string(iter.Key()), walletPrefix))
+	}
+	return names, iter.Error()
+}
+
+// GetWalletBalance 汇总钱包的余额, 按聪累加避免浮点误差, 只返回余额不为0的地址
+func (d *RawDB) GetWalletBalance(addresses []*WalletAddress) (float64, []*WalletBalance, error) {
+	total := uint64(0)
+	balances := make([]*WalletBalance, 0)
+	for _, a := range addresses {
+		balance, err := d.GetBalance(a.Address)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if balance == 0 {
+			continue
+		}
+		total += toSats(balance)
+		balances = append(balances, &WalletBalance{WalletAddress: a, Balance: balance})
+	}
+	return float64(total) / 1e8, balances, nil
+}
+
+// GetWalletUtxo 合并钱包所有地址的utxo, 按高度从新到旧排序
+func (d *RawDB) GetWalletUtxo(addresses []*WalletAddress, filter *UtxoFilter) ([]*WalletUtxo, float64, error) {
+	total := uint64(0)
+	utxos := make([]*WalletUtxo, 0)
+	for _, a := range addresses {
+		vins, _, err := d.GetAllUtxo(a.Address, math.MaxFloat64, math.MaxInt64, 0, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, vin := range vins {
+			total += toSats(vin.Value)
+			utxos = append(utxos, &WalletUtxo{Vin: vin, Label: a.Label})
+		}
+	}
+	sort.SliceStable(utxos, func(i, j int) bool {
+		return utxos[i].Height > utxos[j].Height
+	})
+	return utxos, float64(total) / 1e8, nil
+}
+
+// walletTxRef tx-address- 索引中的一条记录
+type walletTxRef struct {
+	txid   string
+	height int64
+	time   int64
+}
+
+// GetWalletTxs 合并钱包所有地址的交易历史并按高度从新到旧分页, 涉及多个地址的交易只返回一次.
+// tx-address- 中的高度没有补齐, key的顺序不是高度的顺序, 所以先读取所有地址的全部索引再排序.
+func (d *RawDB) GetWalletTxs(addresses []*WalletAddress, limit, offset int64) ([]*Tx, error) {
+	seen := make(map[string]bool)
+	var refs []*walletTxRef
+	for _, a := range addresses {
+		iter := d.read().NewIterator(util.BytesPrefix([]byte(txAddressPrefix+a.Address+"-")), nil)
+		for iter.Next() {
+			parts := strings.Split(strings.TrimPrefix(string(iter.Key()), txAddressPrefix+a.Address+"-"), "-")
+			if len(parts) != 3 {
+				continue
+			}
+			if seen[parts[2]] {
+				continue
+			}
+			seen[parts[2]] = true
+			ref := &walletTxRef{txid: parts[2]}
+			ref.height, _ = strconv.ParseInt(parts[0], 10, 64)
+			ref.time, _ = strconv.ParseInt(parts[1], 10, 64)
+			refs = append(refs, ref)
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].height != refs[j].height {
+			return refs[i].height > refs[j].height
+		}
+		return refs[i].txid > refs[j].txid
+	})
+
+	txs := make([]*Tx, 0)
+	for i := offset; i < int64(len(refs)) && int64(len(txs)) < limit; i++ {
+		tx, err := d.GetTx(refs[i].txid)
+		if err != nil {
+			continue
+		}
+		tx.Height = refs[i].height
+		tx.Time = refs[i].time
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestWallet(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &RawDB{DB: ldb}
+	defer db.Stop()
+
+	// 高度9和10用于检查 tx-address- 中未补齐的高度按数值排序
+	a0 := &Vout{Index: 0, Address: "X", Value: 50, ScriptHash: "sx"}
+	applyTestBlock(t, db, 9, []*Tx{{Txid: "A", Vouts: []*Vout{a0, {Index: 1, Address: "XY", Value: 7, ScriptHash: "sxy"}}}})
+	applyTestBlock(t, db, 10, []*Tx{{Txid: "B", Vins: []*Vin{a0.AsVin("A")}, Vouts: []*Vout{
+		{Index: 0, Address: "Y", Value: 30, ScriptHash: "sy"},
+		{Index: 1, Address: "X", Value: 19, ScriptHash: "sx"},
+	}}})
+
+	w := &Wallet{Name: "customer-1"}
+	w.Put(&WalletEntry{Address: "X", Label: "old"})
+	w.Put(&WalletEntry{Address: "Y", Label: "savings"})
+	w.Put(&WalletEntry{Address: "X", Label: "hot"})
+	if err := db.SetWallet(w); err != nil {
+		t.Fatal(err)
+	}
+	w, err = db.GetWallet("customer-1")
+	if err != nil || len(w.Entries) != 2 || w.Entries[0].Label != "hot" {
+		t.Fatalf("wallet %+v (%v)", w, err)
+	}
+	addresses, err := w.Addresses(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance, balances, err := db.GetWalletBalance(addresses)
+	if err != nil || balance != 49 || len(balances) != 2 {
+		t.Errorf("balance %v %+v (%v)", balance, balances, err)
+	}
+
+	utxos, amount, err := db.GetWalletUtxo(addresses, nil)
+	if err != nil || amount != 49 || len(utxos) != 2 {
+		t.Fatalf("utxo %v %+v (%v)", amount, utxos, err)
+	}
+	for _, utxo := range utxos {
+		if utxo.Address == "XY" {
+			t.Error("utxo of XY included")
+		}
+	}
+
+	// B同时涉及X和Y, 只返回一次
+	txs, err := db.GetWalletTxs(addresses, 10, 0)
+	if err != nil || len(txs) != 2 || txs[0].Txid != "B" || txs[0].Height != 10 || txs[1].Txid != "A" {
+		t.Fatalf("txs %+v (%v)", txs, err)
+	}
+	if txs, _ := db.GetWalletTxs(addresses, 1, 1); len(txs) != 1 || txs[0].Txid != "A" {
+		t.Errorf("second page %+v", txs)
+	}
+
+	if !w.Remove("Y") || w.Remove("Y") || len(w.Entries) != 1 {
+		t.Errorf("remove: %+v", w.Entries)
+	}
+	if err := db.SetWallet(&Wallet{Name: "bad name"}); err == nil {
+		t.Error("expected invalid name error")
+	}
+}